@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS outbox_events_status_next_attempt_at_idx;
+
+ALTER TABLE outbox_events DROP COLUMN next_attempt_at;
@@ -0,0 +1,4 @@
+ALTER TABLE outbox_events
+    ADD COLUMN next_attempt_at TIMESTAMP;    -- Matches the NextAttemptAt field (time.Time, nullable)
+
+CREATE INDEX outbox_events_status_next_attempt_at_idx ON outbox_events (status, next_attempt_at);
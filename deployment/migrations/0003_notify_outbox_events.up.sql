@@ -0,0 +1,15 @@
+-- Announces new outbox events so that sidecars configured with database.notify_channel can
+-- fetch them right after the inserting transaction commits. The trigger argument names the
+-- channel; to use another channel than outbox_events, recreate the trigger with its name, e.g.
+-- EXECUTE FUNCTION notify_outbox_events('orders_outbox'). The sidecar refuses to start when
+-- no trigger notifies its channel.
+CREATE OR REPLACE FUNCTION notify_outbox_events() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify(TG_ARGV[0], '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER outbox_events_notify
+    AFTER INSERT ON outbox_events
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_outbox_events('outbox_events');
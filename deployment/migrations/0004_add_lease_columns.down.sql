@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS outbox_events_status_locked_until_idx;
+
+ALTER TABLE outbox_events
+    DROP COLUMN locked_until,
+    DROP COLUMN locked_by;
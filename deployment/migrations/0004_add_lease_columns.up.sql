@@ -0,0 +1,5 @@
+ALTER TABLE outbox_events
+    ADD COLUMN locked_by TEXT,               -- Instance ID of the sidecar holding the lease (nullable)
+    ADD COLUMN locked_until TIMESTAMP;       -- Expiry of the lease (nullable)
+
+CREATE INDEX outbox_events_status_locked_until_idx ON outbox_events (status, locked_until);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS outbox_event_attempts;
+
+ALTER TABLE outbox_events DROP COLUMN last_error;
@@ -0,0 +1,15 @@
+ALTER TABLE outbox_events
+    ADD COLUMN last_error TEXT;              -- Matches the LastError field (string, nullable)
+
+-- One row per publish attempt, written when database.record_attempts is enabled.
+-- Matches the EventAttempt type.
+CREATE TABLE outbox_event_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    event_id TEXT NOT NULL REFERENCES outbox_events (id) ON DELETE CASCADE,
+    attempted_at TIMESTAMP NOT NULL,
+    instance_id TEXT NOT NULL,
+    broker TEXT NOT NULL,
+    error TEXT                               -- NULL when the attempt succeeded
+);
+
+CREATE INDEX outbox_event_attempts_event_id_idx ON outbox_event_attempts (event_id, attempted_at);
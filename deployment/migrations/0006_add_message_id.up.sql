@@ -0,0 +1,2 @@
+ALTER TABLE outbox_events
+    ADD COLUMN message_id TEXT;              -- Matches the MessageID field (string, nullable)
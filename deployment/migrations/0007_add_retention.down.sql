@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS outbox_events_archive;
+
+DROP INDEX IF EXISTS outbox_events_status_updated_at_idx;
@@ -0,0 +1,8 @@
+-- Serves the retention janitor, which purges events by status and age.
+CREATE INDEX outbox_events_status_updated_at_idx ON outbox_events (status, updated_at);
+
+-- Purged events are moved here when retention.archive is enabled. The janitor copies rows
+-- column by column, so columns added to outbox_events must be added here too, in the same order.
+CREATE TABLE outbox_events_archive (LIKE outbox_events INCLUDING DEFAULTS);
+
+ALTER TABLE outbox_events_archive ADD PRIMARY KEY (id);
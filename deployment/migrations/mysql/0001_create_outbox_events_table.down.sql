@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS outbox_events_archive;
+DROP TABLE IF EXISTS outbox_event_attempts;
+DROP TABLE IF EXISTS outbox_events;
@@ -0,0 +1,40 @@
+-- MySQL 8 / MariaDB 10.6+ schema, equivalent to the PostgreSQL migrations 0001 to 0007 in
+-- the parent directory. Apply it with golang-migrate pointed at this directory.
+CREATE TABLE outbox_events (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,          -- Matches the ID field (string)
+    entity VARCHAR(255) NOT NULL,                  -- Matches the Topic field (string)
+    entity_type VARCHAR(255) NOT NULL,             -- Matches the EntityType field (string)
+    payload LONGBLOB NOT NULL,                     -- Matches the Payload field ([]byte)
+    status VARCHAR(32) NOT NULL DEFAULT 'pending', -- Matches the Status field (Status enum)
+    created_at DATETIME(6) NOT NULL,               -- Matches the CreatedAt field (time.Time, UTC)
+    updated_at DATETIME(6) NOT NULL,               -- Matches the UpdatedAt field (time.Time, UTC)
+    sent_at DATETIME(6),                           -- Matches the SentAt field (time.Time, nullable)
+    message_id VARCHAR(255),                       -- Matches the MessageID field (string, nullable)
+    headers JSON,                                  -- Matches the EventHeaders field (map[string]string)
+    retry_count INT NOT NULL DEFAULT 0,            -- Matches the RetryCount field (int)
+    routing_key VARCHAR(255) NOT NULL DEFAULT '',  -- Matches the RoutingKey field (string)
+    next_attempt_at DATETIME(6),                   -- Matches the NextAttemptAt field (time.Time, nullable)
+    locked_by VARCHAR(255),                        -- Instance ID of the sidecar holding the lease (nullable)
+    locked_until DATETIME(6),                      -- Expiry of the lease (nullable)
+    last_error TEXT,                               -- Matches the LastError field (string, nullable)
+    INDEX outbox_events_status_next_attempt_at_idx (status, next_attempt_at),
+    INDEX outbox_events_status_locked_until_idx (status, locked_until),
+    INDEX outbox_events_status_updated_at_idx (status, updated_at)
+);
+
+-- One row per publish attempt, written when database.record_attempts is enabled.
+-- Matches the EventAttempt type.
+CREATE TABLE outbox_event_attempts (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    event_id VARCHAR(255) NOT NULL,
+    attempted_at DATETIME(6) NOT NULL,
+    instance_id VARCHAR(255) NOT NULL,
+    broker VARCHAR(64) NOT NULL,
+    error TEXT,                                    -- NULL when the attempt succeeded
+    INDEX outbox_event_attempts_event_id_idx (event_id, attempted_at),
+    CONSTRAINT outbox_event_attempts_event_id_fk FOREIGN KEY (event_id) REFERENCES outbox_events (id) ON DELETE CASCADE
+);
+
+-- Purged events are moved here when retention.archive is enabled. The janitor copies rows
+-- column by column, so columns added to outbox_events must be added here too, in the same order.
+CREATE TABLE outbox_events_archive LIKE outbox_events;
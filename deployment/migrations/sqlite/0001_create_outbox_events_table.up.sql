@@ -0,0 +1,59 @@
+-- SQLite schema, equivalent to the PostgreSQL migrations 0001 to 0007 in the parent
+-- directory. Timestamps are stored as UTC text, e.g. '2024-01-02 15:04:05.123+00:00';
+-- CURRENT_TIMESTAMP works too. Apply it with golang-migrate pointed at this directory.
+CREATE TABLE outbox_events (
+    id TEXT NOT NULL PRIMARY KEY,            -- Matches the ID field (string)
+    entity TEXT NOT NULL,                    -- Matches the Topic field (string)
+    entity_type TEXT NOT NULL,               -- Matches the EntityType field (string)
+    payload BLOB NOT NULL,                   -- Matches the Payload field ([]byte)
+    status TEXT NOT NULL DEFAULT 'pending',  -- Matches the Status field (Status enum)
+    created_at DATETIME NOT NULL,            -- Matches the CreatedAt field (time.Time, UTC)
+    updated_at DATETIME NOT NULL,            -- Matches the UpdatedAt field (time.Time, UTC)
+    sent_at DATETIME,                        -- Matches the SentAt field (time.Time, nullable)
+    message_id TEXT,                         -- Matches the MessageID field (string, nullable)
+    headers TEXT,                            -- Matches the EventHeaders field (map[string]string, as JSON)
+    retry_count INTEGER NOT NULL DEFAULT 0,  -- Matches the RetryCount field (int)
+    routing_key TEXT NOT NULL DEFAULT '',    -- Matches the RoutingKey field (string)
+    next_attempt_at DATETIME,                -- Matches the NextAttemptAt field (time.Time, nullable)
+    locked_by TEXT,                          -- Instance ID of the sidecar holding the lease (nullable)
+    locked_until DATETIME,                   -- Expiry of the lease (nullable)
+    last_error TEXT                          -- Matches the LastError field (string, nullable)
+);
+
+CREATE INDEX outbox_events_status_next_attempt_at_idx ON outbox_events (status, next_attempt_at);
+CREATE INDEX outbox_events_status_locked_until_idx ON outbox_events (status, locked_until);
+CREATE INDEX outbox_events_status_updated_at_idx ON outbox_events (status, updated_at);
+
+-- One row per publish attempt, written when database.record_attempts is enabled.
+-- Matches the EventAttempt type.
+CREATE TABLE outbox_event_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_id TEXT NOT NULL REFERENCES outbox_events (id) ON DELETE CASCADE,
+    attempted_at DATETIME NOT NULL,
+    instance_id TEXT NOT NULL,
+    broker TEXT NOT NULL,
+    error TEXT                               -- NULL when the attempt succeeded
+);
+
+CREATE INDEX outbox_event_attempts_event_id_idx ON outbox_event_attempts (event_id, attempted_at);
+
+-- Purged events are moved here when retention.archive is enabled. The janitor copies rows
+-- column by column, so columns added to outbox_events must be added here too, in the same order.
+CREATE TABLE outbox_events_archive (
+    id TEXT NOT NULL PRIMARY KEY,
+    entity TEXT NOT NULL,
+    entity_type TEXT NOT NULL,
+    payload BLOB NOT NULL,
+    status TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    sent_at DATETIME,
+    message_id TEXT,
+    headers TEXT,
+    retry_count INTEGER NOT NULL,
+    routing_key TEXT NOT NULL,
+    next_attempt_at DATETIME,
+    locked_by TEXT,
+    locked_until DATETIME,
+    last_error TEXT
+);
@@ -0,0 +1,13 @@
+CREATE TABLE outbox (
+    id STRING(MAX) NOT NULL,
+    entity STRING(MAX) NOT NULL,
+    entity_type STRING(MAX) NOT NULL,
+    payload BYTES(MAX) NOT NULL,
+    status STRING(MAX) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP,
+    headers JSON,
+    retry_count INT64 NOT NULL,
+    routing_key STRING(MAX) NOT NULL,
+) PRIMARY KEY (id);
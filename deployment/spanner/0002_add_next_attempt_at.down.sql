@@ -0,0 +1,3 @@
+DROP INDEX outbox_status_next_attempt_at_idx;
+
+ALTER TABLE outbox DROP COLUMN next_attempt_at;
@@ -0,0 +1,3 @@
+ALTER TABLE outbox ADD COLUMN next_attempt_at TIMESTAMP;
+
+CREATE INDEX outbox_status_next_attempt_at_idx ON outbox (status, next_attempt_at);
@@ -0,0 +1 @@
+ALTER TABLE outbox ADD COLUMN locked_by STRING(MAX);
@@ -0,0 +1,3 @@
+DROP INDEX outbox_status_locked_until_idx;
+
+ALTER TABLE outbox DROP COLUMN locked_until;
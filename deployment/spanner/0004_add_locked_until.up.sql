@@ -0,0 +1,3 @@
+ALTER TABLE outbox ADD COLUMN locked_until TIMESTAMP;
+
+CREATE INDEX outbox_status_locked_until_idx ON outbox (status, locked_until);
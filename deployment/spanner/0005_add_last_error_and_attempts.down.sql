@@ -0,0 +1,3 @@
+DROP TABLE outbox_event_attempts;
+
+ALTER TABLE outbox DROP COLUMN last_error;
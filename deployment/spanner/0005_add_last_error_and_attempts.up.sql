@@ -0,0 +1,10 @@
+ALTER TABLE outbox ADD COLUMN last_error STRING(MAX);
+
+CREATE TABLE outbox_event_attempts (
+    event_id STRING(MAX) NOT NULL,
+    attempted_at TIMESTAMP NOT NULL,
+    instance_id STRING(MAX) NOT NULL,
+    broker STRING(MAX) NOT NULL,
+    error STRING(MAX),
+) PRIMARY KEY (event_id, attempted_at),
+  INTERLEAVE IN PARENT outbox ON DELETE CASCADE;
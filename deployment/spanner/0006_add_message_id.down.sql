@@ -0,0 +1 @@
+ALTER TABLE outbox DROP COLUMN message_id;
@@ -0,0 +1 @@
+ALTER TABLE outbox ADD COLUMN message_id STRING(MAX);
@@ -0,0 +1,3 @@
+DROP TABLE outbox_archive;
+
+DROP INDEX outbox_status_updated_at_idx;
@@ -0,0 +1,20 @@
+CREATE INDEX outbox_status_updated_at_idx ON outbox (status, updated_at);
+
+CREATE TABLE outbox_archive (
+    id STRING(MAX) NOT NULL,
+    entity STRING(MAX) NOT NULL,
+    entity_type STRING(MAX) NOT NULL,
+    payload BYTES(MAX) NOT NULL,
+    status STRING(MAX) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP,
+    headers JSON,
+    retry_count INT64 NOT NULL,
+    routing_key STRING(MAX) NOT NULL,
+    next_attempt_at TIMESTAMP,
+    locked_by STRING(MAX),
+    locked_until TIMESTAMP,
+    last_error STRING(MAX),
+    message_id STRING(MAX),
+) PRIMARY KEY (id);
@@ -0,0 +1,11 @@
+package schema
+
+// Headers added to an event when it is republished to the dead-letter topic.
+const (
+	HeaderOriginalID         = "x-original-id"
+	HeaderOriginalEntity     = "x-original-entity"
+	HeaderOriginalEntityType = "x-original-entity-type"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderRetryCount         = "x-retry-count"
+	HeaderLastError          = "x-last-error"
+)
@@ -0,0 +1,18 @@
+package schema
+
+import "time"
+
+// EventAttempt records one attempt to publish an outbox event. The relay keeps them in the
+// outbox_event_attempts table when attempt history is enabled.
+type EventAttempt struct {
+	EventID     string    `json:"event_id" bson:"event_id"`
+	AttemptedAt time.Time `json:"attempted_at" bson:"attempted_at"`
+	InstanceID  string    `json:"instance_id" bson:"instance_id"`         // relay instance that made the attempt
+	Broker      string    `json:"broker" bson:"broker"`                   // broker type the event was published to
+	Error       string    `json:"error,omitempty" bson:"error,omitempty"` // empty when the attempt succeeded
+}
+
+// Failed reports whether the attempt failed.
+func (a EventAttempt) Failed() bool {
+	return a.Error != ""
+}
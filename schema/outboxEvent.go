@@ -6,26 +6,30 @@ import "time"
 type Status string
 
 const (
-	StatusPending    Status = "pending"
-	StatusSent       Status = "sent"
-	StatusFailed     Status = "failed"
-	StatusCanceled   Status = "canceled"
-	StatusProcessing Status = "processing"
+	StatusPending      Status = "pending"
+	StatusSent         Status = "sent"
+	StatusFailed       Status = "failed"
+	StatusCanceled     Status = "canceled"
+	StatusProcessing   Status = "processing"
+	StatusDeadLettered Status = "dead_lettered"
 )
 
 // OutboxEvent represents an event stored in the outbox table.
 type OutboxEvent struct {
-	ID         string            `json:"id"`
-	Entity     string            `json:"entity"`
-	EntityType string            `json:"entity_type"`
-	Payload    []byte            `json:"payload"`
-	Status     Status            `json:"status"`
-	CreatedAt  time.Time         `json:"created_at"`
-	UpdatedAt  time.Time         `json:"updated_at"`
-	SentAt     time.Time         `json:"sent_at,omitempty"`
-	Headers    map[string]string `json:"headers"`
-	RetryCount int               `json:"retry_count"`
-	RoutingKey string            `json:"routing_key"`
+	ID            string            `json:"id" bson:"id"`
+	Entity        string            `json:"entity" bson:"entity"`
+	EntityType    string            `json:"entity_type" bson:"entity_type"`
+	Payload       []byte            `json:"payload" bson:"payload"`
+	Status        Status            `json:"status" bson:"status"`
+	CreatedAt     time.Time         `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at" bson:"updated_at"`
+	SentAt        time.Time         `json:"sent_at,omitempty" bson:"sent_at,omitempty"`
+	MessageID     string            `json:"message_id,omitempty" bson:"message_id,omitempty"` // ID the broker assigned on publish
+	Headers       map[string]string `json:"headers" bson:"headers"`
+	RetryCount    int               `json:"retry_count" bson:"retry_count"`
+	RoutingKey    string            `json:"routing_key" bson:"routing_key"`
+	NextAttemptAt time.Time         `json:"next_attempt_at,omitempty" bson:"next_attempt_at,omitempty"`
+	LastError     string            `json:"last_error,omitempty" bson:"last_error,omitempty"`
 }
 
 // NewEvent creates a new OutboxEvent with required fields and sensible defaults.
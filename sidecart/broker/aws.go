@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel"
+
+	"github.com/zoff-tech/go-outbox/config"
+)
+
+// AWSPayloadEncodingAttribute is the message attribute the sns and sqs brokers set to base64
+// when they had to encode the payload: SNS and SQS only accept messages of XML characters.
+const AWSPayloadEncodingAttribute = "outbox-payload-encoding"
+
+// AWSHeadersAttribute is the message attribute the sns and sqs brokers pack the headers into,
+// as a JSON object, that do not fit in message attributes of their own.
+const AWSHeadersAttribute = "outbox-headers"
+
+// awsMaxMessageAttributes is the number of message attributes SNS and SQS accept per message.
+const awsMaxMessageAttributes = 10
+
+// loadAWSConfig loads the default AWS configuration, using the region of settings if set.
+func loadAWSConfig(ctx context.Context, settings config.AWSSettings) (aws.Config, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if settings.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(settings.Region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load the AWS configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// awsMessageBody returns payload as a message body, base64 encoded if it is not text SNS and
+// SQS accept.
+func awsMessageBody(payload []byte) (body string, encoded bool) {
+	if isAWSMessageText(payload) {
+		return string(payload), false
+	}
+	return base64.StdEncoding.EncodeToString(payload), true
+}
+
+// isAWSMessageText reports whether b consists of the characters allowed in messages: #x9, #xA,
+// #xD, #x20 to #xD7FF, #xE000 to #xFFFD and #x10000 to #x10FFFF, UTF-8 encoded.
+func isAWSMessageText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+		case r >= 0x20 && r <= 0xD7FF:
+		case r >= 0xE000 && r <= 0xFFFD:
+		case r >= 0x10000 && r <= 0x10FFFF:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// awsMessageAttributes returns the message attributes carrying headers, which must not be
+// empty. Up to awsMaxMessageAttributes headers get an attribute each; of more, the payload
+// encoding, the trace context and then the first headers by name get one, and the others
+// are packed into AWSHeadersAttribute.
+func awsMessageAttributes(headers map[string]string) (map[string]string, error) {
+	names := make([]string, 0, len(headers))
+	for name, value := range headers {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	attributes := make(map[string]string, min(len(names), awsMaxMessageAttributes))
+	if len(names) <= awsMaxMessageAttributes {
+		for _, name := range names {
+			attributes[name] = headers[name]
+		}
+		return attributes, nil
+	}
+
+	priority := append([]string{AWSPayloadEncodingAttribute}, otel.GetTextMapPropagator().Fields()...)
+	rank := func(name string) int {
+		if i := slices.Index(priority, name); i >= 0 {
+			return i
+		}
+		return len(priority)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if rankA, rankB := rank(names[a]), rank(names[b]); rankA != rankB {
+			return rankA < rankB
+		}
+		return names[a] < names[b]
+	})
+
+	packed := make(map[string]string, len(names)-awsMaxMessageAttributes+1)
+	for i, name := range names {
+		if i < awsMaxMessageAttributes-1 {
+			attributes[name] = headers[name]
+		} else {
+			packed[name] = headers[name]
+		}
+	}
+	encoded, err := json.Marshal(packed)
+	if err != nil {
+		return nil, err
+	}
+	attributes[AWSHeadersAttribute] = string(encoded)
+	return attributes, nil
+}
+
+// isFIFO reports whether the topic or queue named, or identified by an ARN or URL ending, in
+// destination is a FIFO topic or queue.
+func isFIFO(destination string) bool {
+	return strings.HasSuffix(destination, ".fifo")
+}
+
+// isPermanentAWSError reports whether err rejects the message itself or the sidecar's access
+// to the topic or queue, so that sending it again fails the same way. A missing topic or queue
+// is not permanent, it may be created later.
+func isPermanentAWSError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "InvalidMessageContents", "AuthorizationError", "AccessDenied", "AccessDeniedException":
+		return true
+	case "InvalidParameter", "InvalidParameterValue":
+		// Other invalid parameters, e.g. of the request rather than the message, may be
+		// transient or fixed by configuration.
+		return isAWSMessageRejection(apiErr.ErrorMessage())
+	}
+	return false
+}
+
+// isAWSMessageRejection reports whether the message of an invalid parameter error rejects the
+// message attributes, e.g. "Number of message attributes [11] exceeds the allowed maximum
+// [10].", or the message size, e.g. "Message too long" or "Message must be shorter than
+// 262144 bytes.".
+func isAWSMessageRejection(message string) bool {
+	message = strings.ToLower(message)
+	for _, reason := range []string{"attribute", "message too long", "message must be shorter"} {
+		if strings.Contains(message, reason) {
+			return true
+		}
+	}
+	return false
+}
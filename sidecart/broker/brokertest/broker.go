@@ -0,0 +1,148 @@
+// Package brokertest provides an in-memory MessageBroker for tests.
+package brokertest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zoff-tech/go-outbox/broker"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// Broker is a thread-safe, in-memory broker.MessageBroker that records the events it accepts
+// and fails publishes on demand. Accepted events get the message ID "msg-<event ID>".
+type Broker struct {
+	mu        sync.Mutex
+	published []schema.OutboxEvent
+	failNext  []error
+	failFor   map[string]error
+	publishFn func(ctx context.Context, event *schema.OutboxEvent) error
+	attempts  int
+	closed    bool
+}
+
+// NewBroker creates a broker that accepts every publish.
+func NewBroker() *Broker {
+	return &Broker{failFor: make(map[string]error)}
+}
+
+// FailNext makes the next publishes fail with errs, one error per publish, in order.
+func (b *Broker) FailNext(errs ...error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failNext = append(b.failNext, errs...)
+}
+
+// FailEntity makes every publish to entity fail with err until it is called again with a
+// nil error.
+func (b *Broker) FailEntity(entity string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.failFor, entity)
+		return
+	}
+	b.failFor[entity] = err
+}
+
+// OnPublish sets a function called by every publish that is not failed by FailNext or
+// FailEntity, e.g. to block until the test releases it. The publish fails with its error.
+func (b *Broker) OnPublish(fn func(ctx context.Context, event *schema.OutboxEvent) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publishFn = fn
+}
+
+func (b *Broker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return broker.ErrClosed
+	}
+	b.attempts++
+	if len(b.failNext) > 0 {
+		err := b.failNext[0]
+		b.failNext = b.failNext[1:]
+		b.mu.Unlock()
+		return err
+	}
+	if err, ok := b.failFor[event.Entity]; ok {
+		b.mu.Unlock()
+		return err
+	}
+	publishFn := b.publishFn
+	b.mu.Unlock()
+
+	if publishFn != nil {
+		if err := publishFn(ctx, event); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	event.MessageID = "msg-" + event.ID
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, copyEvent(*event))
+	return nil
+}
+
+// Published returns the accepted events in the order they were published.
+func (b *Broker) Published() []schema.OutboxEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	published := make([]schema.OutboxEvent, len(b.published))
+	for i, event := range b.published {
+		published[i] = copyEvent(event)
+	}
+	return published
+}
+
+// PublishedTo returns the accepted events published to entity, in order.
+func (b *Broker) PublishedTo(entity string) []schema.OutboxEvent {
+	var published []schema.OutboxEvent
+	for _, event := range b.Published() {
+		if event.Entity == entity {
+			published = append(published, event)
+		}
+	}
+	return published
+}
+
+// Attempts returns how many publishes were attempted, failed ones included. Publishes after
+// Close are not counted.
+func (b *Broker) Attempts() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.attempts
+}
+
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+// Closed reports whether Close was called.
+func (b *Broker) Closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// copyEvent returns a copy of event that shares no memory with it.
+func copyEvent(event schema.OutboxEvent) schema.OutboxEvent {
+	event.Payload = append([]byte(nil), event.Payload...)
+	if event.Headers != nil {
+		headers := make(map[string]string, len(event.Headers))
+		for key, value := range event.Headers {
+			headers[key] = value
+		}
+		event.Headers = headers
+	}
+	return event
+}
@@ -0,0 +1,115 @@
+package brokertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/broker"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+var _ broker.MessageBroker = (*Broker)(nil)
+
+func TestPublish_RecordsAcceptedEvents(t *testing.T) {
+	b := NewBroker()
+
+	event := &schema.OutboxEvent{ID: "1", Entity: "orders", Headers: map[string]string{"trace": "abc"}}
+	require.NoError(t, b.Publish(context.Background(), event))
+	require.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "2", Entity: "payments"}))
+	assert.Equal(t, "msg-1", event.MessageID)
+
+	// Later changes to the event do not alter what was published.
+	event.Headers["trace"] = "changed"
+
+	published := b.Published()
+	require.Len(t, published, 2)
+	assert.Equal(t, "1", published[0].ID)
+	assert.Equal(t, "abc", published[0].Headers["trace"])
+	assert.Equal(t, "msg-1", published[0].MessageID)
+	assert.Equal(t, []schema.OutboxEvent{published[1]}, b.PublishedTo("payments"))
+	assert.Equal(t, 2, b.Attempts())
+}
+
+func TestPublish_FailNext(t *testing.T) {
+	b := NewBroker()
+	first, second := errors.New("first"), errors.New("second")
+	b.FailNext(first, second)
+
+	assert.ErrorIs(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1"}), first)
+	assert.ErrorIs(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1"}), second)
+	assert.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1"}))
+	assert.Len(t, b.Published(), 1)
+	assert.Equal(t, 3, b.Attempts())
+}
+
+func TestPublish_FailEntity(t *testing.T) {
+	b := NewBroker()
+	nack := errors.New("nack")
+	b.FailEntity("orders", nack)
+
+	assert.ErrorIs(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1", Entity: "orders"}), nack)
+	assert.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "2", Entity: "payments"}))
+
+	b.FailEntity("orders", nil)
+	assert.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1", Entity: "orders"}))
+	assert.Len(t, b.Published(), 2)
+}
+
+func TestPublish_OnPublish(t *testing.T) {
+	b := NewBroker()
+	release := make(chan struct{})
+	b.OnPublish(func(ctx context.Context, event *schema.OutboxEvent) error {
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, b.Publish(ctx, &schema.OutboxEvent{ID: "1"}), context.Canceled)
+	assert.Empty(t, b.Published())
+
+	close(release)
+	assert.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1"}))
+	assert.Len(t, b.Published(), 1)
+}
+
+func TestClose(t *testing.T) {
+	b := NewBroker()
+	assert.False(t, b.Closed())
+	require.NoError(t, b.Close())
+	assert.True(t, b.Closed())
+	assert.ErrorIs(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1"}), broker.ErrClosed)
+	assert.Zero(t, b.Attempts())
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Harness {
+		b := NewBroker()
+		return Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) Message {
+				received := 0
+				return func(t *testing.T) Message {
+					published := b.PublishedTo(entity)
+					require.Greater(t, len(published), received, "no message published to %s", entity)
+					event := published[received]
+					received++
+					return Message{Payload: event.Payload, Headers: event.Headers, Key: event.RoutingKey, MessageID: event.MessageID}
+				}
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				b.FailEntity(entity, broker.Permanent(errors.New("message too large")))
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity}
+			},
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package brokertest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/broker"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// Harness gives the conformance suite access to the broker under test, typically connected
+// to a local emulator or container.
+type Harness struct {
+	// NewBroker returns the broker under test. The suite closes it.
+	NewBroker func(t *testing.T) broker.MessageBroker
+	// Subscribe prepares entity, a destination of entityType that is new to the broker, to
+	// receive messages. The returned function returns the next message published to it and
+	// fails t when none arrives in time.
+	Subscribe func(t *testing.T, entity, entityType string) func(t *testing.T) Message
+	// Rejected returns an event for entity, prepared by Subscribe, that the broker rejects
+	// permanently, e.g. one exceeding its message size limit. When nil, the scenario is
+	// skipped.
+	Rejected func(t *testing.T, entity string) *schema.OutboxEvent
+	// EntitySuffix is appended to the entity names of the suite, e.g. .fifo for brokers that
+	// only keep the order of FIFO destinations.
+	EntitySuffix string
+}
+
+// Message is a message as received from the broker.
+type Message struct {
+	Payload []byte
+	Headers map[string]string
+	// Key is the key the message was published with: its ordering, partition or routing key.
+	Key       string
+	MessageID string
+}
+
+// conformanceEntityType is the entity type of the events published by the suite, a topic
+// exchange for RabbitMQ.
+const conformanceEntityType = "topic"
+
+// RunConformance runs the scenarios every broker.MessageBroker must pass, each as a subtest
+// of t. newHarness is called once per scenario.
+func RunConformance(t *testing.T, newHarness func(t *testing.T) Harness) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, h Harness, b broker.MessageBroker, entity string)
+	}{
+		{"PropagatesPayloadAndHeaders", testPropagatesPayloadAndHeaders},
+		{"PublishesEventsWithoutHeaders", testPublishesEventsWithoutHeaders},
+		{"KeepsOrderPerRoutingKey", testKeepsOrderPerRoutingKey},
+		{"ReportsCanceledPublishes", testReportsCanceledPublishes},
+		{"ClassifiesPermanentFailures", testClassifiesPermanentFailures},
+		{"FailsPublishesAfterClose", testFailsPublishesAfterClose},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			h := newHarness(t)
+			b := h.NewBroker(t)
+			t.Cleanup(func() { b.Close() })
+			scenario.run(t, h, b, fmt.Sprintf("outbox-conformance-%d%s", time.Now().UnixNano(), h.EntitySuffix))
+		})
+	}
+}
+
+// conformanceEvent returns an event for entity.
+func conformanceEvent(id, entity string) *schema.OutboxEvent {
+	return &schema.OutboxEvent{
+		ID:         id,
+		Entity:     entity,
+		EntityType: conformanceEntityType,
+		Payload:    []byte(`{"id":"` + id + `"}`),
+		Headers:    map[string]string{"tenant": "acme"},
+	}
+}
+
+// assertHeaders asserts that every header of want was received. Brokers may add headers of
+// their own, e.g. the trace context.
+func assertHeaders(t *testing.T, want, received map[string]string) {
+	t.Helper()
+	for key, value := range want {
+		assert.Equal(t, value, received[key], "header %s", key)
+	}
+}
+
+func testPropagatesPayloadAndHeaders(t *testing.T, h Harness, b broker.MessageBroker, entity string) {
+	receive := h.Subscribe(t, entity, conformanceEntityType)
+
+	event := conformanceEvent("1", entity)
+	event.Payload = []byte{0x00, 0xff, 0x10, '\n'}
+	event.RoutingKey = "order.created"
+	event.Headers = map[string]string{
+		"tenant":           "acme",
+		"content-language": "de-CH",
+		"note":             "grüezi, 世界",
+	}
+	require.NoError(t, b.Publish(context.Background(), event))
+	assert.NotEmpty(t, event.MessageID)
+
+	message := receive(t)
+	assert.Equal(t, event.Payload, message.Payload)
+	assertHeaders(t, event.Headers, message.Headers)
+	assert.Equal(t, "order.created", message.Key)
+	assert.Equal(t, event.MessageID, message.MessageID)
+}
+
+func testPublishesEventsWithoutHeaders(t *testing.T, h Harness, b broker.MessageBroker, entity string) {
+	receive := h.Subscribe(t, entity, conformanceEntityType)
+
+	event := conformanceEvent("1", entity)
+	event.Headers = nil
+	require.NoError(t, b.Publish(context.Background(), event))
+
+	message := receive(t)
+	assert.Equal(t, event.Payload, message.Payload)
+	assert.Equal(t, event.MessageID, message.MessageID)
+}
+
+func testKeepsOrderPerRoutingKey(t *testing.T, h Harness, b broker.MessageBroker, entity string) {
+	const events = 10
+	receive := h.Subscribe(t, entity, conformanceEntityType)
+
+	// The processor publishes the events of a routing key one after the other.
+	for i := 0; i < events; i++ {
+		event := conformanceEvent(fmt.Sprintf("event-%02d", i), entity)
+		event.RoutingKey = "order-1"
+		require.NoError(t, b.Publish(context.Background(), event))
+	}
+
+	for i := 0; i < events; i++ {
+		message := receive(t)
+		assert.Equal(t, fmt.Sprintf(`{"id":"event-%02d"}`, i), string(message.Payload))
+		assert.Equal(t, "order-1", message.Key)
+	}
+}
+
+func testReportsCanceledPublishes(t *testing.T, h Harness, b broker.MessageBroker, entity string) {
+	h.Subscribe(t, entity, conformanceEntityType)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	event := conformanceEvent("1", entity)
+	err := b.Publish(ctx, event)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, broker.IsPermanent(err), "a canceled publish can be retried")
+	assert.Empty(t, event.MessageID)
+
+	// The broker is still usable.
+	assert.NoError(t, b.Publish(context.Background(), conformanceEvent("2", entity)))
+}
+
+func testClassifiesPermanentFailures(t *testing.T, h Harness, b broker.MessageBroker, entity string) {
+	if h.Rejected == nil {
+		t.Skip("the broker rejects no event permanently")
+	}
+
+	h.Subscribe(t, entity, conformanceEntityType)
+	event := h.Rejected(t, entity)
+	err := b.Publish(context.Background(), event)
+	assert.True(t, broker.IsPermanent(err), "got %v", err)
+	assert.Empty(t, event.MessageID)
+}
+
+func testFailsPublishesAfterClose(t *testing.T, h Harness, b broker.MessageBroker, entity string) {
+	h.Subscribe(t, entity, conformanceEntityType)
+	require.NoError(t, b.Publish(context.Background(), conformanceEvent("1", entity)))
+
+	require.NoError(t, b.Close())
+	event := conformanceEvent("2", entity)
+	assert.ErrorIs(t, b.Publish(context.Background(), event), broker.ErrClosed)
+	assert.Empty(t, event.MessageID)
+	assert.NoError(t, b.Close(), "closing twice")
+}
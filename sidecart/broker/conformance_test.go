@@ -0,0 +1,606 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/redis/go-redis/v9"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/zoff-tech/go-outbox/broker"
+	"github.com/zoff-tech/go-outbox/broker/brokertest"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Every broker runs the conformance suite of brokertest. Pub/Sub runs against the in-process
+// pstest fake, RabbitMQ is skipped unless OUTBOX_TEST_RABBITMQ_URL points at a server, and
+// Kafka runs against OUTBOX_TEST_KAFKA_BROKERS (e.g. a Redpanda container) if set, against
+// the in-process kfake cluster otherwise. NATS likewise runs against OUTBOX_TEST_NATS_URL if
+// set, against an embedded nats-server otherwise, and Redis against OUTBOX_TEST_REDIS_URL or
+// an in-process miniredis. SNS and SQS are skipped unless OUTBOX_TEST_AWS_ENDPOINT points at
+// LocalStack; they publish to FIFO topics and queues, which keep the order of a routing key.
+// Webhooks are posted to an httptest server.
+
+// receiveTimeout is how long the harnesses wait for a published message.
+const receiveTimeout = 10 * time.Second
+
+// receiver returns a function receiving the next message of messages.
+func receiver(entity string, messages <-chan brokertest.Message) func(t *testing.T) brokertest.Message {
+	return func(t *testing.T) brokertest.Message {
+		t.Helper()
+		select {
+		case message := <-messages:
+			return message
+		case <-time.After(receiveTimeout):
+			t.Fatalf("no message received from %s within %s", entity, receiveTimeout)
+			return brokertest.Message{}
+		}
+	}
+}
+
+func TestPubSubBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		const projectID = "test-project"
+		server := pstest.NewServer()
+		t.Cleanup(func() { server.Close() })
+		conn, err := grpc.NewClient(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		admin, err := pubsub.NewClient(context.Background(), projectID, option.WithGRPCConn(conn))
+		require.NoError(t, err)
+
+		return brokertest.Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				b, err := broker.NewPubSubClient(context.Background(), &config.BrokerSettings{ProjectID: projectID}, option.WithGRPCConn(conn))
+				require.NoError(t, err)
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) brokertest.Message {
+				topic, err := admin.CreateTopic(context.Background(), entity)
+				require.NoError(t, err)
+				subscription, err := admin.CreateSubscription(context.Background(), entity, pubsub.SubscriptionConfig{
+					Topic:                 topic,
+					EnableMessageOrdering: true,
+				})
+				require.NoError(t, err)
+
+				messages := make(chan brokertest.Message, 100)
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					subscription.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+						m.Ack()
+						messages <- brokertest.Message{Payload: m.Data, Headers: m.Attributes, Key: m.OrderingKey, MessageID: m.ID}
+					})
+				}()
+				t.Cleanup(func() {
+					cancel()
+					<-done
+				})
+				return receiver(entity, messages)
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				// Pub/Sub refuses messages over 10 MB.
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity, Payload: make([]byte, pubsub.MaxPublishRequestBytes+1)}
+			},
+		}
+	})
+}
+
+func TestRabbitMQBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		url := os.Getenv("OUTBOX_TEST_RABBITMQ_URL")
+		if url == "" {
+			t.Skip("OUTBOX_TEST_RABBITMQ_URL is not set, skipping RabbitMQ integration test")
+		}
+		conn, err := amqp.Dial(url)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		return brokertest.Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				b, err := broker.NewRabbitMqBroker(context.Background(), &config.BrokerSettings{URL: url, PoolSize: 2})
+				require.NoError(t, err)
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) brokertest.Message {
+				channel, err := conn.Channel()
+				require.NoError(t, err)
+				t.Cleanup(func() {
+					channel.ExchangeDelete(entity, false, false)
+					channel.Close()
+				})
+
+				// Declared as the broker does, so that its declaration matches.
+				require.NoError(t, channel.ExchangeDeclare(entity, entityType, true, false, false, false, nil))
+				queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+				require.NoError(t, err)
+				require.NoError(t, channel.QueueBind(queue.Name, "#", entity, false, nil))
+				deliveries, err := channel.Consume(queue.Name, "", true, true, false, false, nil)
+				require.NoError(t, err)
+
+				messages := make(chan brokertest.Message, 100)
+				go func() {
+					for d := range deliveries {
+						headers := make(map[string]string, len(d.Headers))
+						for key, value := range d.Headers {
+							headers[key] = fmt.Sprint(value)
+						}
+						messages <- brokertest.Message{Payload: d.Body, Headers: headers, Key: d.RoutingKey, MessageID: d.MessageId}
+					}
+				}()
+				return receiver(entity, messages)
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				// RabbitMQ refuses to redeclare an exchange with another type.
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity, EntityType: "fanout"}
+			},
+		}
+	})
+}
+
+func TestKafkaBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		seeds := os.Getenv("OUTBOX_TEST_KAFKA_BROKERS")
+		if seeds == "" {
+			cluster, err := kfake.NewCluster(kfake.NumBrokers(1))
+			require.NoError(t, err)
+			t.Cleanup(cluster.Close)
+			seeds = strings.Join(cluster.ListenAddrs(), ",")
+		}
+		admin, err := kgo.NewClient(kgo.SeedBrokers(strings.Split(seeds, ",")...))
+		require.NoError(t, err)
+		t.Cleanup(admin.Close)
+
+		return brokertest.Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				b, err := broker.NewKafkaBroker(context.Background(), &config.BrokerSettings{Type: "kafka", URL: seeds})
+				require.NoError(t, err)
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) brokertest.Message {
+				topic := kmsg.NewCreateTopicsRequestTopic()
+				topic.Topic = entity
+				topic.NumPartitions = 3
+				topic.ReplicationFactor = 1
+				request := kmsg.NewPtrCreateTopicsRequest()
+				request.Topics = append(request.Topics, topic)
+				response, err := request.RequestWith(context.Background(), admin)
+				require.NoError(t, err)
+				require.NoError(t, kerr.ErrorForCode(response.Topics[0].ErrorCode))
+
+				consumer, err := kgo.NewClient(
+					kgo.SeedBrokers(strings.Split(seeds, ",")...),
+					kgo.ConsumeTopics(entity),
+					kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+				)
+				require.NoError(t, err)
+
+				messages := make(chan brokertest.Message, 100)
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for ctx.Err() == nil {
+						consumer.PollFetches(ctx).EachRecord(func(r *kgo.Record) {
+							headers := make(map[string]string, len(r.Headers))
+							for _, header := range r.Headers {
+								headers[header.Key] = string(header.Value)
+							}
+							messages <- brokertest.Message{
+								Payload:   r.Value,
+								Headers:   headers,
+								Key:       string(r.Key),
+								MessageID: broker.KafkaMessageID(r.Topic, r.Partition, r.Offset),
+							}
+						})
+					}
+				}()
+				t.Cleanup(func() {
+					cancel()
+					<-done
+					consumer.Close()
+				})
+				return receiver(entity, messages)
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				// Records larger than the 1 MB producer batch limit are refused by the client.
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity, Payload: make([]byte, 2<<20)}
+			},
+		}
+	})
+}
+
+func TestNATSBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		url := os.Getenv("OUTBOX_TEST_NATS_URL")
+		if url == "" {
+			s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+			require.NoError(t, err)
+			go s.Start()
+			t.Cleanup(s.Shutdown)
+			require.True(t, s.ReadyForConnections(10*time.Second), "NATS server not ready")
+			url = s.ClientURL()
+		}
+		conn, err := nats.Connect(url)
+		require.NoError(t, err)
+		t.Cleanup(conn.Close)
+		js, err := jetstream.New(conn)
+		require.NoError(t, err)
+
+		return brokertest.Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				b, err := broker.NewNATSBroker(context.Background(), &config.BrokerSettings{Type: "nats", URL: url})
+				require.NoError(t, err)
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) brokertest.Message {
+				stream, err := js.CreateStream(context.Background(), jetstream.StreamConfig{
+					Name:     entity,
+					Subjects: []string{entity, entity + ".>"},
+					Storage:  jetstream.MemoryStorage,
+				})
+				require.NoError(t, err)
+				t.Cleanup(func() { js.DeleteStream(context.Background(), entity) })
+				consumer, err := stream.OrderedConsumer(context.Background(), jetstream.OrderedConsumerConfig{})
+				require.NoError(t, err)
+
+				messages := make(chan brokertest.Message, 100)
+				consumeContext, err := consumer.Consume(func(m jetstream.Msg) {
+					headers := make(map[string]string, len(m.Headers()))
+					for key := range m.Headers() {
+						headers[key] = m.Headers().Get(key)
+					}
+					metadata, err := m.Metadata()
+					if err != nil {
+						return
+					}
+					// The routing key is the part of the subject after the entity.
+					key, _ := strings.CutPrefix(m.Subject(), entity)
+					messages <- brokertest.Message{
+						Payload:   m.Data(),
+						Headers:   headers,
+						Key:       strings.TrimPrefix(key, "."),
+						MessageID: broker.NATSMessageID(metadata.Stream, metadata.Sequence.Stream),
+					}
+				})
+				require.NoError(t, err)
+				t.Cleanup(consumeContext.Stop)
+				return receiver(entity, messages)
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				// Messages over the maximum payload of the server, 1 MB by default, are refused.
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity, Payload: make([]byte, conn.MaxPayload()+1)}
+			},
+		}
+	})
+}
+
+func TestRedisBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		url := os.Getenv("OUTBOX_TEST_REDIS_URL")
+		if url == "" {
+			url = "redis://" + miniredis.RunT(t).Addr()
+		}
+		opts, err := redis.ParseURL(url)
+		require.NoError(t, err)
+		client := redis.NewClient(opts)
+		t.Cleanup(func() { client.Close() })
+
+		return brokertest.Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				b, err := broker.NewRedisBroker(context.Background(), &config.BrokerSettings{Type: "redis", URL: url})
+				require.NoError(t, err)
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) brokertest.Message {
+				t.Cleanup(func() { client.Del(context.Background(), entity, entity+"-string") })
+
+				messages := make(chan brokertest.Message, 100)
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					last := "0"
+					for ctx.Err() == nil {
+						streams, err := client.XRead(ctx, &redis.XReadArgs{Streams: []string{entity, last}, Block: 100 * time.Millisecond}).Result()
+						if err != nil {
+							continue
+						}
+						for _, entry := range streams[0].Messages {
+							last = entry.ID
+							message := brokertest.Message{Headers: make(map[string]string), MessageID: broker.RedisMessageID(entity, entry.ID)}
+							for field, value := range entry.Values {
+								switch {
+								case field == broker.RedisPayloadField:
+									message.Payload = []byte(value.(string))
+								case field == broker.RedisRoutingKeyField:
+									message.Key = value.(string)
+								case strings.HasPrefix(field, broker.RedisHeaderFieldPrefix):
+									message.Headers[strings.TrimPrefix(field, broker.RedisHeaderFieldPrefix)] = value.(string)
+								}
+							}
+							messages <- message
+						}
+					}
+				}()
+				t.Cleanup(func() {
+					cancel()
+					<-done
+				})
+				return receiver(entity, messages)
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				// Redis refuses to add entries to a key holding another type.
+				require.NoError(t, client.Set(context.Background(), entity+"-string", "not a stream", 0).Err())
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity + "-string", Payload: []byte("payload")}
+			},
+		}
+	})
+}
+
+// awsTestConfig returns the settings and client configuration for the LocalStack at
+// OUTBOX_TEST_AWS_ENDPOINT, skipping t if it is not set.
+func awsTestConfig(t *testing.T) (*config.BrokerSettings, aws.Config) {
+	endpoint := os.Getenv("OUTBOX_TEST_AWS_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("OUTBOX_TEST_AWS_ENDPOINT is not set, skipping AWS integration test")
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "test")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	}
+	settings := &config.BrokerSettings{AWS: config.AWSSettings{Region: "us-east-1", Endpoint: endpoint}}
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(settings.AWS.Region))
+	require.NoError(t, err)
+	return settings, cfg
+}
+
+// createFIFOQueue creates the FIFO queue name, deleted when t completes, and returns its URL.
+func createFIFOQueue(t *testing.T, client *sqs.Client, name string) string {
+	queue, err := client.CreateQueue(context.Background(), &sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: map[string]string{"FifoQueue": "true"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.DeleteQueue(context.Background(), &sqs.DeleteQueueInput{QueueUrl: queue.QueueUrl}) })
+	return aws.ToString(queue.QueueUrl)
+}
+
+// sqsReceiver receives the messages of the queue at queueURL, converted by convert.
+func sqsReceiver(t *testing.T, client *sqs.Client, queueURL, entity string, convert func(m sqstypes.Message) brokertest.Message) func(t *testing.T) brokertest.Message {
+	messages := make(chan brokertest.Message, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			output, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+				QueueUrl:                    aws.String(queueURL),
+				MaxNumberOfMessages:         10,
+				WaitTimeSeconds:             1,
+				MessageAttributeNames:       []string{"All"},
+				MessageSystemAttributeNames: []sqstypes.MessageSystemAttributeName{sqstypes.MessageSystemAttributeNameMessageGroupId},
+			})
+			if err != nil {
+				continue
+			}
+			for _, m := range output.Messages {
+				client.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(queueURL), ReceiptHandle: m.ReceiptHandle})
+				messages <- convert(m)
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return receiver(entity, messages)
+}
+
+// awsHeaders returns the headers of message attributes, unpacking those the broker packed
+// into one attribute.
+func awsHeaders(attributes map[string]string) map[string]string {
+	packed, ok := attributes[broker.AWSHeadersAttribute]
+	if !ok {
+		return attributes
+	}
+	delete(attributes, broker.AWSHeadersAttribute)
+	json.Unmarshal([]byte(packed), &attributes)
+	return attributes
+}
+
+// awsPayload returns the payload of a message body, decoding it if the broker encoded it.
+func awsPayload(body string, headers map[string]string) []byte {
+	if headers[broker.AWSPayloadEncodingAttribute] != "base64" {
+		return []byte(body)
+	}
+	payload, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return []byte(body)
+	}
+	return payload
+}
+
+func TestSQSBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		settings, cfg := awsTestConfig(t)
+		client := sqs.NewFromConfig(cfg, func(o *sqs.Options) { o.BaseEndpoint = aws.String(settings.AWS.Endpoint) })
+
+		return brokertest.Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				b, err := broker.NewSQSBroker(context.Background(), settings)
+				require.NoError(t, err)
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) brokertest.Message {
+				queueURL := createFIFOQueue(t, client, entity)
+				return sqsReceiver(t, client, queueURL, entity, func(m sqstypes.Message) brokertest.Message {
+					headers := make(map[string]string, len(m.MessageAttributes))
+					for key, value := range m.MessageAttributes {
+						headers[key] = aws.ToString(value.StringValue)
+					}
+					return brokertest.Message{
+						Payload:   awsPayload(aws.ToString(m.Body), headers),
+						Headers:   awsHeaders(headers),
+						Key:       m.Attributes[string(sqstypes.MessageSystemAttributeNameMessageGroupId)],
+						MessageID: aws.ToString(m.MessageId),
+					}
+				})
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				// SQS refuses messages over 256 KB.
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity, Payload: []byte(strings.Repeat("a", 256<<10+1))}
+			},
+			EntitySuffix: ".fifo",
+		}
+	})
+}
+
+func TestSNSBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		settings, cfg := awsTestConfig(t)
+		sqsClient := sqs.NewFromConfig(cfg, func(o *sqs.Options) { o.BaseEndpoint = aws.String(settings.AWS.Endpoint) })
+		snsClient := sns.NewFromConfig(cfg, func(o *sns.Options) { o.BaseEndpoint = aws.String(settings.AWS.Endpoint) })
+
+		return brokertest.Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				b, err := broker.NewSNSBroker(context.Background(), settings)
+				require.NoError(t, err)
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) brokertest.Message {
+				topic, err := snsClient.CreateTopic(context.Background(), &sns.CreateTopicInput{
+					Name:       aws.String(entity),
+					Attributes: map[string]string{"FifoTopic": "true"},
+				})
+				require.NoError(t, err)
+				t.Cleanup(func() { snsClient.DeleteTopic(context.Background(), &sns.DeleteTopicInput{TopicArn: topic.TopicArn}) })
+
+				queueURL := createFIFOQueue(t, sqsClient, entity)
+				queue, err := sqsClient.GetQueueAttributes(context.Background(), &sqs.GetQueueAttributesInput{
+					QueueUrl:       aws.String(queueURL),
+					AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameQueueArn},
+				})
+				require.NoError(t, err)
+				_, err = snsClient.Subscribe(context.Background(), &sns.SubscribeInput{
+					TopicArn: topic.TopicArn,
+					Protocol: aws.String("sqs"),
+					Endpoint: aws.String(queue.Attributes[string(sqstypes.QueueAttributeNameQueueArn)]),
+				})
+				require.NoError(t, err)
+
+				return sqsReceiver(t, sqsClient, queueURL, entity, func(m sqstypes.Message) brokertest.Message {
+					// The queue receives the SNS notification, which wraps the published message.
+					var notification struct {
+						MessageID         string `json:"MessageId"`
+						Message           string
+						MessageAttributes map[string]struct{ Value string }
+					}
+					if err := json.Unmarshal([]byte(aws.ToString(m.Body)), &notification); err != nil {
+						return brokertest.Message{Payload: []byte(aws.ToString(m.Body))}
+					}
+					headers := make(map[string]string, len(notification.MessageAttributes))
+					for key, value := range notification.MessageAttributes {
+						headers[key] = value.Value
+					}
+					return brokertest.Message{
+						Payload:   awsPayload(notification.Message, headers),
+						Headers:   awsHeaders(headers),
+						Key:       m.Attributes[string(sqstypes.MessageSystemAttributeNameMessageGroupId)],
+						MessageID: notification.MessageID,
+					}
+				})
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				// SNS refuses messages over 256 KB.
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity, Payload: []byte(strings.Repeat("a", 256<<10+1))}
+			},
+			EntitySuffix: ".fifo",
+		}
+	})
+}
+
+func TestWebhookBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		// The server accepts the events of subscribed entities and rejects all others.
+		var mu sync.Mutex
+		subscriptions := make(map[string]chan brokertest.Message)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			messages, ok := subscriptions[strings.TrimPrefix(r.URL.Path, "/")]
+			mu.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			payload, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			headers := make(map[string]string, len(r.Header))
+			for key := range r.Header {
+				headers[strings.ToLower(key)] = r.Header.Get(key)
+			}
+			messages <- brokertest.Message{
+				Payload:   payload,
+				Headers:   headers,
+				Key:       r.Header.Get(broker.WebhookRoutingKeyHeader),
+				MessageID: r.Header.Get(broker.WebhookEventIDHeader),
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		t.Cleanup(server.Close)
+
+		return brokertest.Harness{
+			NewBroker: func(t *testing.T) broker.MessageBroker {
+				b, err := broker.NewWebhookBroker(context.Background(), &config.BrokerSettings{Type: "webhook", URL: server.URL + "/{entity}"})
+				require.NoError(t, err)
+				return b
+			},
+			Subscribe: func(t *testing.T, entity, entityType string) func(t *testing.T) brokertest.Message {
+				messages := make(chan brokertest.Message, 100)
+				mu.Lock()
+				subscriptions[entity] = messages
+				mu.Unlock()
+				return receiver(entity, messages)
+			},
+			Rejected: func(t *testing.T, entity string) *schema.OutboxEvent {
+				// The server responds 404 Not Found to entities that are not subscribed.
+				return &schema.OutboxEvent{ID: "rejected", Entity: entity + "-unknown", Payload: []byte("{}")}
+			},
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// DefaultKafkaClientID is the client ID of the kafka broker unless configured otherwise.
+const DefaultKafkaClientID = "go-outbox"
+
+// KafkaBrokerCreator defines a function type for creating Kafka brokers.
+type KafkaBrokerCreator func(ctx context.Context, settings *config.BrokerSettings, opts ...kgo.Opt) (MessageBroker, error)
+
+// NewKafkaBroker connects to the comma-separated seed brokers in settings.URL. opts are
+// applied after the options derived from settings.
+var NewKafkaBroker KafkaBrokerCreator = func(ctx context.Context, settings *config.BrokerSettings, opts ...kgo.Opt) (MessageBroker, error) {
+	kafkaOpts, err := kafkaOptions(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kgo.NewClient(append(kafkaOpts, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the Kafka client: %w", err)
+	}
+	if err := client.Ping(ctx); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Kafka: %w", err)
+	}
+	return &kafkaBroker{client: client}, nil
+}
+
+// kafkaOptions translates the broker settings into client options.
+func kafkaOptions(settings *config.BrokerSettings) ([]kgo.Opt, error) {
+	var seeds []string
+	for _, seed := range strings.Split(settings.URL, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	if len(seeds) == 0 {
+		return nil, errors.New("no Kafka seed brokers configured in the broker URL")
+	}
+
+	kafka := settings.Kafka
+	clientID := kafka.ClientID
+	if clientID == "" {
+		clientID = DefaultKafkaClientID
+	}
+	opts := []kgo.Opt{kgo.SeedBrokers(seeds...), kgo.ClientID(clientID)}
+
+	switch kafka.Acks {
+	case "", "all":
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	case "leader":
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()))
+	case "none":
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()))
+	default:
+		return nil, fmt.Errorf("unsupported Kafka acks: %s", kafka.Acks)
+	}
+	if kafka.DisableIdempotence {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	} else if kafka.Acks != "" && kafka.Acks != "all" {
+		return nil, fmt.Errorf("the idempotent producer requires acks=all, got acks=%s", kafka.Acks)
+	}
+	if kafka.AutoCreateTopics {
+		opts = append(opts, kgo.AllowAutoTopicCreation())
+	}
+
+	tlsConfig, err := newTLSConfig(settings.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+
+	if settings.SASL.Mechanism != "" {
+		mechanism, err := kafkaSASL(settings.SASL)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	return opts, nil
+}
+
+func kafkaSASL(settings config.SASLSettings) (sasl.Mechanism, error) {
+	switch settings.Mechanism {
+	case "PLAIN":
+		return plain.Auth{User: settings.Username, Pass: settings.Password}.AsMechanism(), nil
+	case "SCRAM-SHA-256":
+		return scram.Auth{User: settings.Username, Pass: settings.Password}.AsSha256Mechanism(), nil
+	case "SCRAM-SHA-512":
+		return scram.Auth{User: settings.Username, Pass: settings.Password}.AsSha512Mechanism(), nil
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism: %s", settings.Mechanism)
+	}
+}
+
+type kafkaBroker struct {
+	client *kgo.Client
+	mu     sync.Mutex
+	closed bool
+}
+
+func (k *kafkaBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	closed := k.closed
+	k.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	tracer := otel.Tracer("go-outbox")
+	ctx, span := tracer.Start(ctx, "Publish",
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("kafka"),
+			semconv.MessagingDestinationKindKey.String("topic"),
+			semconv.MessagingDestinationKey.String(event.Entity),
+			semconv.MessagingKafkaMessageKeyKey.String(event.RoutingKey),
+		),
+	)
+	defer span.End()
+
+	// Inject the trace context into the record headers
+	headers := make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	for key, value := range event.Headers {
+		headers[key] = value
+	}
+
+	record := &kgo.Record{
+		Topic: event.Entity,
+		Value: event.Payload,
+	}
+	// Records with the same key go to the same partition, which keeps them in order.
+	if event.RoutingKey != "" {
+		record.Key = []byte(event.RoutingKey)
+	}
+	for key, value := range headers {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: key, Value: []byte(value)})
+	}
+
+	if err := k.client.ProduceSync(ctx, record).FirstErr(); err != nil {
+		span.RecordError(err)
+		if isPermanentKafkaError(err) {
+			return Permanent(err)
+		}
+		return err
+	}
+	// Kafka does not assign message IDs, a record is identified by its position.
+	event.MessageID = KafkaMessageID(record.Topic, record.Partition, record.Offset)
+
+	span.SetAttributes(
+		attribute.Int("messaging.message_payload_size_bytes", len(event.Payload)),
+		semconv.MessagingKafkaPartitionKey.Int64(int64(record.Partition)),
+		semconv.MessagingMessageIDKey.String(event.MessageID),
+	)
+
+	return nil
+}
+
+// KafkaMessageID returns the message ID of the record at offset of the topic partition, as
+// stored in the outbox by the kafka broker.
+func KafkaMessageID(topic string, partition int32, offset int64) string {
+	return fmt.Sprintf("%s/%d/%d", topic, partition, offset)
+}
+
+// isPermanentKafkaError reports whether err rejects the record itself or the sidecar's
+// access to the topic, so that producing it again fails the same way.
+func isPermanentKafkaError(err error) bool {
+	for _, permanent := range []error{
+		kerr.MessageTooLarge,
+		kerr.RecordListTooLarge,
+		kerr.InvalidRecord,
+		kerr.InvalidTopicException,
+		kerr.TopicAuthorizationFailed,
+	} {
+		if errors.Is(err, permanent) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *kafkaBroker) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		return nil
+	}
+	k.closed = true
+
+	k.client.Close()
+	return nil
+}
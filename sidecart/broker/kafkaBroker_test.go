@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+func newKafkaTestCluster(t *testing.T, opts ...kfake.Opt) string {
+	cluster, err := kfake.NewCluster(append([]kfake.Opt{kfake.NumBrokers(1)}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	return strings.Join(cluster.ListenAddrs(), ",")
+}
+
+func TestKafkaOptions_InvalidSettings(t *testing.T) {
+	tests := map[string]config.BrokerSettings{
+		"no seed brokers":              {URL: " , "},
+		"acks without idempotence off": {URL: "localhost:9092", Kafka: config.KafkaSettings{Acks: "leader"}},
+		"unknown acks":                 {URL: "localhost:9092", Kafka: config.KafkaSettings{Acks: "two"}},
+		"unknown SASL mechanism":       {URL: "localhost:9092", SASL: config.SASLSettings{Mechanism: "GSSAPI"}},
+		"missing CA file":              {URL: "localhost:9092", TLS: config.TLSSettings{Enabled: true, CAFile: "missing.pem"}},
+		"missing client certificate":   {URL: "localhost:9092", TLS: config.TLSSettings{Enabled: true, CertFile: "missing.pem", KeyFile: "missing-key.pem"}},
+	}
+	for name, settings := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := kafkaOptions(&settings)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestKafkaOptions_ProducerGuarantees(t *testing.T) {
+	newClient := func(settings config.KafkaSettings) *kgo.Client {
+		opts, err := kafkaOptions(&config.BrokerSettings{URL: "a:9092, b:9092", Kafka: settings})
+		require.NoError(t, err)
+		// The client connects lazily, so its resolved options can be read without brokers.
+		client, err := kgo.NewClient(opts...)
+		require.NoError(t, err)
+		t.Cleanup(client.Close)
+		return client
+	}
+
+	client := newClient(config.KafkaSettings{})
+	assert.Equal(t, []string{"a:9092", "b:9092"}, client.OptValue(kgo.SeedBrokers))
+	assert.Equal(t, kgo.AllISRAcks(), client.OptValue(kgo.RequiredAcks))
+	assert.Equal(t, false, client.OptValue(kgo.DisableIdempotentWrite), "the producer is idempotent by default")
+
+	client = newClient(config.KafkaSettings{Acks: "none", DisableIdempotence: true})
+	assert.Equal(t, kgo.NoAck(), client.OptValue(kgo.RequiredAcks))
+	assert.Equal(t, true, client.OptValue(kgo.DisableIdempotentWrite))
+}
+
+func TestKafkaBroker_PublishesRecords(t *testing.T) {
+	seeds := newKafkaTestCluster(t, kfake.SeedTopics(3, "orders"))
+	b, err := NewBroker(context.Background(), &config.BrokerSettings{Type: "kafka", URL: seeds})
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{
+		ID:         "1",
+		Entity:     "orders",
+		RoutingKey: "order-1",
+		Payload:    []byte(`{"id":1}`),
+		Headers:    map[string]string{"tenant": "acme"},
+	}
+	require.NoError(t, b.Publish(context.Background(), event))
+
+	consumer, err := kgo.NewClient(kgo.SeedBrokers(seeds), kgo.ConsumeTopics("orders"))
+	require.NoError(t, err)
+	defer consumer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fetches := consumer.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+
+	record := records[0]
+	assert.Equal(t, "order-1", string(record.Key))
+	assert.Equal(t, `{"id":1}`, string(record.Value))
+	assert.Contains(t, record.Headers, kgo.RecordHeader{Key: "tenant", Value: []byte("acme")})
+	assert.Equal(t, KafkaMessageID("orders", record.Partition, record.Offset), event.MessageID)
+}
+
+func TestKafkaBroker_SASL(t *testing.T) {
+	seeds := newKafkaTestCluster(t, kfake.EnableSASL(), kfake.Superuser("SCRAM-SHA-512", "sidecar", "secret"), kfake.SeedTopics(1, "orders"))
+
+	settings := &config.BrokerSettings{URL: seeds, SASL: config.SASLSettings{Mechanism: "SCRAM-SHA-512", Username: "sidecar", Password: "secret"}}
+	b, err := NewKafkaBroker(context.Background(), settings)
+	require.NoError(t, err)
+	defer b.Close()
+	assert.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1", Entity: "orders", Payload: []byte("payload")}))
+
+	settings.SASL.Password = "wrong"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = NewKafkaBroker(ctx, settings)
+	assert.Error(t, err)
+}
+
+func TestKafkaBroker_OversizedRecordIsPermanent(t *testing.T) {
+	seeds := newKafkaTestCluster(t, kfake.SeedTopics(1, "orders"))
+	b, err := NewKafkaBroker(context.Background(), &config.BrokerSettings{URL: seeds}, kgo.ProducerBatchMaxBytes(1024))
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{ID: "1", Entity: "orders", Payload: make([]byte, 2048)}
+	err = b.Publish(context.Background(), event)
+	assert.True(t, IsPermanent(err), "got %v", err)
+	assert.Empty(t, event.MessageID)
+}
@@ -2,6 +2,7 @@ package broker
 
 import (
 	"context"
+	"errors"
 
 	"github.com/zoff-tech/go-outbox/schema"
 )
@@ -9,7 +10,43 @@ import (
 // MessageBroker defines the operations to publish messages to a broker.
 type MessageBroker interface {
 	// Publish sends the message to the specified topic or exchange with optional headers.
+	// Once the broker accepted the message, Publish stores its message ID in event.MessageID.
+	// Failures that retrying cannot fix are wrapped with Permanent.
 	Publish(ctx context.Context, event *schema.OutboxEvent) error
-	// Close cleans up any resources (connections).
+	// Close cleans up any resources (connections). Publishing afterwards fails with ErrClosed,
+	// and closing again is a no-op.
 	Close() error
 }
+
+// ErrClosed is returned by Publish once the broker was closed.
+var ErrClosed = errors.New("broker is closed")
+
+// ErrPermanent matches publish errors that retrying cannot fix, e.g. a message the broker
+// rejects as invalid. The processor gives up on such events without retrying them.
+var ErrPermanent = errors.New("permanent publish failure")
+
+// Permanent marks err as a permanent publish failure, so that errors.Is(err, ErrPermanent)
+// holds. It returns nil for a nil err.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err is a permanent publish failure.
+func IsPermanent(err error) bool {
+	return errors.Is(err, ErrPermanent)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() []error {
+	return []error{e.err, ErrPermanent}
+}
@@ -22,6 +22,42 @@ func NewBroker(ctx context.Context, cfg *config.BrokerSettings) (MessageBroker,
 			return nil, err
 		}
 		return broker, nil
+	case "kafka":
+		broker, err := NewKafkaBroker(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return broker, nil
+	case "nats":
+		broker, err := NewNATSBroker(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return broker, nil
+	case "redis":
+		broker, err := NewRedisBroker(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return broker, nil
+	case "sns":
+		broker, err := NewSNSBroker(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return broker, nil
+	case "sqs":
+		broker, err := NewSQSBroker(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return broker, nil
+	case "webhook":
+		broker, err := NewWebhookBroker(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return broker, nil
 	default:
 		return nil, fmt.Errorf("unsupported broker type: %s", cfg.Type)
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
@@ -19,20 +20,17 @@ func TestFetchPending(t *testing.T) {
 	repo := &store.PostgresRepository{Db: db}
 
 	// Mock rows for the SELECT query
-	rows := sqlmock.NewRows([]string{"id", "entity", "entity_type", "payload", "retry_count", "headers", "routing_key"}).
-		AddRow("1", "entity1", "type1", []byte("payload1"), 0, `{"header1":"value1"}`, "key1").
-		AddRow("2", "entity2", "type2", []byte("payload2"), 3, `{"header2":"value2"}`, "key2")
+	rows := sqlmock.NewRows([]string{"id", "entity", "entity_type", "payload", "retry_count", "headers", "routing_key", "created_at"}).
+		AddRow("1", "entity1", "type1", []byte("payload1"), 0, `{"header1":"value1"}`, "key1", time.Now()).
+		AddRow("2", "entity2", "type2", []byte("payload2"), 3, `{"header2":"value2"}`, "key2", time.Now())
 
 	mock.ExpectBegin()
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key FROM outbox_events WHERE (status='pending' OR (status='processing' AND updated_at < $1)) FOR UPDATE SKIP LOCKED LIMIT $2`)).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key, created_at FROM outbox_events WHERE ((status='pending' AND (next_attempt_at IS NULL OR next_attempt_at <= $1)) OR (status='processing' AND (locked_until IS NULL OR locked_until < $1))) ORDER BY created_at FOR UPDATE SKIP LOCKED LIMIT $2`)).
 		WithArgs(sqlmock.AnyArg(), 10).
 		WillReturnRows(rows)
-	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox_events SET status=$1, retry_count = retry_count + 1, updated_at=$2 WHERE id=$3`)).
-		WithArgs(schema.StatusProcessing, sqlmock.AnyArg(), "1").
-		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox_events SET status=$1, updated_at=$2 WHERE id=$3`)).
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "2").
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox_events SET status=$1, locked_by=$2, locked_until=$3, updated_at=$4 WHERE id = ANY($5)`)).
+		WithArgs(schema.StatusProcessing, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
 	mock.ExpectCommit()
 
 	ctx := context.Background()
@@ -0,0 +1,20 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermanent(t *testing.T) {
+	invalid := errors.New("invalid message")
+	err := fmt.Errorf("publish: %w", Permanent(invalid))
+
+	assert.True(t, IsPermanent(err))
+	assert.ErrorIs(t, err, invalid)
+	assert.EqualError(t, err, "publish: invalid message")
+	assert.False(t, IsPermanent(invalid))
+	assert.NoError(t, Permanent(nil))
+}
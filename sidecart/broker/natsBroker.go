@@ -0,0 +1,192 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// DefaultNATSClientName is the connection name the nats broker reports to the server.
+const DefaultNATSClientName = "go-outbox"
+
+// jsErrCodeMessageTooLarge is the JetStream error code of a message exceeding the maximum
+// message size of its stream.
+const jsErrCodeMessageTooLarge jetstream.ErrorCode = 10054
+
+// NATSBrokerCreator defines a function type for creating NATS brokers.
+type NATSBrokerCreator func(ctx context.Context, settings *config.BrokerSettings, opts ...nats.Option) (MessageBroker, error)
+
+// NewNATSBroker connects to the comma-separated NATS servers in settings.URL and creates or
+// updates the streams configured in settings.NATS. opts are applied after the options
+// derived from settings.
+var NewNATSBroker NATSBrokerCreator = func(ctx context.Context, settings *config.BrokerSettings, opts ...nats.Option) (MessageBroker, error) {
+	natsOpts := []nats.Option{nats.Name(DefaultNATSClientName)}
+	tlsConfig, err := newTLSConfig(settings.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		natsOpts = append(natsOpts, nats.Secure(tlsConfig))
+	}
+	if settings.NATS.CredentialsFile != "" {
+		natsOpts = append(natsOpts, nats.UserCredentials(settings.NATS.CredentialsFile))
+	}
+
+	conn, err := nats.Connect(settings.URL, append(natsOpts, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create the JetStream context: %w", err)
+	}
+
+	for _, stream := range settings.NATS.Streams {
+		if _, err := js.CreateOrUpdateStream(ctx, natsStreamConfig(stream)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create or update stream %s: %w", stream.Name, err)
+		}
+	}
+	return &natsBroker{conn: conn, js: js}, nil
+}
+
+// natsStreamConfig translates the stream settings into a stream configuration.
+func natsStreamConfig(settings config.NATSStreamSettings) jetstream.StreamConfig {
+	storage := jetstream.FileStorage
+	if settings.Storage == "memory" {
+		storage = jetstream.MemoryStorage
+	}
+	return jetstream.StreamConfig{
+		Name:       settings.Name,
+		Subjects:   settings.Subjects,
+		Storage:    storage,
+		Replicas:   settings.Replicas,
+		MaxAge:     settings.MaxAge,
+		Duplicates: settings.DuplicateWindow,
+	}
+}
+
+type natsBroker struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream
+	mu     sync.Mutex
+	closed bool
+}
+
+func (n *natsBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	closed := n.closed
+	n.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	subject, err := NATSSubject(event.Entity, event.RoutingKey)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	tracer := otel.Tracer("go-outbox")
+	ctx, span := tracer.Start(ctx, "Publish",
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("nats"),
+			semconv.MessagingDestinationKindKey.String("topic"),
+			semconv.MessagingDestinationKey.String(subject),
+		),
+	)
+	defer span.End()
+
+	// Inject the trace context into the message headers
+	headers := make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	for key, value := range event.Headers {
+		headers[key] = value
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = event.Payload
+	for key, value := range headers {
+		msg.Header.Set(key, value)
+	}
+
+	// The message ID lets the stream discard an event published again within its duplicate
+	// window, e.g. after the sidecar crashed before marking it sent.
+	ack, err := n.js.PublishMsg(ctx, msg, jetstream.WithMsgID(event.ID))
+	if err != nil {
+		span.RecordError(err)
+		if isPermanentNATSError(err) {
+			return Permanent(err)
+		}
+		return err
+	}
+	event.MessageID = NATSMessageID(ack.Stream, ack.Sequence)
+
+	span.SetAttributes(
+		attribute.Int("messaging.message_payload_size_bytes", len(event.Payload)),
+		attribute.Bool("messaging.nats.duplicate", ack.Duplicate),
+		semconv.MessagingMessageIDKey.String(event.MessageID),
+	)
+
+	return nil
+}
+
+// NATSSubject returns the subject the nats broker publishes the events of entity with
+// routingKey to: the entity, followed by the routing key if there is one. An entity orders
+// with routing key eu.created publishes to orders.eu.created.
+func NATSSubject(entity, routingKey string) (string, error) {
+	subject := entity
+	if routingKey != "" {
+		subject += "." + routingKey
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return "", fmt.Errorf("invalid NATS subject %q: tokens must be non-empty, without whitespace or wildcards", subject)
+		}
+	}
+	return subject, nil
+}
+
+// NATSMessageID returns the message ID of the message at sequence of stream, as stored in the
+// outbox by the nats broker.
+func NATSMessageID(stream string, sequence uint64) string {
+	return fmt.Sprintf("%s/%d", stream, sequence)
+}
+
+// isPermanentNATSError reports whether err rejects the message itself, so that publishing it
+// again fails the same way. A missing stream is not permanent, it may be created later.
+func isPermanentNATSError(err error) bool {
+	if errors.Is(err, nats.ErrMaxPayload) || errors.Is(err, nats.ErrBadSubject) {
+		return true
+	}
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == jsErrCodeMessageTooLarge
+}
+
+func (n *natsBroker) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil
+	}
+	n.closed = true
+
+	n.conn.Close()
+	return nil
+}
@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+func newNATSTestServer(t *testing.T) string {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(10*time.Second), "NATS server not ready")
+	return s.ClientURL()
+}
+
+func TestNATSSubject(t *testing.T) {
+	subject, err := NATSSubject("orders", "")
+	require.NoError(t, err)
+	assert.Equal(t, "orders", subject)
+
+	subject, err = NATSSubject("orders", "eu.created")
+	require.NoError(t, err)
+	assert.Equal(t, "orders.eu.created", subject)
+
+	for _, routingKey := range []string{"eu..created", "eu.*", ">", "eu created", "created."} {
+		_, err := NATSSubject("orders", routingKey)
+		assert.Error(t, err, routingKey)
+	}
+}
+
+func TestNATSBroker_PublishesToStream(t *testing.T) {
+	url := newNATSTestServer(t)
+	b, err := NewBroker(context.Background(), &config.BrokerSettings{
+		Type: "nats",
+		URL:  url,
+		NATS: config.NATSSettings{Streams: []config.NATSStreamSettings{
+			{Name: "ORDERS", Subjects: []string{"orders", "orders.>"}, Storage: "memory", DuplicateWindow: time.Minute},
+		}},
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{
+		ID:         "1",
+		Entity:     "orders",
+		RoutingKey: "order-1",
+		Payload:    []byte(`{"id":1}`),
+		Headers:    map[string]string{"tenant": "acme"},
+	}
+	require.NoError(t, b.Publish(context.Background(), event))
+	assert.Equal(t, NATSMessageID("ORDERS", 1), event.MessageID)
+
+	// Publishing the event again is discarded as a duplicate.
+	again := *event
+	require.NoError(t, b.Publish(context.Background(), &again))
+	assert.Equal(t, event.MessageID, again.MessageID)
+
+	conn, err := nats.Connect(url)
+	require.NoError(t, err)
+	defer conn.Close()
+	js, err := jetstream.New(conn)
+	require.NoError(t, err)
+	stream, err := js.Stream(context.Background(), "ORDERS")
+	require.NoError(t, err)
+	assert.Equal(t, jetstream.MemoryStorage, stream.CachedInfo().Config.Storage)
+	assert.Equal(t, uint64(1), stream.CachedInfo().State.Msgs)
+
+	msg, err := stream.GetMsg(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "orders.order-1", msg.Subject)
+	assert.Equal(t, `{"id":1}`, string(msg.Data))
+	assert.Equal(t, "acme", msg.Header.Get("tenant"))
+	assert.Equal(t, "1", msg.Header.Get(jetstream.MsgIDHeader))
+}
+
+func TestNATSBroker_WithoutStreamIsRetried(t *testing.T) {
+	b, err := NewNATSBroker(context.Background(), &config.BrokerSettings{URL: newNATSTestServer(t)})
+	require.NoError(t, err)
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = b.Publish(ctx, &schema.OutboxEvent{ID: "1", Entity: "orders", Payload: []byte("payload")})
+	assert.Error(t, err)
+	assert.False(t, IsPermanent(err), "the stream may be created later")
+}
+
+func TestNATSBroker_OversizedMessageIsPermanent(t *testing.T) {
+	url := newNATSTestServer(t)
+	conn, err := nats.Connect(url)
+	require.NoError(t, err)
+	defer conn.Close()
+	js, err := jetstream.New(conn)
+	require.NoError(t, err)
+	_, err = js.CreateStream(context.Background(), jetstream.StreamConfig{Name: "ORDERS", Subjects: []string{"orders"}, MaxMsgSize: 1024})
+	require.NoError(t, err)
+
+	b, err := NewNATSBroker(context.Background(), &config.BrokerSettings{URL: url})
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{ID: "1", Entity: "orders", Payload: make([]byte, 2048)}
+	err = b.Publish(context.Background(), event)
+	assert.True(t, IsPermanent(err), "got %v", err)
+	assert.Empty(t, event.MessageID)
+}
+
+func TestNATSBroker_InvalidSubjectIsPermanent(t *testing.T) {
+	b, err := NewNATSBroker(context.Background(), &config.BrokerSettings{URL: newNATSTestServer(t)})
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.Publish(context.Background(), &schema.OutboxEvent{ID: "1", Entity: "orders", RoutingKey: "eu.*"})
+	assert.True(t, IsPermanent(err), "got %v", err)
+}
@@ -2,6 +2,8 @@ package broker
 
 import (
 	"context"
+	"errors"
+	"sync"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/zoff-tech/go-outbox/config"
@@ -24,14 +26,27 @@ var NewPubSubClient PubSubBrokerCreator = func(ctx context.Context, settings *co
 	if err != nil {
 		return nil, err
 	}
-	return &pubSubBroker{client: client}, nil
+	return &pubSubBroker{client: client, topics: make(map[string]*pubsub.Topic)}, nil
 }
 
 type pubSubBroker struct {
 	client *pubsub.Client
+	mu     sync.Mutex
+	// topics caches a publisher per entity, so that messages are batched and published in
+	// order per ordering key.
+	topics map[string]*pubsub.Topic
+	closed bool
 }
 
 func (p *pubSubBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	topic, err := p.topic(event.Entity)
+	if err != nil {
+		return err
+	}
+
 	tracer := otel.Tracer("go-outbox")
 	ctx, span := tracer.Start(ctx, "Publish",
 		trace.WithAttributes(
@@ -59,20 +74,58 @@ func (p *pubSubBroker) Publish(ctx context.Context, event *schema.OutboxEvent) e
 
 	message.OrderingKey = event.RoutingKey
 
-	res := p.client.Topic(event.Entity).Publish(ctx, message)
-	_, err := res.Get(ctx) // wait for server ack
+	res := topic.Publish(ctx, message)
+	id, err := res.Get(ctx) // wait for server ack
 	if err != nil {
 		span.RecordError(err)
+		if event.RoutingKey != "" {
+			// A failed publish pauses its ordering key, so resume it for the retry.
+			topic.ResumePublish(event.RoutingKey)
+		}
+		if errors.Is(err, pubsub.ErrOversizedMessage) {
+			return Permanent(err)
+		}
 		return err
 	}
+	event.MessageID = id
 
 	span.SetAttributes(
 		attribute.Int("messaging.message_payload_size_bytes", len(event.Payload)),
+		semconv.MessagingMessageIDKey.String(id),
 	)
 
 	return nil
 }
 
+// topic returns the publisher of entity. Ordering is enabled, as events with a routing key
+// are published with it as ordering key.
+func (p *pubSubBroker) topic(entity string) (*pubsub.Topic, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrClosed
+	}
+
+	topic, ok := p.topics[entity]
+	if !ok {
+		topic = p.client.Topic(entity)
+		topic.EnableMessageOrdering = true
+		p.topics[entity] = topic
+	}
+	return topic, nil
+}
+
 func (p *pubSubBroker) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	// Stop flushes the messages still being batched.
+	for _, topic := range p.topics {
+		topic.Stop()
+	}
 	return p.client.Close()
 }
@@ -78,9 +78,21 @@ type rabbitMqBroker struct {
 	settings        *config.BrokerSettings
 	reconnectTicker *time.Ticker
 	stopReconnect   chan struct{}
+	closed          bool
 }
 
 func (r *rabbitMqBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	// The AMQP client does not take a context, so a canceled publish is not attempted at all.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
 	tracer := otel.Tracer("go-outbox")
 	ctx, span := tracer.Start(ctx, "Publish",
 		trace.WithAttributes(
@@ -125,32 +137,64 @@ func (r *rabbitMqBroker) Publish(ctx context.Context, event *schema.OutboxEvent)
 		nil,              // arguments
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare exchange: %w", err)
+		err = fmt.Errorf("failed to declare exchange: %w", err)
+		span.RecordError(err)
+		if isPermanentAMQPError(err) {
+			return Permanent(err)
+		}
+		return err
 	}
 
 	err = pooledChan.channel.Publish(
 		event.Entity, event.RoutingKey, false, false,
 		amqp.Publishing{
 			ContentType: "application/json",
+			MessageId:   event.ID,
 			Body:        event.Payload,
 			Headers:     amqpHeaders,
 		},
 	)
 	if err != nil {
 		span.RecordError(err)
+		if isPermanentAMQPError(err) {
+			return Permanent(err)
+		}
 		return err
 	}
+	// RabbitMQ does not assign message IDs, so the event ID is sent as the message ID.
+	event.MessageID = event.ID
 
 	span.SetAttributes(
 		attribute.Int("messaging.message_payload_size_bytes", len(event.Payload)),
+		semconv.MessagingMessageIDKey.String(event.MessageID),
 	)
 
 	return nil
 }
 
+// isPermanentAMQPError reports whether err is refused by RabbitMQ in a way that retrying
+// cannot fix: an exchange redeclared with another type, an unknown exchange type or
+// missing permissions.
+func isPermanentAMQPError(err error) bool {
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return false
+	}
+	switch amqpErr.Code {
+	case amqp.PreconditionFailed, amqp.CommandInvalid, amqp.AccessRefused:
+		return true
+	default:
+		return false
+	}
+}
+
 func (r *rabbitMqBroker) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
 
 	// Stop the connection recovery goroutine
 	close(r.stopReconnect)
@@ -79,9 +79,12 @@ func TestPublish_Success(t *testing.T) {
 	broker := newTestBroker(1, conn, ch)
 
 	ch.On("ExchangeDeclare", "ex", "direct", true, false, false, false, mock.Anything).Return(nil)
-	ch.On("Publish", "ex", "rk", false, false, mock.Anything).Return(nil)
+	ch.On("Publish", "ex", "rk", false, false, mock.MatchedBy(func(msg amqp.Publishing) bool {
+		return msg.MessageId == "1"
+	})).Return(nil)
 
 	event := &schema.OutboxEvent{
+		ID:         "1",
 		Entity:     "ex",
 		EntityType: "direct",
 		RoutingKey: "rk",
@@ -90,6 +93,7 @@ func TestPublish_Success(t *testing.T) {
 	}
 	err := broker.Publish(context.Background(), event)
 	assert.NoError(t, err)
+	assert.Equal(t, "1", event.MessageID)
 	ch.AssertExpectations(t)
 }
 
@@ -108,6 +112,25 @@ func TestPublish_ExchangeDeclareError(t *testing.T) {
 	}
 	err := broker.Publish(context.Background(), event)
 	assert.ErrorContains(t, err, "exch")
+	assert.False(t, IsPermanent(err))
+	ch.AssertExpectations(t)
+}
+
+func TestPublish_ExchangeTypeMismatchIsPermanent(t *testing.T) {
+	conn := new(mockAmqpConnection)
+	ch := new(mockChannel)
+	broker := newTestBroker(1, conn, ch)
+
+	ch.On("ExchangeDeclare", "ex", "direct", true, false, false, false, mock.Anything).
+		Return(&amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg 'type'"})
+	event := &schema.OutboxEvent{
+		Entity:     "ex",
+		EntityType: "direct",
+		Headers:    map[string]string{},
+	}
+	err := broker.Publish(context.Background(), event)
+	assert.ErrorContains(t, err, "PRECONDITION_FAILED")
+	assert.True(t, IsPermanent(err))
 	ch.AssertExpectations(t)
 }
 
@@ -188,6 +211,23 @@ func TestClose(t *testing.T) {
 	assert.NoError(t, err)
 	ch.AssertExpectations(t)
 	conn.AssertExpectations(t)
+
+	// Closing again is a no-op, and publishing fails without touching the closed pool.
+	assert.NoError(t, broker.Close())
+	assert.ErrorIs(t, broker.Publish(context.Background(), &schema.OutboxEvent{ID: "1"}), ErrClosed)
+}
+
+func TestPublish_CanceledContext(t *testing.T) {
+	conn := new(mockAmqpConnection)
+	ch := new(mockChannel)
+	broker := newTestBroker(1, conn, ch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	event := &schema.OutboxEvent{ID: "1", Entity: "ex", EntityType: "direct"}
+	assert.ErrorIs(t, broker.Publish(ctx, event), context.Canceled)
+	assert.Empty(t, event.MessageID)
+	ch.AssertNotCalled(t, "ExchangeDeclare", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
 }
 
 func TestRecoverConnection_Stop(t *testing.T) {
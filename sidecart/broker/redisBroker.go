@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// The fields of the stream entries added by the redis broker. Each event header is stored in
+// a field of its own, named by RedisHeaderFieldPrefix followed by the header name.
+const (
+	RedisPayloadField      = "payload"
+	RedisRoutingKeyField   = "routing_key"
+	RedisHeaderFieldPrefix = "header:"
+)
+
+// RedisBrokerCreator defines a function type for creating Redis brokers.
+type RedisBrokerCreator func(ctx context.Context, settings *config.BrokerSettings) (MessageBroker, error)
+
+// NewRedisBroker connects to the Redis server, or with settings.Redis.Cluster the Redis
+// Cluster, at settings.URL.
+var NewRedisBroker RedisBrokerCreator = func(ctx context.Context, settings *config.BrokerSettings) (MessageBroker, error) {
+	tlsConfig, err := newTLSConfig(settings.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	var client redis.UniversalClient
+	if settings.Redis.Cluster {
+		opts, err := redis.ParseClusterURL(settings.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis Cluster URL: %w", err)
+		}
+		if tlsConfig != nil {
+			opts.TLSConfig = tlsConfig
+		}
+		client = redis.NewClusterClient(opts)
+	} else {
+		opts, err := redis.ParseURL(settings.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis URL: %w", err)
+		}
+		if tlsConfig != nil {
+			opts.TLSConfig = tlsConfig
+		}
+		client = redis.NewClient(opts)
+	}
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	return &redisBroker{client: client, settings: settings.Redis}, nil
+}
+
+type redisBroker struct {
+	client   redis.UniversalClient
+	settings config.RedisSettings
+	mu       sync.Mutex
+	closed   bool
+}
+
+func (r *redisBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	stream := r.stream(event)
+	tracer := otel.Tracer("go-outbox")
+	ctx, span := tracer.Start(ctx, "Publish",
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("redis"),
+			semconv.MessagingDestinationKindKey.String("topic"),
+			semconv.MessagingDestinationKey.String(stream),
+		),
+	)
+	defer span.End()
+
+	// Inject the trace context into the entry headers
+	headers := make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	for key, value := range event.Headers {
+		headers[key] = value
+	}
+
+	values := []interface{}{RedisPayloadField, event.Payload}
+	if event.RoutingKey != "" {
+		values = append(values, RedisRoutingKeyField, event.RoutingKey)
+	}
+	for key, value := range headers {
+		values = append(values, RedisHeaderFieldPrefix+key, value)
+	}
+
+	id, err := r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: r.settings.MaxLen,
+		Approx: !r.settings.ExactTrimming,
+		Values: values,
+	}).Result()
+	if err != nil {
+		span.RecordError(err)
+		if isPermanentRedisError(err) {
+			return Permanent(err)
+		}
+		return err
+	}
+	// Entry IDs are only unique within their stream.
+	event.MessageID = RedisMessageID(stream, id)
+
+	span.SetAttributes(
+		attribute.Int("messaging.message_payload_size_bytes", len(event.Payload)),
+		semconv.MessagingMessageIDKey.String(event.MessageID),
+	)
+
+	return nil
+}
+
+// stream returns the name of the stream the event is added to: its entity, followed by its
+// routing key as a hash tag if so configured. Redis Cluster only hashes the part of a key
+// between the braces, so that the streams of a routing key share a slot.
+func (r *redisBroker) stream(event *schema.OutboxEvent) string {
+	if r.settings.HashTagRoutingKey && event.RoutingKey != "" {
+		return event.Entity + ":{" + event.RoutingKey + "}"
+	}
+	return event.Entity
+}
+
+// RedisMessageID returns the message ID of the entry with id in stream, as stored in the
+// outbox by the redis broker.
+func RedisMessageID(stream, id string) string {
+	return stream + "/" + id
+}
+
+// isPermanentRedisError reports whether err rejects the entry itself or the sidecar's access
+// to the stream, e.g. because the key holds another type, so that adding it again fails the
+// same way.
+func isPermanentRedisError(err error) bool {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return false
+	}
+	for _, prefix := range []string{"WRONGTYPE", "NOPERM"} {
+		if strings.HasPrefix(redisErr.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redisBroker) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	return r.client.Close()
+}
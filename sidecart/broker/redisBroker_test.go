@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+func TestRedisBroker_AddsStreamEntries(t *testing.T) {
+	server := miniredis.RunT(t)
+	b, err := NewBroker(context.Background(), &config.BrokerSettings{Type: "redis", URL: "redis://" + server.Addr()})
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{
+		ID:         "1",
+		Entity:     "orders",
+		RoutingKey: "order-1",
+		Payload:    []byte(`{"id":1}`),
+		Headers:    map[string]string{"tenant": "acme"},
+	}
+	require.NoError(t, b.Publish(context.Background(), event))
+
+	entries, err := server.Stream("orders")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, RedisMessageID("orders", entries[0].ID), event.MessageID)
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(entries[0].Values); i += 2 {
+		fields[entries[0].Values[i]] = entries[0].Values[i+1]
+	}
+	assert.Equal(t, `{"id":1}`, fields[RedisPayloadField])
+	assert.Equal(t, "order-1", fields[RedisRoutingKeyField])
+	assert.Equal(t, "acme", fields[RedisHeaderFieldPrefix+"tenant"])
+}
+
+func TestRedisBroker_TrimsStreams(t *testing.T) {
+	server := miniredis.RunT(t)
+	b, err := NewRedisBroker(context.Background(), &config.BrokerSettings{
+		URL:   "redis://" + server.Addr(),
+		Redis: config.RedisSettings{MaxLen: 3, ExactTrimming: true},
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "1", Entity: "orders", Payload: []byte("payload")}))
+	}
+	entries, err := server.Stream("orders")
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestRedisBroker_HashTagRoutingKey(t *testing.T) {
+	server := miniredis.RunT(t)
+	b, err := NewRedisBroker(context.Background(), &config.BrokerSettings{
+		URL:   "redis://" + server.Addr(),
+		Redis: config.RedisSettings{HashTagRoutingKey: true},
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	keyed := &schema.OutboxEvent{ID: "1", Entity: "orders", RoutingKey: "order-1", Payload: []byte("payload")}
+	require.NoError(t, b.Publish(context.Background(), keyed))
+	unkeyed := &schema.OutboxEvent{ID: "2", Entity: "orders", Payload: []byte("payload")}
+	require.NoError(t, b.Publish(context.Background(), unkeyed))
+
+	assert.Equal(t, []string{"orders", "orders:{order-1}"}, server.Keys())
+	assert.Contains(t, keyed.MessageID, "orders:{order-1}/")
+}
+
+func TestRedisBroker_WrongTypeIsPermanent(t *testing.T) {
+	server := miniredis.RunT(t)
+	require.NoError(t, server.Set("orders", "not a stream"))
+	b, err := NewRedisBroker(context.Background(), &config.BrokerSettings{URL: "redis://" + server.Addr()})
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{ID: "1", Entity: "orders", Payload: []byte("payload")}
+	err = b.Publish(context.Background(), event)
+	assert.True(t, IsPermanent(err), "got %v", err)
+	assert.Empty(t, event.MessageID)
+
+	// Losing the connection is retried.
+	server.Close()
+	err = b.Publish(context.Background(), &schema.OutboxEvent{ID: "2", Entity: "orders-2", Payload: []byte("payload")})
+	assert.Error(t, err)
+	assert.False(t, IsPermanent(err))
+}
+
+func TestRedisBroker_Cluster(t *testing.T) {
+	server := miniredis.RunT(t)
+	b, err := NewRedisBroker(context.Background(), &config.BrokerSettings{
+		URL:   "redis://" + server.Addr(),
+		Redis: config.RedisSettings{Cluster: true, HashTagRoutingKey: true},
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{ID: "1", Entity: "orders", RoutingKey: "order-1", Payload: []byte("payload")}
+	require.NoError(t, b.Publish(context.Background(), event))
+	entries, err := server.Stream("orders:{order-1}")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestNewRedisBroker_InvalidURL(t *testing.T) {
+	_, err := NewRedisBroker(context.Background(), &config.BrokerSettings{URL: "http://localhost:6379"})
+	assert.Error(t, err)
+	_, err = NewRedisBroker(context.Background(), &config.BrokerSettings{URL: "http://localhost:6379", Redis: config.RedisSettings{Cluster: true}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,169 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// SNSBrokerCreator defines a function type for creating SNS brokers.
+type SNSBrokerCreator func(ctx context.Context, settings *config.BrokerSettings, opts ...func(*sns.Options)) (MessageBroker, error)
+
+// NewSNSBroker creates a broker publishing to the SNS topics named, or identified by the ARN,
+// in the entity of the events. opts are applied after the options derived from settings.
+var NewSNSBroker SNSBrokerCreator = func(ctx context.Context, settings *config.BrokerSettings, opts ...func(*sns.Options)) (MessageBroker, error) {
+	cfg, err := loadAWSConfig(ctx, settings.AWS)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := settings.AWS.Endpoint
+	client := sns.NewFromConfig(cfg, append([]func(*sns.Options){func(o *sns.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	}}, opts...)...)
+	return &snsBroker{client: client, topicARNs: make(map[string]string)}, nil
+}
+
+type snsBroker struct {
+	client    *sns.Client
+	mu        sync.Mutex
+	topicARNs map[string]string
+	closed    bool
+}
+
+func (s *snsBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	tracer := otel.Tracer("go-outbox")
+	ctx, span := tracer.Start(ctx, "Publish",
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("sns"),
+			semconv.MessagingDestinationKindKey.String("topic"),
+			semconv.MessagingDestinationKey.String(event.Entity),
+		),
+	)
+	defer span.End()
+
+	topicARN, err := s.topicARN(ctx, event.Entity)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	// Inject the trace context into the message attributes
+	headers := make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	for key, value := range event.Headers {
+		headers[key] = value
+	}
+
+	body, encoded := awsMessageBody(event.Payload)
+	if encoded {
+		headers[AWSPayloadEncodingAttribute] = "base64"
+	}
+	attributes, err := awsMessageAttributes(headers)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(topicARN),
+		Message:           aws.String(body),
+		MessageAttributes: make(map[string]types.MessageAttributeValue, len(attributes)),
+	}
+	for key, value := range attributes {
+		input.MessageAttributes[key] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	if isFIFO(topicARN) {
+		input.MessageGroupId = aws.String(messageGroupID(event))
+		input.MessageDeduplicationId = aws.String(event.ID)
+	}
+
+	output, err := s.client.Publish(ctx, input)
+	if err != nil {
+		span.RecordError(err)
+		if isPermanentAWSError(err) {
+			return Permanent(err)
+		}
+		return err
+	}
+	event.MessageID = aws.ToString(output.MessageId)
+
+	span.SetAttributes(
+		attribute.Int("messaging.message_payload_size_bytes", len(event.Payload)),
+		semconv.MessagingMessageIDKey.String(event.MessageID),
+	)
+
+	return nil
+}
+
+// topicARN returns the ARN of the topic of entity, which is either the ARN or the name of the
+// topic. The ARNs of topic names are looked up once.
+func (s *snsBroker) topicARN(ctx context.Context, entity string) (string, error) {
+	if strings.HasPrefix(entity, "arn:") {
+		return entity, nil
+	}
+	s.mu.Lock()
+	topicARN, ok := s.topicARNs[entity]
+	s.mu.Unlock()
+	if ok {
+		return topicARN, nil
+	}
+
+	paginator := sns.NewListTopicsPaginator(s.client, &sns.ListTopicsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to look up the ARN of topic %s: %w", entity, err)
+		}
+		for _, topic := range page.Topics {
+			if strings.HasSuffix(aws.ToString(topic.TopicArn), ":"+entity) {
+				s.mu.Lock()
+				s.topicARNs[entity] = aws.ToString(topic.TopicArn)
+				s.mu.Unlock()
+				return aws.ToString(topic.TopicArn), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("topic %s not found", entity)
+}
+
+// messageGroupID returns the message group of event in a FIFO topic or queue: its routing
+// key, which keeps the events of a key in order. Events without a routing key are not ordered,
+// so each gets a group of its own.
+func messageGroupID(event *schema.OutboxEvent) string {
+	if event.RoutingKey != "" {
+		return event.RoutingKey
+	}
+	return event.ID
+}
+
+func (s *snsBroker) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The client holds no connections of its own, there is nothing else to release.
+	s.closed = true
+	return nil
+}
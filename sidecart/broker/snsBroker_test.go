@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// fakeSNS serves the SNS query protocol, answering ListTopics and Publish.
+type fakeSNS struct {
+	mu        sync.Mutex
+	topicARNs []string
+	listings  int
+	published []url.Values
+	// errorCode, if set, fails Publish with this error and errorMessage.
+	errorCode    string
+	errorMessage string
+}
+
+func (f *fakeSNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml")
+	switch r.PostForm.Get("Action") {
+	case "ListTopics":
+		f.listings++
+		fmt.Fprint(w, `<ListTopicsResponse><ListTopicsResult><Topics>`)
+		for _, topicARN := range f.topicARNs {
+			fmt.Fprintf(w, `<member><TopicArn>%s</TopicArn></member>`, topicARN)
+		}
+		fmt.Fprint(w, `</Topics></ListTopicsResult></ListTopicsResponse>`)
+	case "Publish":
+		if f.errorCode != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error></ErrorResponse>`, f.errorCode, f.errorMessage)
+			return
+		}
+		f.published = append(f.published, r.PostForm)
+		fmt.Fprint(w, `<PublishResponse><PublishResult><MessageId>message-1</MessageId></PublishResult></PublishResponse>`)
+	default:
+		http.Error(w, "unexpected action", http.StatusBadRequest)
+	}
+}
+
+func newSNSTestBroker(t *testing.T, fake *fakeSNS) MessageBroker {
+	setAWSTestEnv(t)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	b, err := NewBroker(context.Background(), &config.BrokerSettings{
+		Type: "sns",
+		AWS:  config.AWSSettings{Region: "eu-central-1", Endpoint: server.URL},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// messageAttributes returns the message attributes of a Publish request.
+func messageAttributes(form url.Values) map[string]string {
+	attributes := make(map[string]string)
+	for i := 1; form.Has(fmt.Sprintf("MessageAttributes.entry.%d.Name", i)); i++ {
+		attributes[form.Get(fmt.Sprintf("MessageAttributes.entry.%d.Name", i))] = form.Get(fmt.Sprintf("MessageAttributes.entry.%d.Value.StringValue", i))
+	}
+	return attributes
+}
+
+func TestSNSBroker_PublishesToFIFOTopics(t *testing.T) {
+	fake := &fakeSNS{topicARNs: []string{
+		"arn:aws:sns:eu-central-1:123456789012:orders",
+		"arn:aws:sns:eu-central-1:123456789012:orders.fifo",
+	}}
+	b := newSNSTestBroker(t, fake)
+
+	event := &schema.OutboxEvent{
+		ID:         "event-1",
+		Entity:     "orders.fifo",
+		RoutingKey: "order-1",
+		Payload:    []byte(`{"id":1}`),
+		Headers:    map[string]string{"tenant": "acme"},
+	}
+	require.NoError(t, b.Publish(context.Background(), event))
+	require.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "event-2", Entity: "orders.fifo", Payload: []byte("{}")}))
+	assert.Equal(t, "message-1", event.MessageID)
+
+	assert.Equal(t, 1, fake.listings, "topic ARNs are looked up once")
+	require.Len(t, fake.published, 2)
+	published := fake.published[0]
+	assert.Equal(t, "arn:aws:sns:eu-central-1:123456789012:orders.fifo", published.Get("TopicArn"))
+	assert.Equal(t, `{"id":1}`, published.Get("Message"))
+	assert.Equal(t, "order-1", published.Get("MessageGroupId"))
+	assert.Equal(t, "event-1", published.Get("MessageDeduplicationId"))
+	assert.Equal(t, "acme", messageAttributes(published)["tenant"])
+}
+
+func TestSNSBroker_PublishesToStandardTopics(t *testing.T) {
+	fake := &fakeSNS{}
+	b := newSNSTestBroker(t, fake)
+
+	event := &schema.OutboxEvent{ID: "event-1", Entity: "arn:aws:sns:eu-central-1:123456789012:orders", RoutingKey: "order-1", Payload: []byte("payload")}
+	require.NoError(t, b.Publish(context.Background(), event))
+
+	assert.Zero(t, fake.listings, "ARNs need no lookup")
+	require.Len(t, fake.published, 1)
+	assert.False(t, fake.published[0].Has("MessageGroupId"))
+	assert.False(t, fake.published[0].Has("MessageDeduplicationId"))
+}
+
+func TestSNSBroker_PacksHeadersBeyondTheAttributeLimit(t *testing.T) {
+	fake := &fakeSNS{}
+	b := newSNSTestBroker(t, fake)
+
+	headers := make(map[string]string)
+	for i := range 12 {
+		headers[fmt.Sprintf("h%02d", i)] = fmt.Sprintf("v%d", i)
+	}
+	event := &schema.OutboxEvent{ID: "event-1", Entity: "arn:aws:sns:eu-central-1:123456789012:orders", Payload: []byte{0xff}, Headers: headers}
+	require.NoError(t, b.Publish(context.Background(), event))
+
+	require.Len(t, fake.published, 1)
+	attributes := messageAttributes(fake.published[0])
+	assert.Len(t, attributes, 10)
+	assert.Equal(t, "base64", attributes[AWSPayloadEncodingAttribute])
+	assert.Equal(t, "v7", attributes["h07"])
+	assert.JSONEq(t, `{"h08":"v8","h09":"v9","h10":"v10","h11":"v11"}`, attributes[AWSHeadersAttribute])
+}
+
+func TestSNSBroker_ClassifiesErrors(t *testing.T) {
+	fake := &fakeSNS{errorCode: "InvalidParameter", errorMessage: "Invalid parameter: Message too long"}
+	b := newSNSTestBroker(t, fake)
+
+	event := &schema.OutboxEvent{ID: "event-1", Entity: "arn:aws:sns:eu-central-1:123456789012:orders", Payload: []byte("payload")}
+	err := b.Publish(context.Background(), event)
+	assert.True(t, IsPermanent(err), "got %v", err)
+	assert.Empty(t, event.MessageID)
+
+	// Invalid parameters of the request rather than the message are not permanent.
+	fake.errorMessage = "Invalid parameter: TopicArn"
+	err = b.Publish(context.Background(), event)
+	assert.Error(t, err)
+	assert.False(t, IsPermanent(err))
+
+	// A topic that does not exist yet is retried.
+	err = b.Publish(context.Background(), &schema.OutboxEvent{ID: "event-2", Entity: "payments", Payload: []byte("payload")})
+	assert.Error(t, err)
+	assert.False(t, IsPermanent(err))
+}
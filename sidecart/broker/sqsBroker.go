@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// SQSBrokerCreator defines a function type for creating SQS brokers.
+type SQSBrokerCreator func(ctx context.Context, settings *config.BrokerSettings, opts ...func(*sqs.Options)) (MessageBroker, error)
+
+// NewSQSBroker creates a broker sending to the SQS queues named, or identified by the ARN or
+// URL, in the entity of the events. opts are applied after the options derived from settings.
+var NewSQSBroker SQSBrokerCreator = func(ctx context.Context, settings *config.BrokerSettings, opts ...func(*sqs.Options)) (MessageBroker, error) {
+	cfg, err := loadAWSConfig(ctx, settings.AWS)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := settings.AWS.Endpoint
+	client := sqs.NewFromConfig(cfg, append([]func(*sqs.Options){func(o *sqs.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	}}, opts...)...)
+	return &sqsBroker{client: client, queueURLs: make(map[string]string)}, nil
+}
+
+type sqsBroker struct {
+	client    *sqs.Client
+	mu        sync.Mutex
+	queueURLs map[string]string
+	closed    bool
+}
+
+func (s *sqsBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	tracer := otel.Tracer("go-outbox")
+	ctx, span := tracer.Start(ctx, "Publish",
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("sqs"),
+			semconv.MessagingDestinationKindKey.String("queue"),
+			semconv.MessagingDestinationKey.String(event.Entity),
+		),
+	)
+	defer span.End()
+
+	queueURL, err := s.queueURL(ctx, event.Entity)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	// Inject the trace context into the message attributes
+	headers := make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	for key, value := range event.Headers {
+		headers[key] = value
+	}
+
+	body, encoded := awsMessageBody(event.Payload)
+	if encoded {
+		headers[AWSPayloadEncodingAttribute] = "base64"
+	}
+	attributes, err := awsMessageAttributes(headers)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queueURL),
+		MessageBody:       aws.String(body),
+		MessageAttributes: make(map[string]types.MessageAttributeValue, len(attributes)),
+	}
+	for key, value := range attributes {
+		input.MessageAttributes[key] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	if isFIFO(queueURL) {
+		input.MessageGroupId = aws.String(messageGroupID(event))
+		input.MessageDeduplicationId = aws.String(event.ID)
+	}
+
+	output, err := s.client.SendMessage(ctx, input)
+	if err != nil {
+		span.RecordError(err)
+		if isPermanentAWSError(err) {
+			return Permanent(err)
+		}
+		return err
+	}
+	event.MessageID = aws.ToString(output.MessageId)
+
+	span.SetAttributes(
+		attribute.Int("messaging.message_payload_size_bytes", len(event.Payload)),
+		semconv.MessagingMessageIDKey.String(event.MessageID),
+	)
+
+	return nil
+}
+
+// queueURL returns the URL of the queue of entity, which is either the URL, the ARN or the
+// name of the queue. The URLs of queue ARNs and names are looked up once.
+func (s *sqsBroker) queueURL(ctx context.Context, entity string) (string, error) {
+	if strings.HasPrefix(entity, "https://") || strings.HasPrefix(entity, "http://") {
+		return entity, nil
+	}
+	s.mu.Lock()
+	queueURL, ok := s.queueURLs[entity]
+	s.mu.Unlock()
+	if ok {
+		return queueURL, nil
+	}
+
+	input := &sqs.GetQueueUrlInput{QueueName: aws.String(entity)}
+	if queueARN, err := arn.Parse(entity); err == nil {
+		input.QueueName = aws.String(queueARN.Resource)
+		input.QueueOwnerAWSAccountId = aws.String(queueARN.AccountID)
+	}
+	output, err := s.client.GetQueueUrl(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the URL of queue %s: %w", entity, err)
+	}
+
+	s.mu.Lock()
+	s.queueURLs[entity] = aws.ToString(output.QueueUrl)
+	s.mu.Unlock()
+	return aws.ToString(output.QueueUrl), nil
+}
+
+func (s *sqsBroker) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The client holds no connections of its own, there is nothing else to release.
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// setAWSTestEnv gives the AWS clients static credentials and keeps them from reading the
+// shared config files of the host.
+func setAWSTestEnv(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+}
+
+// fakeSQS serves the SQS JSON protocol, answering GetQueueUrl and SendMessage.
+type fakeSQS struct {
+	mu       sync.Mutex
+	lookups  []map[string]any
+	messages []map[string]any
+	// errorCode, if set, fails SendMessage with this error and errorMessage.
+	errorCode    string
+	errorMessage string
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	switch r.Header.Get("X-Amz-Target") {
+	case "AmazonSQS.GetQueueUrl":
+		f.lookups = append(f.lookups, input)
+		json.NewEncoder(w).Encode(map[string]string{"QueueUrl": "http://" + r.Host + "/000000000000/" + input["QueueName"].(string)})
+	case "AmazonSQS.SendMessage":
+		if f.errorCode != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.sqs#" + f.errorCode, "message": f.errorMessage})
+			return
+		}
+		f.messages = append(f.messages, input)
+		json.NewEncoder(w).Encode(map[string]string{"MessageId": "message-1"})
+	default:
+		http.Error(w, "unexpected operation", http.StatusBadRequest)
+	}
+}
+
+func newSQSTestBroker(t *testing.T, fake *fakeSQS) MessageBroker {
+	setAWSTestEnv(t)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	b, err := NewSQSBroker(context.Background(), &config.BrokerSettings{
+		AWS: config.AWSSettings{Region: "eu-central-1", Endpoint: server.URL},
+	}, func(o *sqs.Options) {
+		// The fake computes no checksums.
+		o.DisableMessageChecksumValidation = true
+		o.RetryMaxAttempts = 1
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestSQSBroker_SendsToFIFOQueues(t *testing.T) {
+	fake := &fakeSQS{}
+	b := newSQSTestBroker(t, fake)
+
+	event := &schema.OutboxEvent{
+		ID:         "event-1",
+		Entity:     "orders.fifo",
+		RoutingKey: "order-1",
+		Payload:    []byte(`{"id":1}`),
+		Headers:    map[string]string{"tenant": "acme"},
+	}
+	require.NoError(t, b.Publish(context.Background(), event))
+	require.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "event-2", Entity: "orders.fifo", Payload: []byte("{}")}))
+	assert.Equal(t, "message-1", event.MessageID)
+
+	require.Len(t, fake.lookups, 1, "queue URLs are looked up once")
+	assert.Equal(t, "orders.fifo", fake.lookups[0]["QueueName"])
+	require.Len(t, fake.messages, 2)
+	message := fake.messages[0]
+	assert.Contains(t, message["QueueUrl"], "/000000000000/orders.fifo")
+	assert.Equal(t, `{"id":1}`, message["MessageBody"])
+	assert.Equal(t, "order-1", message["MessageGroupId"])
+	assert.Equal(t, "event-1", message["MessageDeduplicationId"])
+	assert.Equal(t, map[string]any{"DataType": "String", "StringValue": "acme"}, message["MessageAttributes"].(map[string]any)["tenant"])
+	assert.Equal(t, "event-2", fake.messages[1]["MessageGroupId"], "events without routing key are not ordered")
+}
+
+func TestSQSBroker_SendsToStandardQueues(t *testing.T) {
+	fake := &fakeSQS{}
+	b := newSQSTestBroker(t, fake)
+
+	event := &schema.OutboxEvent{ID: "event-1", Entity: "arn:aws:sqs:eu-central-1:123456789012:orders", RoutingKey: "order-1", Payload: []byte{0x00, 0xff}}
+	require.NoError(t, b.Publish(context.Background(), event))
+
+	require.Len(t, fake.lookups, 1)
+	assert.Equal(t, "orders", fake.lookups[0]["QueueName"])
+	assert.Equal(t, "123456789012", fake.lookups[0]["QueueOwnerAWSAccountId"])
+	require.Len(t, fake.messages, 1)
+	message := fake.messages[0]
+	assert.NotContains(t, message, "MessageGroupId")
+	assert.NotContains(t, message, "MessageDeduplicationId")
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte{0x00, 0xff}), message["MessageBody"])
+	assert.Equal(t, "base64", message["MessageAttributes"].(map[string]any)[AWSPayloadEncodingAttribute].(map[string]any)["StringValue"])
+}
+
+func TestSQSBroker_PacksHeadersBeyondTheAttributeLimit(t *testing.T) {
+	fake := &fakeSQS{}
+	b := newSQSTestBroker(t, fake)
+
+	headers := map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "empty": ""}
+	for i := range 11 {
+		headers[fmt.Sprintf("h%02d", i)] = fmt.Sprintf("v%d", i)
+	}
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(previous)
+	require.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "event-1", Entity: "orders", Payload: []byte("{}"), Headers: headers}))
+
+	require.Len(t, fake.messages, 1)
+	attributes := fake.messages[0]["MessageAttributes"].(map[string]any)
+	assert.Len(t, attributes, 10)
+	assert.Contains(t, attributes, "traceparent", "the trace context keeps its own attribute")
+	assert.Contains(t, attributes, "h07")
+	assert.NotContains(t, attributes, "empty")
+	packed := attributes[AWSHeadersAttribute].(map[string]any)["StringValue"].(string)
+	assert.JSONEq(t, `{"h08":"v8","h09":"v9","h10":"v10"}`, packed)
+}
+
+func TestSQSBroker_ClassifiesErrors(t *testing.T) {
+	fake := &fakeSQS{errorCode: "InvalidParameterValue", errorMessage: "Number of message attributes [11] exceeds the allowed maximum [10]."}
+	b := newSQSTestBroker(t, fake)
+
+	event := &schema.OutboxEvent{ID: "event-1", Entity: "orders", Payload: []byte("payload")}
+	err := b.Publish(context.Background(), event)
+	assert.True(t, IsPermanent(err), "got %v", err)
+	assert.Empty(t, event.MessageID)
+
+	// Invalid parameters of the request rather than the message are not permanent.
+	fake.errorMessage = "Value 0 for parameter DelaySeconds is invalid."
+	err = b.Publish(context.Background(), event)
+	assert.Error(t, err)
+	assert.False(t, IsPermanent(err))
+
+	fake.errorCode = "ServiceUnavailable"
+	err = b.Publish(context.Background(), event)
+	assert.Error(t, err)
+	assert.False(t, IsPermanent(err))
+}
+
+func TestAWSMessageBody(t *testing.T) {
+	for payload, encoded := range map[string]bool{
+		`{"note":"grüezi, 世界"}`: false,
+		"line\r\n\ttab":         false,
+		"\x00":                  true,
+		"\xff":                  true,
+		"\uFFFE":                true,
+	} {
+		body, isEncoded := awsMessageBody([]byte(payload))
+		assert.Equal(t, encoded, isEncoded, "%q", payload)
+		if !encoded {
+			assert.Equal(t, payload, body)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// Defaults of the webhook broker.
+const (
+	DefaultWebhookSignatureHeader = "X-Outbox-Signature"
+	DefaultWebhookContentType     = "application/json"
+	DefaultWebhookTimeout         = 10 * time.Second
+)
+
+// The headers the webhook broker sets on every request besides the event headers.
+const (
+	WebhookEventIDHeader    = "X-Outbox-Event-Id"
+	WebhookRoutingKeyHeader = "X-Outbox-Routing-Key"
+	WebhookTimestampHeader  = "X-Outbox-Timestamp"
+)
+
+// WebhookBrokerCreator defines a function type for creating webhook brokers.
+type WebhookBrokerCreator func(ctx context.Context, settings *config.BrokerSettings) (MessageBroker, error)
+
+// NewWebhookBroker creates a broker posting the events to the endpoints of settings.Webhook,
+// or to settings.URL for entities without one.
+var NewWebhookBroker WebhookBrokerCreator = func(ctx context.Context, settings *config.BrokerSettings) (MessageBroker, error) {
+	webhook := settings.Webhook
+	if webhook.SignatureHeader == "" {
+		webhook.SignatureHeader = DefaultWebhookSignatureHeader
+	}
+	if webhook.ContentType == "" {
+		webhook.ContentType = DefaultWebhookContentType
+	}
+	if webhook.Timeout == 0 {
+		webhook.Timeout = DefaultWebhookTimeout
+	}
+
+	endpoints := make(map[string]string, len(webhook.Endpoints))
+	for _, endpoint := range webhook.Endpoints {
+		endpoints[endpoint.Entity] = endpoint.URL
+	}
+	if settings.URL == "" && len(endpoints) == 0 {
+		return nil, fmt.Errorf("no webhook URL configured")
+	}
+
+	tlsConfig, err := newTLSConfig(settings.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   webhook.Timeout,
+		// Following a redirect would turn the POST into a GET without the event, redirects
+		// are retried like any other response outside of 2xx.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return &webhookBroker{
+		client:     client,
+		settings:   webhook,
+		defaultURL: settings.URL,
+		endpoints:  endpoints,
+	}, nil
+}
+
+type webhookBroker struct {
+	client     *http.Client
+	settings   config.WebhookSettings
+	defaultURL string
+	endpoints  map[string]string
+	mu         sync.Mutex
+	closed     bool
+}
+
+func (w *webhookBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	closed := w.closed
+	w.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	endpoint := w.url(event.Entity)
+	tracer := otel.Tracer("go-outbox")
+	ctx, span := tracer.Start(ctx, "Publish",
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("webhook"),
+			semconv.MessagingDestinationKey.String(event.Entity),
+			semconv.HTTPMethodKey.String(http.MethodPost),
+			semconv.HTTPURLKey.String(endpoint),
+		),
+	)
+	defer span.End()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(event.Payload))
+	if err != nil {
+		span.RecordError(err)
+		return Permanent(fmt.Errorf("invalid webhook URL for entity %s: %w", event.Entity, err))
+	}
+
+	// Inject the trace context into the request headers
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+	for key, value := range event.Headers {
+		request.Header.Set(key, value)
+	}
+	request.Header.Set("Content-Type", w.settings.ContentType)
+	request.Header.Set(WebhookEventIDHeader, event.ID)
+	if event.RoutingKey != "" {
+		request.Header.Set(WebhookRoutingKeyHeader, event.RoutingKey)
+	}
+	if w.settings.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(WebhookTimestampHeader, timestamp)
+		request.Header.Set(w.settings.SignatureHeader, WebhookSignature(w.settings.Secret, timestamp, event.Payload))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer response.Body.Close()
+	// Read a little of the body for the error, and the rest to reuse the connection.
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	io.Copy(io.Discard, response.Body)
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(response.StatusCode))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err := fmt.Errorf("webhook %s responded %s: %s", endpoint, response.Status, strings.TrimSpace(string(body)))
+		span.RecordError(err)
+		if isPermanentWebhookStatus(response.StatusCode) {
+			return Permanent(err)
+		}
+		return err
+	}
+	// Webhooks return no message IDs, the receiver knows the event by its ID.
+	event.MessageID = event.ID
+
+	span.SetAttributes(
+		attribute.Int("messaging.message_payload_size_bytes", len(event.Payload)),
+		semconv.MessagingMessageIDKey.String(event.MessageID),
+	)
+
+	return nil
+}
+
+// url returns the URL the events of entity are posted to.
+func (w *webhookBroker) url(entity string) string {
+	if endpoint, ok := w.endpoints[entity]; ok {
+		return endpoint
+	}
+	return strings.ReplaceAll(w.defaultURL, "{entity}", url.PathEscape(entity))
+}
+
+// WebhookSignature returns the signature of a request posting payload at timestamp, the Unix
+// time in the timestamp header: the hex encoded HMAC-SHA256 of the timestamp, a dot and the
+// payload, keyed with secret and prefixed with sha256=. Receivers recompute it to verify the
+// request, and reject old timestamps to prevent replays.
+func WebhookSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// isPermanentWebhookStatus reports whether the status rejects the request itself, so that
+// posting it again fails the same way: client errors, except for timeouts and rate limits.
+func isPermanentWebhookStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 400 && status <= 499
+}
+
+func (w *webhookBroker) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.client.CloseIdleConnections()
+	return nil
+}
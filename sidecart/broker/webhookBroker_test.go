@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+func TestWebhookBroker_PostsEvents(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	b, err := NewBroker(context.Background(), &config.BrokerSettings{
+		Type: "webhook",
+		URL:  server.URL + "/events/{entity}",
+		Webhook: config.WebhookSettings{
+			Endpoints: []config.WebhookEndpoint{{Entity: "orders", URL: server.URL + "/orders-hook"}},
+			Secret:    "secret",
+		},
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{
+		ID:         "event-1",
+		Entity:     "orders",
+		RoutingKey: "order-1",
+		Payload:    []byte(`{"id":1}`),
+		Headers:    map[string]string{"tenant": "acme"},
+	}
+	require.NoError(t, b.Publish(context.Background(), event))
+	assert.Equal(t, "event-1", event.MessageID)
+
+	request, body := <-requests, <-bodies
+	assert.Equal(t, http.MethodPost, request.Method)
+	assert.Equal(t, "/orders-hook", request.URL.Path)
+	assert.Equal(t, `{"id":1}`, string(body))
+	assert.Equal(t, "acme", request.Header.Get("tenant"))
+	assert.Equal(t, DefaultWebhookContentType, request.Header.Get("Content-Type"))
+	assert.Equal(t, "event-1", request.Header.Get(WebhookEventIDHeader))
+	assert.Equal(t, "order-1", request.Header.Get(WebhookRoutingKeyHeader))
+	timestamp := request.Header.Get(WebhookTimestampHeader)
+	require.NotEmpty(t, timestamp)
+	assert.Equal(t, WebhookSignature("secret", timestamp, body), request.Header.Get(DefaultWebhookSignatureHeader))
+
+	// Other entities are posted to the default URL.
+	require.NoError(t, b.Publish(context.Background(), &schema.OutboxEvent{ID: "event-2", Entity: "payments/eu", Payload: []byte("{}")}))
+	request = <-requests
+	<-bodies
+	assert.Equal(t, "/events/payments%2Feu", request.URL.EscapedPath())
+	assert.Empty(t, request.Header.Get(WebhookRoutingKeyHeader))
+}
+
+func TestWebhookBroker_ClassifiesResponses(t *testing.T) {
+	tests := []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusNotFound, true},
+		{http.StatusUnprocessableEntity, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusBadGateway, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "rejected", test.status)
+			}))
+			defer server.Close()
+			b, err := NewWebhookBroker(context.Background(), &config.BrokerSettings{URL: server.URL})
+			require.NoError(t, err)
+			defer b.Close()
+
+			event := &schema.OutboxEvent{ID: "event-1", Entity: "orders", Payload: []byte("{}")}
+			err = b.Publish(context.Background(), event)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "rejected")
+			assert.Equal(t, test.permanent, IsPermanent(err))
+			assert.Empty(t, event.MessageID)
+		})
+	}
+}
+
+func TestWebhookBroker_DoesNotFollowRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/hook", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/moved", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	b, err := NewWebhookBroker(context.Background(), &config.BrokerSettings{URL: server.URL + "/hook"})
+	require.NoError(t, err)
+	defer b.Close()
+
+	event := &schema.OutboxEvent{ID: "event-1", Entity: "orders", Payload: []byte("{}")}
+	err = b.Publish(context.Background(), event)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "302")
+	assert.False(t, IsPermanent(err), "redirects are retried")
+	assert.Empty(t, event.MessageID)
+}
+
+func TestWebhookBroker_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	b, err := NewWebhookBroker(context.Background(), &config.BrokerSettings{
+		URL:     server.URL,
+		Webhook: config.WebhookSettings{Timeout: 50 * time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.Publish(context.Background(), &schema.OutboxEvent{ID: "event-1", Entity: "orders", Payload: []byte("{}")})
+	assert.Error(t, err)
+	assert.False(t, IsPermanent(err), "timeouts are retried")
+}
+
+func TestNewWebhookBroker_NoURL(t *testing.T) {
+	_, err := NewWebhookBroker(context.Background(), &config.BrokerSettings{})
+	assert.Error(t, err)
+}
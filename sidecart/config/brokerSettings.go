@@ -1,9 +1,138 @@
 package config
 
+import "time"
+
 // BrokerSettings holds configuration for connecting to a message broker.
 type BrokerSettings struct {
 	Type      string
-	URL       string
+	URL       string // Comma-separated seed brokers for Kafka, servers for NATS, redis:// URL for Redis, default webhook URL
 	ProjectID string // Optional for brokers like GCP Pub/Sub
 	PoolSize  int    // Optional for RabbitMQ
+	// TLS secures the connection to the broker (Kafka, NATS, Redis).
+	TLS TLSSettings `mapstructure:"tls"`
+	// SASL authenticates the sidecar to the broker (Kafka).
+	SASL SASLSettings `mapstructure:"sasl"`
+	// Kafka holds the settings specific to the kafka broker.
+	Kafka KafkaSettings `mapstructure:"kafka"`
+	// NATS holds the settings specific to the nats broker.
+	NATS NATSSettings `mapstructure:"nats"`
+	// Redis holds the settings specific to the redis broker.
+	Redis RedisSettings `mapstructure:"redis"`
+	// AWS holds the settings specific to the sns and sqs brokers.
+	AWS AWSSettings `mapstructure:"aws"`
+	// Webhook holds the settings specific to the webhook broker.
+	Webhook WebhookSettings `mapstructure:"webhook"`
+}
+
+// TLSSettings configures a TLS connection to the broker.
+type TLSSettings struct {
+	Enabled bool `mapstructure:"enabled"`
+	// CAFile is a PEM file with the CAs that verify the broker certificate (default: the
+	// system roots).
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile are a PEM client certificate and its key, for mutual TLS.
+	CertFile string `mapstructure:"cert_file" validate:"required_with=KeyFile"`
+	KeyFile  string `mapstructure:"key_file" validate:"required_with=CertFile"`
+	// ServerName overrides the host name verified against the broker certificate.
+	ServerName string `mapstructure:"server_name"`
+	// InsecureSkipVerify disables verifying the broker certificate. For tests only.
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+}
+
+// SASLSettings configures SASL authentication.
+type SASLSettings struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512. Empty disables SASL.
+	Mechanism string `mapstructure:"mechanism" validate:"omitempty,oneof=PLAIN SCRAM-SHA-256 SCRAM-SHA-512"`
+	Username  string `mapstructure:"username" validate:"required_with=Mechanism"`
+	Password  string `mapstructure:"password"`
+}
+
+// KafkaSettings configures the kafka broker.
+type KafkaSettings struct {
+	// ClientID identifies the sidecar in the broker logs and quotas (default "go-outbox").
+	ClientID string `mapstructure:"client_id"`
+	// Acks is how many replicas must store a record before it counts as published: all
+	// (default), leader or none. Anything but all requires DisableIdempotence.
+	Acks string `mapstructure:"acks" validate:"omitempty,oneof=all leader none"`
+	// DisableIdempotence turns off the idempotent producer, which otherwise keeps retried
+	// produce requests from writing duplicates. Needed when the sidecar lacks the
+	// IDEMPOTENT_WRITE permission on brokers before Kafka 3.0.
+	DisableIdempotence bool `mapstructure:"disable_idempotence"`
+	// AutoCreateTopics lets publishing create missing topics, if the brokers allow it.
+	AutoCreateTopics bool `mapstructure:"auto_create_topics"`
+}
+
+// NATSSettings configures the nats broker, which publishes to JetStream.
+type NATSSettings struct {
+	// CredentialsFile is a NATS credentials file (user JWT and NKey seed) authenticating the
+	// sidecar. User and password can be given in the URL instead.
+	CredentialsFile string `mapstructure:"credentials_file"`
+	// Streams are created, or updated to match, when the broker connects. Streams managed
+	// elsewhere need not be listed.
+	Streams []NATSStreamSettings `mapstructure:"streams" validate:"dive"`
+}
+
+// NATSStreamSettings defines a JetStream stream.
+type NATSStreamSettings struct {
+	Name string `mapstructure:"name" validate:"required"`
+	// Subjects are the subjects the stream stores, e.g. orders.> for the events of the orders
+	// entity that have a routing key.
+	Subjects []string `mapstructure:"subjects" validate:"required,min=1"`
+	// Storage is file (default) or memory.
+	Storage string `mapstructure:"storage" validate:"omitempty,oneof=file memory"`
+	// Replicas is the number of copies kept in a cluster (default 1).
+	Replicas int `mapstructure:"replicas" validate:"gte=0,lte=5"`
+	// MaxAge discards messages older than this (default: no limit).
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// DuplicateWindow is how long the stream remembers message IDs to discard republished
+	// events (default 2m).
+	DuplicateWindow time.Duration `mapstructure:"duplicate_window"`
+}
+
+// RedisSettings configures the redis broker, which appends events to Redis streams.
+type RedisSettings struct {
+	// Cluster connects to a Redis Cluster. The URL names one node; further seed nodes are
+	// added as addr query parameters, e.g. redis://node-1:6379?addr=node-2:6379.
+	Cluster bool `mapstructure:"cluster"`
+	// HashTagRoutingKey appends the routing key of an event to its stream name as a hash tag,
+	// e.g. orders:{order-1}, spreading the events of an entity across the cluster while
+	// keeping the events of a routing key in one stream.
+	HashTagRoutingKey bool `mapstructure:"hash_tag_routing_key"`
+	// MaxLen trims the streams to about this many entries when adding events (default: no
+	// trimming).
+	MaxLen int64 `mapstructure:"max_len" validate:"gte=0"`
+	// ExactTrimming trims the streams to exactly MaxLen entries rather than letting Redis trim
+	// whole nodes only, which is cheaper.
+	ExactTrimming bool `mapstructure:"exact_trimming"`
+}
+
+// AWSSettings configures the sns and sqs brokers. Credentials are taken from the default
+// chain: the AWS_* environment variables, the shared config files or the instance role.
+type AWSSettings struct {
+	// Region overrides the region of the default chain, e.g. eu-central-1.
+	Region string `mapstructure:"region"`
+	// Endpoint overrides the service endpoint, e.g. http://localhost:4566 for LocalStack or
+	// http://localhost:9324 for ElasticMQ.
+	Endpoint string `mapstructure:"endpoint" validate:"omitempty,url"`
+}
+
+// WebhookSettings configures the webhook broker, which POSTs events to HTTP endpoints.
+type WebhookSettings struct {
+	// Endpoints are the URLs of the entities. Events of other entities are posted to the
+	// broker URL, in which {entity} is replaced by their entity.
+	Endpoints []WebhookEndpoint `mapstructure:"endpoints" validate:"dive"`
+	// Secret signs the requests with HMAC-SHA256 (default: unsigned).
+	Secret string `mapstructure:"secret"`
+	// SignatureHeader is the header carrying the signature (default X-Outbox-Signature).
+	SignatureHeader string `mapstructure:"signature_header"`
+	// ContentType is the content type of the payloads (default application/json).
+	ContentType string `mapstructure:"content_type"`
+	// Timeout limits each request, including reading the response (default 10s).
+	Timeout time.Duration `mapstructure:"timeout" validate:"gte=0"`
+}
+
+// WebhookEndpoint is the URL events of an entity are posted to.
+type WebhookEndpoint struct {
+	Entity string `mapstructure:"entity" validate:"required"`
+	URL    string `mapstructure:"url" validate:"required,url"`
 }
@@ -1,8 +1,26 @@
 package config
 
+import "time"
+
 type DbSettings struct {
 	Type   string
 	DSN    string
 	URI    string
 	DBName string
+	// Collection is the MongoDB outbox collection (default "outbox_events").
+	Collection string `mapstructure:"collection"`
+	// InstanceID identifies this sidecar replica as the owner of the events it claims (default: host name).
+	InstanceID string `mapstructure:"instance_id"`
+	// LeaseDuration is how long a claim on an event lasts before another instance may take it
+	// over (default 5m, at least 1s). Claims are renewed right before and while an event is
+	// being published.
+	LeaseDuration time.Duration `mapstructure:"lease_duration" validate:"omitempty,min=1s"`
+	// RecordAttempts keeps every publish attempt in the outbox_event_attempts table.
+	RecordAttempts bool `mapstructure:"record_attempts"`
+	// BusyTimeout is how long SQLite writes wait for the database lock (default 5s).
+	BusyTimeout time.Duration `mapstructure:"busy_timeout"`
+	// NotifyChannel enables event-driven processing on Postgres: the sidecar LISTENs on
+	// this channel and fetches as soon as a notification arrives. Polling stays active.
+	// The notify trigger of outbox_events must name the channel as its argument.
+	NotifyChannel string `mapstructure:"notify_channel"`
 }
@@ -0,0 +1,18 @@
+package config
+
+import "time"
+
+// RetentionSettings configures the janitor that purges processed events from the outbox.
+type RetentionSettings struct {
+	// Statuses maps an event status to how long events stay in the outbox after reaching it,
+	// e.g. sent: 168h. Events in statuses without an entry are kept. Only final statuses can
+	// be purged.
+	Statuses map[string]time.Duration `mapstructure:"statuses" validate:"dive,keys,oneof=sent canceled failed dead_lettered,endkeys,gt=0"`
+	// Interval is how often the janitor runs (default 1h).
+	Interval time.Duration `mapstructure:"interval"`
+	// BatchSize bounds the number of events purged per statement (default 1000).
+	BatchSize int `mapstructure:"batch_size"`
+	// Archive moves purged events to the outbox_events_archive table (collection in MongoDB)
+	// instead of only deleting them.
+	Archive bool `mapstructure:"archive"`
+}
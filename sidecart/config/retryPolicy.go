@@ -0,0 +1,43 @@
+package config
+
+import "strings"
+
+// DefaultMaxRetries is the retry limit used when none is configured.
+const DefaultMaxRetries = 3
+
+// RetryPolicy decides how many times a failed event is retried before it is given up on.
+// The repository and the processor share one policy so they never disagree about the limit.
+type RetryPolicy struct {
+	// MaxRetries is the retry limit of entities without an override; 0 disables retries.
+	MaxRetries int
+	// Overrides holds per-entity retry limits keyed by OutboxEvent.Entity. Keys are
+	// matched case-insensitively because configuration keys are case-insensitive.
+	Overrides map[string]int
+}
+
+// NewRetryPolicy creates a RetryPolicy with the given default limit and per-entity overrides.
+func NewRetryPolicy(maxRetries int, overrides map[string]int) *RetryPolicy {
+	normalized := make(map[string]int, len(overrides))
+	for entity, limit := range overrides {
+		normalized[strings.ToLower(entity)] = limit
+	}
+	return &RetryPolicy{MaxRetries: maxRetries, Overrides: normalized}
+}
+
+// MaxRetriesFor returns the retry limit for events published to entity.
+// A nil policy applies DefaultMaxRetries to every entity.
+func (r *RetryPolicy) MaxRetriesFor(entity string) int {
+	if r == nil {
+		return DefaultMaxRetries
+	}
+	if limit, ok := r.Overrides[strings.ToLower(entity)]; ok {
+		return limit
+	}
+	return r.MaxRetries
+}
+
+// Exhausted reports whether an event that has already been retried retryCount times
+// gets no further retries after another failure.
+func (r *RetryPolicy) Exhausted(entity string, retryCount int) bool {
+	return retryCount >= r.MaxRetriesFor(entity)
+}
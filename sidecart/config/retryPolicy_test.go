@@ -0,0 +1,45 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_MaxRetriesFor(t *testing.T) {
+	policy := NewRetryPolicy(5, map[string]int{"Payments": 20, "analytics": 2})
+
+	assert.Equal(t, 20, policy.MaxRetriesFor("payments"))
+	assert.Equal(t, 20, policy.MaxRetriesFor("Payments"))
+	assert.Equal(t, 2, policy.MaxRetriesFor("analytics"))
+	assert.Equal(t, 5, policy.MaxRetriesFor("orders"))
+}
+
+func TestRetryPolicy_Defaults(t *testing.T) {
+	var nilPolicy *RetryPolicy
+	assert.Equal(t, DefaultMaxRetries, nilPolicy.MaxRetriesFor("orders"))
+	assert.Equal(t, DefaultMaxRetries, (&Settings{}).RetryPolicy().MaxRetriesFor("orders"))
+}
+
+func TestRetryPolicy_ZeroMaxRetriesDisablesRetries(t *testing.T) {
+	maxRetries := 0
+	policy := (&Settings{MaxRetries: &maxRetries, RetryOverrides: map[string]int{"payments": 2}}).RetryPolicy()
+	assert.True(t, policy.Exhausted("orders", 0))
+	assert.False(t, policy.Exhausted("payments", 0))
+}
+
+func TestRetryPolicy_ZeroOverrideDisablesRetries(t *testing.T) {
+	policy := NewRetryPolicy(5, map[string]int{"audit": 0})
+	assert.True(t, policy.Exhausted("audit", 0))
+	assert.False(t, policy.Exhausted("orders", 4))
+	assert.True(t, policy.Exhausted("orders", 5))
+}
+
+func TestSettings_RetryPolicy(t *testing.T) {
+	maxRetries := 5
+	cfg := Settings{MaxRetries: &maxRetries, RetryOverrides: map[string]int{"payments": 20}}
+	policy := cfg.RetryPolicy()
+
+	assert.Equal(t, 5, policy.MaxRetriesFor("orders"))
+	assert.Equal(t, 20, policy.MaxRetriesFor("payments"))
+}
@@ -12,14 +12,20 @@ import (
 )
 
 type Settings struct {
-	Database        DbSettings     `mapstructure:"database"`
-	Broker          BrokerSettings `mapstructure:"broker"`
-	PollInterval    time.Duration  `mapstructure:"poll_interval"`
-	BatchSize       int            `mapstructure:"batch_size"`
-	MaxRetries      int            `mapstructure:"max_retries"`
-	RetryBackoff    time.Duration  `mapstructure:"retry_backoff"` // initial backoff duration
-	DeadLetterTopic string         `mapstructure:"dead_letter_topic"`
-	Observability   Observability  `mapstructure:"observability"` // Observability settings
+	Database             DbSettings        `mapstructure:"database"`
+	Broker               BrokerSettings    `mapstructure:"broker"`
+	PollInterval         time.Duration     `mapstructure:"poll_interval"`
+	BatchSize            int               `mapstructure:"batch_size"`
+	Workers              int               `mapstructure:"workers"`                                // number of concurrent publishers
+	MaxRetries           *int              `mapstructure:"max_retries" validate:"omitempty,gte=0"` // DefaultMaxRetries when unset; 0 disables retries
+	RetryOverrides       map[string]int    `mapstructure:"retry_overrides"`                        // per-entity max_retries
+	RetryBackoff         time.Duration     `mapstructure:"retry_backoff"`                          // initial backoff duration
+	MaxRetryBackoff      time.Duration     `mapstructure:"max_retry_backoff"`                      // upper bound for the backoff between retries
+	DeadLetterTopic      string            `mapstructure:"dead_letter_topic"`
+	DeadLetterEntityType string            `mapstructure:"dead_letter_entity_type"` // entity type of the dead-letter topic, "topic" by default
+	ShutdownTimeout      time.Duration     `mapstructure:"shutdown_timeout"`        // time allowed to drain in-flight events
+	Retention            RetentionSettings `mapstructure:"retention"`               // purging of processed events
+	Observability        Observability     `mapstructure:"observability"`           // Observability settings
 }
 
 func (c *Settings) Validate() error {
@@ -27,6 +33,15 @@ func (c *Settings) Validate() error {
 	return validate.Struct(c)
 }
 
+// RetryPolicy builds the retry policy shared by the repository and the processor.
+func (c *Settings) RetryPolicy() *RetryPolicy {
+	maxRetries := DefaultMaxRetries
+	if c.MaxRetries != nil {
+		maxRetries = *c.MaxRetries
+	}
+	return NewRetryPolicy(maxRetries, c.RetryOverrides)
+}
+
 func LoadFromFile(filePath string) (*Settings, error) {
 
 	env := getEnvWithDefaultLookup("ENVIRONMENT", "development")
@@ -73,14 +88,52 @@ func (c *Settings) LoadFromEnv() error {
 	viper.BindEnv("database.type")
 	viper.BindEnv("database.dsn")
 	viper.BindEnv("database.uri")
+	viper.BindEnv("database.dbname")
+	viper.BindEnv("database.collection")
+	viper.BindEnv("database.notify_channel")
+	viper.BindEnv("database.instance_id")
+	viper.BindEnv("database.lease_duration")
+	viper.BindEnv("database.record_attempts")
+	viper.BindEnv("database.busy_timeout")
 	viper.BindEnv("broker.type")
 	viper.BindEnv("broker.url")
 	viper.BindEnv("broker.projectID")
+	viper.BindEnv("broker.tls.enabled")
+	viper.BindEnv("broker.tls.ca_file")
+	viper.BindEnv("broker.tls.cert_file")
+	viper.BindEnv("broker.tls.key_file")
+	viper.BindEnv("broker.tls.server_name")
+	viper.BindEnv("broker.tls.insecure_skip_verify")
+	viper.BindEnv("broker.sasl.mechanism")
+	viper.BindEnv("broker.sasl.username")
+	viper.BindEnv("broker.sasl.password")
+	viper.BindEnv("broker.kafka.client_id")
+	viper.BindEnv("broker.kafka.acks")
+	viper.BindEnv("broker.kafka.disable_idempotence")
+	viper.BindEnv("broker.kafka.auto_create_topics")
+	viper.BindEnv("broker.nats.credentials_file")
+	viper.BindEnv("broker.redis.cluster")
+	viper.BindEnv("broker.redis.hash_tag_routing_key")
+	viper.BindEnv("broker.redis.max_len")
+	viper.BindEnv("broker.redis.exact_trimming")
+	viper.BindEnv("broker.aws.region")
+	viper.BindEnv("broker.aws.endpoint")
+	viper.BindEnv("broker.webhook.secret")
+	viper.BindEnv("broker.webhook.signature_header")
+	viper.BindEnv("broker.webhook.content_type")
+	viper.BindEnv("broker.webhook.timeout")
 	viper.BindEnv("poll_interval")
 	viper.BindEnv("batch_size")
+	viper.BindEnv("workers")
 	viper.BindEnv("max_retries")
 	viper.BindEnv("retry_backoff")
+	viper.BindEnv("max_retry_backoff")
 	viper.BindEnv("dead_letter_topic")
+	viper.BindEnv("dead_letter_entity_type")
+	viper.BindEnv("shutdown_timeout")
+	viper.BindEnv("retention.interval")
+	viper.BindEnv("retention.batch_size")
+	viper.BindEnv("retention.archive")
 	viper.BindEnv("observability.service_name")
 	viper.BindEnv("observability.tracing_url")
 	viper.BindEnv("observability.metrics_url")
@@ -2,12 +2,16 @@ package processor
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 
@@ -17,80 +21,358 @@ import (
 	"github.com/zoff-tech/go-outbox/store"
 )
 
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	defaultRetryBackoff    = time.Second
+	defaultMaxRetryBackoff = 5 * time.Minute
+)
+
 // OutboxProcessor processes outbox events.
 type OutboxProcessor struct {
-	repo         store.OutBoxRepository
-	broker       broker.MessageBroker
-	tracer       trace.Tracer
-	maxRetries   int
-	retryBackoff time.Duration
+	repo            store.OutBoxRepository
+	broker          broker.MessageBroker
+	brokerType      string
+	tracer          trace.Tracer
+	deliveryLatency metric.Float64Histogram
+	retryPolicy     *config.RetryPolicy
+	retryBackoff    time.Duration
+	maxBackoff      time.Duration
+	deadLetterTopic string
+	// deadLetterEntityType is the entity type of the events republished to deadLetterTopic.
+	deadLetterEntityType string
+	workers              int
+	batchSize            int
+	scheduler            *pollScheduler
+	statuses             *statusBatcher
+	// notifications wakes the processor before the poll interval elapses. It is nil
+	// when the repository does not push notifications.
+	notifications <-chan struct{}
+	// shutdownTimeout bounds how long in-flight publishes may run once shutdown starts.
+	shutdownTimeout time.Duration
+	// leaseDuration is how long the repository leases claimed events; leases are renewed
+	// right before an event is published and every third of it while it is.
+	leaseDuration time.Duration
+
+	// heldKeys maps the routing keys of events awaiting a retry to the time of the retry.
+	// Later events of these keys are deferred until then, so they stay behind the retried
+	// event. The hold is local to this process: other replicas may still publish later
+	// events of a key ahead of its retried event. Expired entries are pruned before every
+	// fetch.
+	heldMu   sync.Mutex
+	heldKeys map[string]time.Time
 }
 
 // NewOutboxProcessor creates a new instance of OutboxProcessor.
 func NewOutboxProcessor(repo store.OutBoxRepository, broker broker.MessageBroker, cfg *config.Settings) *OutboxProcessor {
-	return &OutboxProcessor{
-		repo:         repo,
-		broker:       broker,
-		tracer:       otel.Tracer("go-outbox"),
-		maxRetries:   cfg.MaxRetries,
-		retryBackoff: cfg.RetryBackoff,
+	scheduler := newPollScheduler(cfg.PollInterval, cfg.BatchSize)
+	retryBackoff := cfg.RetryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultRetryBackoff
+	}
+	maxBackoff := cfg.MaxRetryBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxRetryBackoff
+	}
+	leaseDuration := cfg.Database.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = store.DefaultLeaseDuration
+	}
+	deadLetterEntityType := cfg.DeadLetterEntityType
+	if deadLetterEntityType == "" {
+		deadLetterEntityType = defaultDeadLetterEntityType
+	}
+	deliveryLatency, err := otel.Meter("go-outbox").Float64Histogram("outbox.event.delivery_latency",
+		metric.WithDescription("Time from the creation of an outbox event until the broker accepted it"),
+		metric.WithUnit("s"))
+	if err != nil {
+		log.Printf("Failed to create the delivery latency histogram: %v", err)
+		deliveryLatency = noop.Float64Histogram{}
+	}
+	processor := &OutboxProcessor{
+		repo:                 repo,
+		broker:               broker,
+		brokerType:           cfg.Broker.Type,
+		tracer:               otel.Tracer("go-outbox"),
+		deliveryLatency:      deliveryLatency,
+		retryPolicy:          cfg.RetryPolicy(),
+		retryBackoff:         retryBackoff,
+		maxBackoff:           maxBackoff,
+		deadLetterTopic:      cfg.DeadLetterTopic,
+		deadLetterEntityType: deadLetterEntityType,
+		workers:              cfg.Workers,
+		batchSize:            scheduler.batchSize,
+		scheduler:            scheduler,
+		statuses:             newStatusBatcher(repo, scheduler.batchSize),
+		shutdownTimeout:      cfg.ShutdownTimeout,
+		leaseDuration:        leaseDuration,
+		heldKeys:             make(map[string]time.Time),
+	}
+	if notifier, ok := repo.(store.Notifier); ok {
+		processor.notifications = notifier.Notifications()
 	}
+	return processor
 }
 
+// ProcessEvents fetches pending events and publishes them through a pool of workers.
+// Events sharing a routing key are published in the order they were fetched; while one of
+// them awaits a retry, the later ones are deferred until the retry.
+//
+// ProcessEvents returns once ctx is canceled and the processor has shut down: fetching
+// stops, publishes already in flight get up to the shutdown timeout to finish, and
+// claimed events that were not published are released back to pending.
 func (p *OutboxProcessor) ProcessEvents(ctx context.Context) {
-	for {
-		events, err := p.repo.FetchPending(ctx, 10)
-		if err != nil {
+	// Publishing must outlive ctx so that in-flight events can be drained on shutdown.
+	publishCtx, abortPublishing := context.WithCancel(context.WithoutCancel(ctx))
+	defer abortPublishing()
+
+	flushCtx, stopFlushing := context.WithCancel(publishCtx)
+	go p.statuses.Run(flushCtx)
+
+	pool := newWorkerPool(p.workers, p.batchSize, func(event schema.OutboxEvent) {
+		if ctx.Err() != nil {
+			p.release(publishCtx, event)
+			return
+		}
+		p.processEvent(publishCtx, event)
+	})
+
+	for ctx.Err() == nil {
+		p.pruneHeldKeys()
+		events, err := p.repo.FetchPending(ctx, p.batchSize)
+		if err != nil && ctx.Err() == nil {
 			log.Printf("Failed to fetch events: %v", err)
-			continue
 		}
 
-		for _, event := range events {
-			ctx, span := p.tracer.Start(ctx, "ProcessOutboxEvent", trace.WithAttributes(
-				attribute.String("event.id", event.ID),
-				attribute.String("event.destination", event.Entity),
-				attribute.String("event.type", event.EntityType),
-				attribute.String("event.status", string(event.Status)),
-				attribute.Int("event.retry_count", event.RetryCount),
-				attribute.String("event.created_at", event.CreatedAt.String()),
-				attribute.String("event.updated_at", event.UpdatedAt.String()),
-			))
-
-			headers := event.Headers
-
-			// Inject the trace context into the message headers
-			propagator := otel.GetTextMapPropagator()
-			propagator.Inject(ctx, propagation.MapCarrier(headers))
-
-			if err := p.broker.Publish(ctx, &event); err != nil {
-				log.Printf("Failed to publish event %s: %v", event.ID, err)
-				span.RecordError(err)
-				span.SetStatus(codes.Error, err.Error())
-
-				// Increment retry count and update status
-				if event.RetryCount < p.maxRetries {
-					if err := p.repo.SetStatusAndIncrementRetry(ctx, event.ID, schema.StatusPending); err != nil {
-						log.Printf("Failed to update retry count for event %s: %v", event.ID, err)
-					}
-				} else {
-					if err := p.repo.SetStatus(ctx, event.ID, schema.StatusFailed); err != nil {
-						log.Printf("Failed to mark event %s as failed: %v", event.ID, err)
-					}
+		for i, event := range events {
+			if !pool.Submit(ctx, event) {
+				for _, unsubmitted := range events[i:] {
+					p.release(publishCtx, unsubmitted)
 				}
-
-				span.End()
-				continue
+				break
 			}
+		}
+
+		p.wait(ctx, p.scheduler.Next(len(events), err))
+	}
+
+	p.drain(pool, abortPublishing)
+	stopFlushing()
+	p.statuses.Flush(publishCtx)
+}
+
+// wait blocks for the given delay, until the repository announces new events or until ctx is done.
+func (p *OutboxProcessor) wait(ctx context.Context, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-p.notifications:
+	}
+}
+
+// drain waits for the workers to finish. Once the shutdown timeout expires, in-flight
+// publishes are aborted and their events released.
+func (p *OutboxProcessor) drain(pool *workerPool, abortPublishing context.CancelFunc) {
+	timeout := p.shutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	log.Printf("Shutting down outbox processor, draining in-flight events (timeout %s)", timeout)
+
+	done := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Shutdown timeout exceeded, aborting in-flight publishes")
+		abortPublishing()
+		<-done
+	}
+}
+
+// release hands a claimed event back to pending so another instance can pick it up.
+func (p *OutboxProcessor) release(ctx context.Context, event schema.OutboxEvent) {
+	if err := p.repo.SetStatus(context.WithoutCancel(ctx), event.ID, schema.StatusPending); err != nil {
+		log.Printf("Failed to release event %s: %v", event.ID, err)
+	}
+}
+
+func (p *OutboxProcessor) processEvent(ctx context.Context, event schema.OutboxEvent) {
+	if nextAttemptAt, held := p.heldUntil(event.RoutingKey); held {
+		// An earlier event of the routing key failed; publishing this one first would break
+		// their order.
+		p.statuses.Defer(ctx, event.ID, nextAttemptAt)
+		return
+	}
 
-			if err := p.repo.MarkProcessed(ctx, event.ID); err != nil {
-				log.Printf("Failed to mark event %s as processed: %v", event.ID, err)
-				span.RecordError(err)
-				span.SetStatus(codes.Error, err.Error())
+	// The event may have waited in its worker's queue for longer than its lease. Renewing
+	// the lease before publishing makes sure no other instance claimed it in the meantime.
+	if err := p.repo.RenewLease(ctx, event.ID); errors.Is(err, store.ErrLeaseLost) {
+		log.Printf("Skipping event %s, its lease was lost to another instance", event.ID)
+		return
+	} else if err != nil {
+		log.Printf("Failed to renew the lease of event %s: %v", event.ID, err)
+	}
+
+	ctx, span := p.tracer.Start(ctx, "ProcessOutboxEvent", trace.WithAttributes(
+		attribute.String("event.id", event.ID),
+		attribute.String("event.destination", event.Entity),
+		attribute.String("event.type", event.EntityType),
+		attribute.String("event.status", string(event.Status)),
+		attribute.Int("event.retry_count", event.RetryCount),
+		attribute.String("event.created_at", event.CreatedAt.String()),
+		attribute.String("event.updated_at", event.UpdatedAt.String()),
+	))
+	defer span.End()
+
+	if event.Headers == nil {
+		event.Headers = make(map[string]string)
+	}
+
+	// Inject the trace context into the message headers
+	propagator := otel.GetTextMapPropagator()
+	propagator.Inject(ctx, propagation.MapCarrier(event.Headers))
+
+	publishCtx, stopRenewing := p.renewLease(ctx, event.ID)
+	attempt := schema.EventAttempt{EventID: event.ID, AttemptedAt: time.Now(), Broker: p.brokerType}
+	err := p.broker.Publish(publishCtx, &event)
+	stopRenewing()
+	if err != nil {
+		if errors.Is(context.Cause(publishCtx), store.ErrLeaseLost) {
+			// Another instance owns the event now and will publish it.
+			log.Printf("Lost the lease of event %s while publishing it", event.ID)
+			span.RecordError(store.ErrLeaseLost)
+			return
+		}
+		if ctx.Err() != nil {
+			// Publishing was aborted by shutdown, so this attempt does not count as a failure.
+			p.release(ctx, event)
+			return
+		}
+
+		log.Printf("Failed to publish event %s: %v", event.ID, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		attempt.Error = err.Error()
+		p.statuses.RecordAttempt(attempt)
+
+		// Increment retry count and schedule the next attempt with exponential backoff, unless
+		// retrying cannot help.
+		if !broker.IsPermanent(err) && !p.retryPolicy.Exhausted(event.Entity, event.RetryCount) {
+			nextAttemptAt := time.Now().Add(exponentialBackoff(p.retryBackoff, p.maxBackoff, event.RetryCount))
+			p.hold(event.RoutingKey, nextAttemptAt)
+			p.statuses.ScheduleRetry(ctx, event.ID, nextAttemptAt)
+		} else {
+			p.giveUp(ctx, event, err)
+		}
+		return
+	}
+
+	sentAt := time.Now()
+	p.statuses.RecordAttempt(attempt)
+	p.statuses.MarkSent(ctx, store.SentEvent{EventID: event.ID, MessageID: event.MessageID, SentAt: sentAt})
+	if !event.CreatedAt.IsZero() {
+		p.deliveryLatency.Record(ctx, sentAt.Sub(event.CreatedAt).Seconds(),
+			metric.WithAttributes(attribute.String("event.destination", event.Entity)))
+	}
+}
+
+// hold defers the events of routingKey processed before nextAttemptAt until then.
+func (p *OutboxProcessor) hold(routingKey string, nextAttemptAt time.Time) {
+	if routingKey == "" {
+		return
+	}
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+	p.heldKeys[routingKey] = nextAttemptAt
+}
+
+// heldUntil reports whether the events of routingKey are held back, and until when.
+func (p *OutboxProcessor) heldUntil(routingKey string) (time.Time, bool) {
+	if routingKey == "" {
+		return time.Time{}, false
+	}
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+	nextAttemptAt, held := p.heldKeys[routingKey]
+	if held && !time.Now().Before(nextAttemptAt) {
+		delete(p.heldKeys, routingKey)
+		return time.Time{}, false
+	}
+	return nextAttemptAt, held
+}
+
+// pruneHeldKeys forgets the routing keys whose hold has expired, including those of keys
+// that are not seen again.
+func (p *OutboxProcessor) pruneHeldKeys() {
+	now := time.Now()
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+	for routingKey, nextAttemptAt := range p.heldKeys {
+		if !now.Before(nextAttemptAt) {
+			delete(p.heldKeys, routingKey)
+		}
+	}
+}
+
+// renewLease renews the lease of the event every third of the lease duration until the
+// returned stop function is called. The returned context is canceled with ErrLeaseLost
+// once the lease is lost to another instance, which aborts the publish.
+func (p *OutboxProcessor) renewLease(ctx context.Context, eventID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(p.leaseDuration / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := p.repo.RenewLease(ctx, eventID)
+				if errors.Is(err, store.ErrLeaseLost) {
+					cancel(err)
+					return
+				}
+				if err != nil && ctx.Err() == nil {
+					log.Printf("Failed to renew the lease of event %s: %v", eventID, err)
+				}
 			}
+		}
+	}()
 
-			span.End()
+	return ctx, func() {
+		cancel(nil)
+		<-done
+	}
+}
+
+// giveUp handles an event that exhausted its retries. It is republished to the dead-letter
+// topic when one is configured and recorded as dead-lettered, otherwise it is marked as failed.
+func (p *OutboxProcessor) giveUp(ctx context.Context, event schema.OutboxEvent, lastErr error) {
+	status := schema.StatusFailed
+	if p.deadLetterTopic != "" {
+		if err := p.broker.Publish(ctx, newDeadLetterEvent(event, p.deadLetterTopic, p.deadLetterEntityType, lastErr)); err != nil {
+			log.Printf("Failed to publish event %s to dead-letter topic %s: %v", event.ID, p.deadLetterTopic, err)
+		} else {
+			status = schema.StatusDeadLettered
 		}
+	}
 
-		time.Sleep(5 * time.Second)
+	if err := p.repo.SetStatus(ctx, event.ID, status); err != nil {
+		log.Printf("Failed to mark event %s as %s: %v", event.ID, status, err)
 	}
 }
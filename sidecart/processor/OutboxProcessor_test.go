@@ -0,0 +1,762 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/broker"
+	"github.com/zoff-tech/go-outbox/broker/brokertest"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"github.com/zoff-tech/go-outbox/store"
+	"github.com/zoff-tech/go-outbox/store/storetest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// --- Fakes ---
+
+type fakeRepository struct {
+	mu           sync.Mutex
+	batches      [][]schema.OutboxEvent
+	statuses     map[string]schema.Status
+	nextAttempts map[string]time.Time
+	sent         map[string]store.SentEvent
+	renewals     int
+	renewErr     error
+	batchWrites  int
+	deferred     []string
+	attempts     []schema.EventAttempt
+	purgeable    map[schema.Status]int
+	purges       []purgeCall
+	closed       bool
+
+	// renewErrAfter, if set, lets this many renewals succeed before they fail with renewErr.
+	renewErrAfter int
+}
+
+func newFakeRepository(batches ...[]schema.OutboxEvent) *fakeRepository {
+	return &fakeRepository{
+		batches:      batches,
+		statuses:     make(map[string]schema.Status),
+		nextAttempts: make(map[string]time.Time),
+		sent:         make(map[string]store.SentEvent),
+		purgeable:    make(map[schema.Status]int),
+	}
+}
+
+func (f *fakeRepository) FetchPending(ctx context.Context, batchSize int) ([]schema.OutboxEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.batches) == 0 {
+		return nil, nil
+	}
+	batch := f.batches[0]
+	f.batches = f.batches[1:]
+	for _, event := range batch {
+		f.statuses[event.ID] = schema.StatusProcessing
+	}
+	return batch, nil
+}
+
+func (f *fakeRepository) MarkProcessed(ctx context.Context, eventID, messageID string) error {
+	return f.MarkProcessedBatch(ctx, []store.SentEvent{{EventID: eventID, MessageID: messageID, SentAt: time.Now()}})
+}
+
+func (f *fakeRepository) MarkProcessedBatch(ctx context.Context, sent []store.SentEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batchWrites++
+	for _, event := range sent {
+		f.statuses[event.EventID] = schema.StatusSent
+		f.sent[event.EventID] = event
+	}
+	return nil
+}
+
+func (f *fakeRepository) SetStatus(ctx context.Context, eventID string, status schema.Status) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[eventID] = status
+	return nil
+}
+
+func (f *fakeRepository) SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error {
+	return f.SetStatus(ctx, eventID, status)
+}
+
+func (f *fakeRepository) ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[eventID] = schema.StatusPending
+	f.nextAttempts[eventID] = nextAttemptAt
+	return nil
+}
+
+func (f *fakeRepository) ScheduleRetryBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batchWrites++
+	for id, nextAttemptAt := range nextAttempts {
+		f.statuses[id] = schema.StatusPending
+		f.nextAttempts[id] = nextAttemptAt
+	}
+	return nil
+}
+
+func (f *fakeRepository) DeferBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batchWrites++
+	for id, nextAttemptAt := range nextAttempts {
+		f.statuses[id] = schema.StatusPending
+		f.nextAttempts[id] = nextAttemptAt
+		f.deferred = append(f.deferred, id)
+	}
+	return nil
+}
+
+func (f *fakeRepository) IncrementRetryCount(ctx context.Context, eventID string) error {
+	return nil
+}
+
+func (f *fakeRepository) RenewLease(ctx context.Context, eventID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renewals++
+	if f.renewals <= f.renewErrAfter {
+		return nil
+	}
+	return f.renewErr
+}
+
+func (f *fakeRepository) RecordAttempts(ctx context.Context, attempts []schema.EventAttempt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts = append(f.attempts, attempts...)
+	return nil
+}
+
+// purgeCall records the arguments of a Purge call.
+type purgeCall struct {
+	status  schema.Status
+	before  time.Time
+	limit   int
+	archive bool
+}
+
+// Purge purges up to limit of the purgeable events in status.
+func (f *fakeRepository) Purge(ctx context.Context, status schema.Status, before time.Time, limit int, archive bool) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.purges = append(f.purges, purgeCall{status: status, before: before, limit: limit, archive: archive})
+	purged := min(limit, f.purgeable[status])
+	f.purgeable[status] -= purged
+	return purged, nil
+}
+
+func (f *fakeRepository) recordedAttempts() []schema.EventAttempt {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]schema.EventAttempt(nil), f.attempts...)
+}
+
+func (f *fakeRepository) renewalCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.renewals
+}
+
+func (f *fakeRepository) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeRepository) status(eventID string) schema.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.statuses[eventID]
+}
+
+func (f *fakeRepository) sentEvent(eventID string) store.SentEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sent[eventID]
+}
+
+func (f *fakeRepository) deferredEvents() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.deferred...)
+}
+
+func (f *fakeRepository) nextAttempt(eventID string) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nextAttempts[eventID]
+}
+
+// notifyingRepository is a fakeRepository that pushes new-event notifications.
+type notifyingRepository struct {
+	*fakeRepository
+	notifications chan struct{}
+}
+
+func (n *notifyingRepository) Notifications() <-chan struct{} {
+	return n.notifications
+}
+
+// fakeBroker blocks every publish until release is closed or the context is done.
+type fakeBroker struct {
+	started chan string
+	release chan struct{}
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{started: make(chan string, 10), release: make(chan struct{})}
+}
+
+func (f *fakeBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	f.started <- event.ID
+	select {
+	case <-f.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeBroker) Close() error {
+	return nil
+}
+
+// failingBroker rejects publishes to the entities in failFor (all entities when empty)
+// and records the events it accepts, which it assigns the message ID "msg-<event ID>".
+type failingBroker struct {
+	err       error
+	failFor   map[string]bool
+	published []schema.OutboxEvent
+}
+
+func (f *failingBroker) Publish(ctx context.Context, event *schema.OutboxEvent) error {
+	if len(f.failFor) == 0 || f.failFor[event.Entity] {
+		return f.err
+	}
+	event.MessageID = "msg-" + event.ID
+	f.published = append(f.published, *event)
+	return nil
+}
+
+func (f *failingBroker) Close() error {
+	return nil
+}
+
+// maxRetries returns a pointer to n for config.Settings.MaxRetries.
+func maxRetries(n int) *int {
+	return &n
+}
+
+// failingMeterProvider provides meters that fail to create histograms.
+type failingMeterProvider struct {
+	noop.MeterProvider
+}
+
+func (failingMeterProvider) Meter(name string, opts ...metric.MeterOption) metric.Meter {
+	return failingMeter{}
+}
+
+type failingMeter struct {
+	noop.Meter
+}
+
+func (failingMeter) Float64Histogram(name string, opts ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	return nil, errors.New("instrument rejected")
+}
+
+// --- Tests ---
+
+func TestProcessEvents_DrainsInFlightAndReleasesQueuedOnShutdown(t *testing.T) {
+	repo := newFakeRepository([]schema.OutboxEvent{
+		{ID: "1", RoutingKey: "k"},
+		{ID: "2", RoutingKey: "k"},
+		{ID: "3", RoutingKey: "k"},
+	})
+	broker := newFakeBroker()
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{Workers: 1, ShutdownTimeout: time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processor.ProcessEvents(ctx)
+		close(done)
+	}()
+
+	assert.Equal(t, "1", <-broker.started)
+	cancel()
+	close(broker.release)
+	<-done
+
+	assert.Equal(t, schema.StatusSent, repo.status("1"))
+	assert.Equal(t, schema.StatusPending, repo.status("2"))
+	assert.Equal(t, schema.StatusPending, repo.status("3"))
+}
+
+func TestProcessEvents_ReleasesInFlightAfterShutdownTimeout(t *testing.T) {
+	repo := newFakeRepository([]schema.OutboxEvent{{ID: "1", RoutingKey: "k"}})
+	broker := newFakeBroker()
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{Workers: 1, ShutdownTimeout: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processor.ProcessEvents(ctx)
+		close(done)
+	}()
+
+	<-broker.started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("processor did not stop after the shutdown timeout")
+	}
+	assert.Equal(t, schema.StatusPending, repo.status("1"))
+}
+
+func TestProcessEvent_FailureSchedulesRetryWithBackoff(t *testing.T) {
+	repo := newFakeRepository()
+	processor := NewOutboxProcessor(repo, &failingBroker{err: errors.New("nack")}, &config.Settings{
+		MaxRetries:      maxRetries(5),
+		RetryBackoff:    time.Second,
+		MaxRetryBackoff: time.Minute,
+	})
+
+	before := time.Now()
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", RetryCount: 2})
+	processor.statuses.Flush(context.Background())
+
+	assert.Equal(t, schema.StatusPending, repo.status("1"))
+	delay := repo.nextAttempt("1").Sub(before)
+	assert.GreaterOrEqual(t, delay, 2*time.Second)
+	assert.LessOrEqual(t, delay, 4*time.Second+time.Since(before))
+}
+
+func TestProcessEvent_FailureDefersLaterEventsOfTheRoutingKey(t *testing.T) {
+	repo := newFakeRepository()
+	broker := &failingBroker{err: errors.New("nack"), failFor: map[string]bool{"orders": true}}
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{MaxRetries: maxRetries(5), RetryBackoff: time.Second})
+
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", Entity: "orders", RoutingKey: "order-1"})
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "2", Entity: "payments", RoutingKey: "order-1"})
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "3", Entity: "payments", RoutingKey: "order-2"})
+	processor.statuses.Flush(context.Background())
+
+	// Event 2 waits for the retry of event 1 without being attempted itself.
+	assert.Equal(t, []string{"2"}, repo.deferredEvents())
+	assert.Equal(t, schema.StatusPending, repo.status("2"))
+	assert.Equal(t, repo.nextAttempt("1"), repo.nextAttempt("2"))
+	if assert.Len(t, broker.published, 1) {
+		assert.Equal(t, "3", broker.published[0].ID)
+	}
+}
+
+func TestProcessEvents_PrunesExpiredRoutingKeyHolds(t *testing.T) {
+	processor := NewOutboxProcessor(newFakeRepository(), &failingBroker{}, &config.Settings{PollInterval: time.Millisecond})
+	processor.hold("order-1", time.Now().Add(-time.Second))
+	processor.hold("order-2", time.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	processor.ProcessEvents(ctx)
+
+	processor.heldMu.Lock()
+	defer processor.heldMu.Unlock()
+	assert.NotContains(t, processor.heldKeys, "order-1")
+	assert.Contains(t, processor.heldKeys, "order-2")
+}
+
+func TestProcessEvent_FailureAfterMaxRetriesMarksFailed(t *testing.T) {
+	repo := newFakeRepository()
+	processor := NewOutboxProcessor(repo, &failingBroker{err: errors.New("nack")}, &config.Settings{MaxRetries: maxRetries(3)})
+
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", RetryCount: 3})
+
+	assert.Equal(t, schema.StatusFailed, repo.status("1"))
+}
+
+func TestProcessEvent_ExhaustedEventIsDeadLettered(t *testing.T) {
+	repo := newFakeRepository()
+	broker := &failingBroker{err: errors.New("nack"), failFor: map[string]bool{"orders": true}}
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{MaxRetries: maxRetries(3), DeadLetterTopic: "dead-letter-topic"})
+
+	processor.processEvent(context.Background(), schema.OutboxEvent{
+		ID:         "1",
+		Entity:     "orders",
+		EntityType: "direct",
+		RoutingKey: "order.created",
+		RetryCount: 3,
+		Headers:    map[string]string{"tenant": "acme"},
+	})
+
+	assert.Equal(t, schema.StatusDeadLettered, repo.status("1"))
+	assert.Len(t, broker.published, 1)
+
+	deadLetter := broker.published[0]
+	assert.Equal(t, "1:dlq", deadLetter.ID)
+	assert.Equal(t, "dead-letter-topic", deadLetter.Entity)
+	assert.Equal(t, "topic", deadLetter.EntityType)
+	assert.Equal(t, "order.created", deadLetter.RoutingKey)
+	assert.Equal(t, "acme", deadLetter.Headers["tenant"])
+	assert.Equal(t, "1", deadLetter.Headers[schema.HeaderOriginalID])
+	assert.Equal(t, "orders", deadLetter.Headers[schema.HeaderOriginalEntity])
+	assert.Equal(t, "direct", deadLetter.Headers[schema.HeaderOriginalEntityType])
+	assert.Equal(t, "order.created", deadLetter.Headers[schema.HeaderOriginalRoutingKey])
+	assert.Equal(t, "3", deadLetter.Headers[schema.HeaderRetryCount])
+	assert.Equal(t, "nack", deadLetter.Headers[schema.HeaderLastError])
+}
+
+func TestProcessEvent_DeadLettersWithTheConfiguredEntityType(t *testing.T) {
+	repo := newFakeRepository()
+	broker := &failingBroker{err: errors.New("nack"), failFor: map[string]bool{"orders": true}}
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{
+		MaxRetries:           maxRetries(3),
+		DeadLetterTopic:      "dead-letter-exchange",
+		DeadLetterEntityType: "fanout",
+	})
+
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", Entity: "orders", EntityType: "direct", RetryCount: 3})
+
+	if assert.Len(t, broker.published, 1) {
+		assert.Equal(t, "fanout", broker.published[0].EntityType)
+		assert.Equal(t, "direct", broker.published[0].Headers[schema.HeaderOriginalEntityType])
+	}
+}
+
+func TestProcessEvent_DeadLetterPublishFailureMarksFailed(t *testing.T) {
+	repo := newFakeRepository()
+	processor := NewOutboxProcessor(repo, &failingBroker{err: errors.New("nack")}, &config.Settings{MaxRetries: maxRetries(3), DeadLetterTopic: "dead-letter-topic"})
+
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", Entity: "orders", RetryCount: 3})
+
+	assert.Equal(t, schema.StatusFailed, repo.status("1"))
+}
+
+func TestProcessEvent_UsesPerEntityRetryLimit(t *testing.T) {
+	repo := newFakeRepository()
+	processor := NewOutboxProcessor(repo, &failingBroker{err: errors.New("nack")}, &config.Settings{
+		MaxRetries:     maxRetries(3),
+		RetryOverrides: map[string]int{"payments": 20, "analytics": 2},
+	})
+
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", Entity: "payments", RetryCount: 10})
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "2", Entity: "analytics", RetryCount: 2})
+	processor.statuses.Flush(context.Background())
+
+	assert.Equal(t, schema.StatusPending, repo.status("1"))
+	assert.Equal(t, schema.StatusFailed, repo.status("2"))
+}
+
+func TestProcessEvent_PermanentFailureIsDeadLetteredWithoutRetrying(t *testing.T) {
+	repo := newFakeRepository()
+	b := &failingBroker{err: broker.Permanent(errors.New("message too large")), failFor: map[string]bool{"orders": true}}
+	processor := NewOutboxProcessor(repo, b, &config.Settings{MaxRetries: maxRetries(3), DeadLetterTopic: "dead-letter-topic"})
+
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", Entity: "orders"})
+
+	assert.Equal(t, schema.StatusDeadLettered, repo.status("1"))
+	if assert.Len(t, b.published, 1) {
+		assert.Equal(t, "message too large", b.published[0].Headers[schema.HeaderLastError])
+	}
+}
+
+func TestProcessEvents_NotificationTriggersFetchBeforePollInterval(t *testing.T) {
+	repo := &notifyingRepository{
+		fakeRepository: newFakeRepository(nil, []schema.OutboxEvent{{ID: "1"}}),
+		notifications:  make(chan struct{}, 1),
+	}
+	broker := newFakeBroker()
+	close(broker.release)
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{PollInterval: time.Hour})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go processor.ProcessEvents(ctx)
+
+	repo.notifications <- struct{}{}
+
+	select {
+	case id := <-broker.started:
+		assert.Equal(t, "1", id)
+	case <-time.After(time.Second):
+		t.Fatal("notification did not wake the processor")
+	}
+}
+
+func TestProcessEvent_RenewsLeaseWhilePublishing(t *testing.T) {
+	repo := newFakeRepository()
+	broker := newFakeBroker()
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{
+		Database: config.DbSettings{LeaseDuration: 30 * time.Millisecond},
+	})
+
+	done := make(chan struct{})
+	go func() {
+		processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1"})
+		close(done)
+	}()
+
+	<-broker.started
+	assert.Eventually(t, func() bool { return repo.renewalCount() >= 2 }, time.Second, 5*time.Millisecond)
+	close(broker.release)
+	<-done
+	processor.statuses.Flush(context.Background())
+
+	assert.Equal(t, schema.StatusSent, repo.status("1"))
+}
+
+func TestProcessEvent_LostLeaseAbortsPublishAndLeavesEventToNewOwner(t *testing.T) {
+	repo := newFakeRepository()
+	repo.renewErr = store.ErrLeaseLost
+	repo.renewErrAfter = 1 // the renewal before publishing
+	repo.statuses["1"] = schema.StatusProcessing
+	processor := NewOutboxProcessor(repo, newFakeBroker(), &config.Settings{
+		Database: config.DbSettings{LeaseDuration: 30 * time.Millisecond},
+	})
+
+	done := make(chan struct{})
+	go func() {
+		processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish was not aborted after the lease was lost")
+	}
+	assert.Equal(t, schema.StatusProcessing, repo.status("1"))
+	assert.Zero(t, repo.nextAttempt("1"))
+}
+
+func TestProcessEvent_SkipsEventWhoseLeaseExpiredWhileQueued(t *testing.T) {
+	cfg := &config.Settings{Database: config.DbSettings{LeaseDuration: time.Minute}}
+	now := time.Now()
+	repo := storetest.NewRepository("instance-a", cfg.RetryPolicy())
+	repo.LeaseDuration = time.Minute
+	repo.Clock = func() time.Time { return now }
+	repo.Insert(schema.OutboxEvent{ID: "1", Entity: "orders"})
+	events, err := repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// While the event waits in its worker's queue, its lease expires and another instance
+	// claims it.
+	now = now.Add(2 * time.Minute)
+	claimed, err := repo.ForInstance("instance-b").FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+
+	broker := brokertest.NewBroker()
+	processor := NewOutboxProcessor(repo, broker, cfg)
+	processor.processEvent(context.Background(), events[0])
+	processor.statuses.Flush(context.Background())
+
+	assert.Empty(t, broker.Published(), "the event belongs to instance-b")
+	assert.Zero(t, broker.Attempts())
+}
+
+func TestProcessEvents_WritesOutcomesInBatches(t *testing.T) {
+	var batch []schema.OutboxEvent
+	for i := 0; i < 10; i++ {
+		batch = append(batch, schema.OutboxEvent{ID: fmt.Sprint(i)})
+	}
+	repo := newFakeRepository(batch)
+	broker := newFakeBroker()
+	close(broker.release)
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{BatchSize: 10, Workers: 4})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processor.ProcessEvents(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return repo.status("9") == schema.StatusSent }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	for _, event := range batch {
+		assert.Equal(t, schema.StatusSent, repo.status(event.ID))
+	}
+	// A full batch is written at once; the periodic flush may split it at most once.
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.LessOrEqual(t, repo.batchWrites, 2)
+}
+
+func TestProcessEvent_RecordsPublishAttempts(t *testing.T) {
+	repo := newFakeRepository()
+	broker := &failingBroker{err: errors.New("nack"), failFor: map[string]bool{"orders": true}}
+	processor := NewOutboxProcessor(repo, broker, &config.Settings{
+		Broker:     config.BrokerSettings{Type: "rabbitmq"},
+		MaxRetries: maxRetries(5),
+	})
+
+	before := time.Now()
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", Entity: "orders"})
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "2", Entity: "payments"})
+	processor.statuses.Flush(context.Background())
+
+	attempts := repo.recordedAttempts()
+	if assert.Len(t, attempts, 2) {
+		assert.Equal(t, "1", attempts[0].EventID)
+		assert.Equal(t, "rabbitmq", attempts[0].Broker)
+		assert.Equal(t, "nack", attempts[0].Error)
+		assert.False(t, attempts[0].AttemptedAt.Before(before))
+		assert.Equal(t, "2", attempts[1].EventID)
+		assert.False(t, attempts[1].Failed())
+	}
+}
+
+func TestProcessEvent_RecordsSentAtMessageIDAndDeliveryLatency(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	previous := otel.GetMeterProvider()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	defer otel.SetMeterProvider(previous)
+
+	repo := newFakeRepository()
+	processor := NewOutboxProcessor(repo, &failingBroker{failFor: map[string]bool{"other": true}}, &config.Settings{})
+
+	createdAt := time.Now().Add(-2 * time.Second)
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", Entity: "orders", CreatedAt: createdAt})
+	processor.statuses.Flush(context.Background())
+
+	sent := repo.sentEvent("1")
+	assert.Equal(t, "msg-1", sent.MessageID)
+	assert.WithinDuration(t, time.Now(), sent.SentAt, time.Second)
+
+	var metrics metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &metrics))
+	require.Len(t, metrics.ScopeMetrics, 1)
+	require.Len(t, metrics.ScopeMetrics[0].Metrics, 1)
+	latency := metrics.ScopeMetrics[0].Metrics[0]
+	assert.Equal(t, "outbox.event.delivery_latency", latency.Name)
+	histogram := latency.Data.(metricdata.Histogram[float64])
+	require.Len(t, histogram.DataPoints, 1)
+	assert.Equal(t, uint64(1), histogram.DataPoints[0].Count)
+	assert.InDelta(t, sent.SentAt.Sub(createdAt).Seconds(), histogram.DataPoints[0].Sum, 0.001)
+	destination, _ := histogram.DataPoints[0].Attributes.Value("event.destination")
+	assert.Equal(t, "orders", destination.AsString())
+}
+
+func TestProcessEvent_PublishesWhenTheDeliveryLatencyHistogramIsUnavailable(t *testing.T) {
+	previous := otel.GetMeterProvider()
+	otel.SetMeterProvider(failingMeterProvider{})
+	defer otel.SetMeterProvider(previous)
+
+	repo := newFakeRepository()
+	processor := NewOutboxProcessor(repo, &failingBroker{failFor: map[string]bool{"other": true}}, &config.Settings{})
+
+	processor.processEvent(context.Background(), schema.OutboxEvent{ID: "1", Entity: "orders", CreatedAt: time.Now()})
+	processor.statuses.Flush(context.Background())
+
+	assert.Equal(t, schema.StatusSent, repo.status("1"))
+}
+
+func TestProcessEvents_RetriesAndDeadLettersWithInMemoryRepositoryAndBroker(t *testing.T) {
+	cfg := &config.Settings{
+		PollInterval:    10 * time.Millisecond,
+		MaxRetries:      maxRetries(2),
+		RetryBackoff:    time.Millisecond,
+		DeadLetterTopic: "dead-letter",
+	}
+	repo := storetest.NewRepository("instance-a", cfg.RetryPolicy())
+	repo.AttemptHistory = true
+	broker := brokertest.NewBroker()
+	broker.FailEntity("payments", errors.New("nack"))
+	repo.Insert(
+		schema.OutboxEvent{ID: "1", Entity: "orders"},
+		schema.OutboxEvent{ID: "2", Entity: "payments"},
+	)
+	processor := NewOutboxProcessor(repo, broker, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processor.ProcessEvents(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		event, _ := repo.Event("2")
+		return event.Status == schema.StatusDeadLettered
+	}, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	sent, _ := repo.Event("1")
+	assert.Equal(t, schema.StatusSent, sent.Status)
+	assert.Equal(t, "msg-1", sent.MessageID)
+
+	deadLettered, _ := repo.Event("2")
+	assert.Equal(t, 2, deadLettered.RetryCount)
+	assert.Equal(t, "nack", deadLettered.LastError)
+	if published := broker.PublishedTo("dead-letter"); assert.Len(t, published, 1) {
+		assert.Equal(t, "2:dlq", published[0].ID)
+		assert.Equal(t, "payments", published[0].Headers[schema.HeaderOriginalEntity])
+	}
+	// One successful publish of event 1 and three failed ones of event 2.
+	assert.Len(t, repo.Attempts(), 4)
+}
+
+func TestProcessEvents_KeepsOrderPerRoutingKeyAcrossRetries(t *testing.T) {
+	cfg := &config.Settings{
+		PollInterval: 10 * time.Millisecond,
+		MaxRetries:   maxRetries(3),
+		RetryBackoff: 50 * time.Millisecond,
+	}
+	repo := storetest.NewRepository("instance-a", cfg.RetryPolicy())
+	broker := brokertest.NewBroker()
+	broker.FailNext(errors.New("nack"))
+	now := time.Now()
+	repo.Insert(
+		schema.OutboxEvent{ID: "1", Entity: "orders", RoutingKey: "order-1", CreatedAt: now},
+		schema.OutboxEvent{ID: "2", Entity: "orders", RoutingKey: "order-1", CreatedAt: now.Add(time.Millisecond)},
+	)
+	processor := NewOutboxProcessor(repo, broker, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processor.ProcessEvents(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		event, _ := repo.Event("2")
+		return event.Status == schema.StatusSent
+	}, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	var ids []string
+	for _, event := range broker.Published() {
+		ids = append(ids, event.ID)
+	}
+	assert.Equal(t, []string{"1", "2"}, ids)
+	retried, _ := repo.Event("1")
+	assert.Equal(t, 1, retried.RetryCount)
+	deferred, _ := repo.Event("2")
+	assert.Equal(t, 0, deferred.RetryCount)
+}
@@ -0,0 +1,23 @@
+package processor
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// exponentialBackoff returns base doubled once per attempt, capped at limit, with
+// jitter applied: the result is picked at random from the upper half of the window.
+// Attempt 0 yields a delay between base/2 and base.
+func exponentialBackoff(base, limit time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	backoff := base
+	for i := 0; i < attempt && backoff < limit; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, max(base, limit))
+
+	return backoff/2 + rand.N(backoff/2+1)
+}
@@ -0,0 +1,32 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff_DoublesPerAttempt(t *testing.T) {
+	for attempt, window := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		delay := exponentialBackoff(time.Second, time.Minute, attempt)
+		assert.GreaterOrEqual(t, delay, window/2)
+		assert.LessOrEqual(t, delay, window)
+	}
+}
+
+func TestExponentialBackoff_CappedAtLimit(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		assert.LessOrEqual(t, exponentialBackoff(time.Second, 10*time.Second, attempt), 10*time.Second)
+	}
+}
+
+func TestExponentialBackoff_BaseAboveLimit(t *testing.T) {
+	delay := exponentialBackoff(time.Minute, time.Second, 3)
+	assert.GreaterOrEqual(t, delay, 30*time.Second)
+	assert.LessOrEqual(t, delay, time.Minute)
+}
+
+func TestExponentialBackoff_ZeroBase(t *testing.T) {
+	assert.Equal(t, time.Duration(0), exponentialBackoff(0, time.Minute, 5))
+}
@@ -0,0 +1,40 @@
+package processor
+
+import (
+	"maps"
+	"strconv"
+
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// defaultDeadLetterEntityType is the entity type used for the dead-letter destination
+// when none is configured. On brokers that declare exchanges, a topic exchange keeps the
+// original routing key usable for binding consumers to a subset of the dead-lettered
+// events.
+const defaultDeadLetterEntityType = "topic"
+
+// deadLetterIDSuffix is appended to the ID of an event to identify its dead-letter copy,
+// which brokers deduplicating by event ID would otherwise drop as a repeat of the event.
+const deadLetterIDSuffix = ":dlq"
+
+// newDeadLetterEvent builds the copy of event that is republished to the dead-letter
+// topic. The original ID, destination, retry count and last error travel as headers.
+func newDeadLetterEvent(event schema.OutboxEvent, topic, entityType string, lastErr error) *schema.OutboxEvent {
+	headers := make(map[string]string, len(event.Headers)+6)
+	maps.Copy(headers, event.Headers)
+	headers[schema.HeaderOriginalID] = event.ID
+	headers[schema.HeaderOriginalEntity] = event.Entity
+	headers[schema.HeaderOriginalEntityType] = event.EntityType
+	headers[schema.HeaderOriginalRoutingKey] = event.RoutingKey
+	headers[schema.HeaderRetryCount] = strconv.Itoa(event.RetryCount)
+	if lastErr != nil {
+		headers[schema.HeaderLastError] = lastErr.Error()
+	}
+
+	deadLetter := event
+	deadLetter.ID = event.ID + deadLetterIDSuffix
+	deadLetter.Entity = topic
+	deadLetter.EntityType = entityType
+	deadLetter.Headers = headers
+	return &deadLetter
+}
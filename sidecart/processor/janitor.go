@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"github.com/zoff-tech/go-outbox/store"
+)
+
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionBatchSize = 1000
+)
+
+// Janitor purges processed events once they are older than the retention configured for
+// their status, so the outbox does not grow without bound.
+type Janitor struct {
+	repo      store.OutBoxRepository
+	tracer    trace.Tracer
+	retention map[schema.Status]time.Duration
+	interval  time.Duration
+	batchSize int
+	archive   bool
+}
+
+// NewJanitor creates a janitor applying the retention settings to the repository.
+func NewJanitor(repo store.OutBoxRepository, cfg config.RetentionSettings) *Janitor {
+	retention := make(map[schema.Status]time.Duration, len(cfg.Statuses))
+	for status, age := range cfg.Statuses {
+		retention[schema.Status(status)] = age
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultRetentionBatchSize
+	}
+	return &Janitor{
+		repo:      repo,
+		tracer:    otel.Tracer("go-outbox"),
+		retention: retention,
+		interval:  interval,
+		batchSize: batchSize,
+		archive:   cfg.Archive,
+	}
+}
+
+// Run purges expired events right away and then every interval, until ctx is done.
+func (j *Janitor) Run(ctx context.Context) {
+	if len(j.retention) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.Purge(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge deletes, batch by batch, all events older than the retention of their status.
+// Failures are logged and retried on the next run.
+func (j *Janitor) Purge(ctx context.Context) {
+	statuses := make([]schema.Status, 0, len(j.retention))
+	for status := range j.retention {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a] < statuses[b] })
+
+	for _, status := range statuses {
+		purged, err := j.purgeStatus(ctx, status, time.Now().Add(-j.retention[status]))
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to purge %s events: %v", status, err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d %s events", purged, status)
+		}
+	}
+}
+
+// purgeStatus purges the events in status last updated before the given time and returns
+// how many it purged.
+func (j *Janitor) purgeStatus(ctx context.Context, status schema.Status, before time.Time) (int, error) {
+	ctx, span := j.tracer.Start(ctx, "PurgeOutboxEvents", trace.WithAttributes(
+		attribute.String("event.status", string(status)),
+		attribute.Bool("retention.archive", j.archive),
+	))
+	defer span.End()
+
+	total := 0
+	for ctx.Err() == nil {
+		purged, err := j.repo.Purge(ctx, status, before, j.batchSize, j.archive)
+		total += purged
+		if err != nil {
+			span.RecordError(err)
+			return total, err
+		}
+		if purged < j.batchSize {
+			break
+		}
+	}
+	span.SetAttributes(attribute.Int("retention.purged", total))
+	return total, nil
+}
@@ -0,0 +1,80 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+func TestJanitor_PurgesEachStatusInBatches(t *testing.T) {
+	repo := newFakeRepository()
+	repo.purgeable[schema.StatusSent] = 25
+	repo.purgeable[schema.StatusCanceled] = 3
+	janitor := NewJanitor(repo, config.RetentionSettings{
+		Statuses:  map[string]time.Duration{"sent": 24 * time.Hour, "canceled": time.Hour},
+		BatchSize: 10,
+		Archive:   true,
+	})
+
+	before := time.Now()
+	janitor.Purge(context.Background())
+
+	assert.Equal(t, 0, repo.purgeable[schema.StatusSent])
+	assert.Equal(t, 0, repo.purgeable[schema.StatusCanceled])
+	if assert.Len(t, repo.purges, 4) {
+		// A batch smaller than the batch size ends the purge of a status.
+		assert.Equal(t, schema.StatusCanceled, repo.purges[0].status)
+		assert.WithinDuration(t, before.Add(-time.Hour), repo.purges[0].before, time.Second)
+		for _, call := range repo.purges[1:] {
+			assert.Equal(t, schema.StatusSent, call.status)
+			assert.WithinDuration(t, before.Add(-24*time.Hour), call.before, time.Second)
+			assert.Equal(t, 10, call.limit)
+			assert.True(t, call.archive)
+		}
+	}
+}
+
+func TestJanitor_RunDoesNothingWithoutRetention(t *testing.T) {
+	repo := newFakeRepository()
+	janitor := NewJanitor(repo, config.RetentionSettings{})
+
+	done := make(chan struct{})
+	go func() {
+		janitor.Run(context.Background())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return without retention settings")
+	}
+	assert.Empty(t, repo.purges)
+}
+
+func TestJanitor_RunPurgesUntilCanceled(t *testing.T) {
+	repo := newFakeRepository()
+	janitor := NewJanitor(repo, config.RetentionSettings{
+		Statuses: map[string]time.Duration{"sent": time.Hour},
+		Interval: 10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		janitor.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		return len(repo.purges) >= 2
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
@@ -0,0 +1,49 @@
+package processor
+
+import "time"
+
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultBatchSize    = 10
+	maxFetchBackoff     = time.Minute
+)
+
+// pollScheduler decides how long the processor waits before fetching again.
+// A full batch means more events are likely waiting, so the next fetch happens
+// right away. An idle outbox is polled at the configured interval, and failed
+// fetches back off exponentially with jitter so a struggling database is not
+// hammered by every replica at once.
+type pollScheduler struct {
+	interval  time.Duration
+	batchSize int
+	failures  int
+}
+
+func newPollScheduler(interval time.Duration, batchSize int) *pollScheduler {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	return &pollScheduler{interval: interval, batchSize: batchSize}
+}
+
+// Next returns the delay before the next fetch, given the outcome of the last one.
+func (s *pollScheduler) Next(fetched int, err error) time.Duration {
+	if err != nil {
+		s.failures++
+		return s.errorBackoff()
+	}
+
+	s.failures = 0
+	if fetched >= s.batchSize {
+		return 0
+	}
+	return s.interval
+}
+
+// errorBackoff doubles the poll interval for every consecutive failure, up to maxFetchBackoff.
+func (s *pollScheduler) errorBackoff() time.Duration {
+	return exponentialBackoff(s.interval, maxFetchBackoff, s.failures-1)
+}
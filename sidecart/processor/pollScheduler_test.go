@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollScheduler_FullBatchPollsImmediately(t *testing.T) {
+	scheduler := newPollScheduler(10*time.Second, 100)
+	assert.Equal(t, time.Duration(0), scheduler.Next(100, nil))
+}
+
+func TestPollScheduler_IdleUsesInterval(t *testing.T) {
+	scheduler := newPollScheduler(10*time.Second, 100)
+	assert.Equal(t, 10*time.Second, scheduler.Next(0, nil))
+	assert.Equal(t, 10*time.Second, scheduler.Next(42, nil))
+}
+
+func TestPollScheduler_Defaults(t *testing.T) {
+	scheduler := newPollScheduler(0, 0)
+	assert.Equal(t, defaultPollInterval, scheduler.Next(0, nil))
+	assert.Equal(t, time.Duration(0), scheduler.Next(defaultBatchSize, nil))
+}
+
+func TestPollScheduler_ErrorsBackOffWithJitter(t *testing.T) {
+	scheduler := newPollScheduler(time.Second, 10)
+	fetchErr := errors.New("connection refused")
+
+	for _, window := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		delay := scheduler.Next(0, fetchErr)
+		assert.GreaterOrEqual(t, delay, window/2)
+		assert.LessOrEqual(t, delay, window)
+	}
+
+	for i := 0; i < 100; i++ {
+		assert.LessOrEqual(t, scheduler.Next(0, fetchErr), maxFetchBackoff)
+	}
+}
+
+func TestPollScheduler_SuccessResetsBackoff(t *testing.T) {
+	scheduler := newPollScheduler(time.Second, 10)
+	for i := 0; i < 5; i++ {
+		scheduler.Next(0, errors.New("boom"))
+	}
+	scheduler.Next(0, nil)
+
+	delay := scheduler.Next(0, errors.New("boom"))
+	assert.LessOrEqual(t, delay, time.Second)
+}
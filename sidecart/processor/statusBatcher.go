@@ -0,0 +1,127 @@
+package processor
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zoff-tech/go-outbox/schema"
+	"github.com/zoff-tech/go-outbox/store"
+)
+
+// statusFlushInterval bounds how long the outcome of a publish waits before it is written.
+const statusFlushInterval = 100 * time.Millisecond
+
+// statusBatcher collects the outcome of publishes and writes them to the repository in
+// batches, so a batch of events costs a couple of statements instead of one per event.
+// Outcomes are written once size of them are pending, and at least every flush interval
+// while Run is active. Publish attempts are written along with the outcomes.
+type statusBatcher struct {
+	repo store.OutBoxRepository
+	size int
+
+	mu           sync.Mutex
+	sent         []store.SentEvent
+	nextAttempts map[string]time.Time
+	deferred     map[string]time.Time
+	attempts     []schema.EventAttempt
+}
+
+func newStatusBatcher(repo store.OutBoxRepository, size int) *statusBatcher {
+	return &statusBatcher{repo: repo, size: size, nextAttempts: make(map[string]time.Time), deferred: make(map[string]time.Time)}
+}
+
+// MarkSent records that the event was published.
+func (b *statusBatcher) MarkSent(ctx context.Context, sent store.SentEvent) {
+	b.mu.Lock()
+	b.sent = append(b.sent, sent)
+	full := b.pending() >= b.size
+	b.mu.Unlock()
+
+	if full {
+		b.Flush(ctx)
+	}
+}
+
+// ScheduleRetry records that the event is to be retried at nextAttemptAt.
+func (b *statusBatcher) ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) {
+	b.mu.Lock()
+	b.nextAttempts[eventID] = nextAttemptAt
+	full := b.pending() >= b.size
+	b.mu.Unlock()
+
+	if full {
+		b.Flush(ctx)
+	}
+}
+
+// Defer records that the event, which was not attempted, is held back until nextAttemptAt.
+func (b *statusBatcher) Defer(ctx context.Context, eventID string, nextAttemptAt time.Time) {
+	b.mu.Lock()
+	b.deferred[eventID] = nextAttemptAt
+	full := b.pending() >= b.size
+	b.mu.Unlock()
+
+	if full {
+		b.Flush(ctx)
+	}
+}
+
+// RecordAttempt records a publish attempt. Attempts do not count towards the batch size,
+// since every outcome follows an attempt.
+func (b *statusBatcher) RecordAttempt(attempt schema.EventAttempt) {
+	b.mu.Lock()
+	b.attempts = append(b.attempts, attempt)
+	b.mu.Unlock()
+}
+
+// Run flushes the pending outcomes every flush interval until ctx is done.
+func (b *statusBatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(statusFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.Flush(ctx)
+		}
+	}
+}
+
+// Flush writes the pending outcomes. Status updates must not be lost to a canceled context,
+// so they run without its cancellation.
+func (b *statusBatcher) Flush(ctx context.Context) {
+	b.mu.Lock()
+	sent, nextAttempts, deferred, attempts := b.sent, b.nextAttempts, b.deferred, b.attempts
+	b.sent, b.nextAttempts, b.deferred, b.attempts = nil, make(map[string]time.Time), make(map[string]time.Time), nil
+	b.mu.Unlock()
+
+	ctx = context.WithoutCancel(ctx)
+	if len(attempts) > 0 {
+		if err := b.repo.RecordAttempts(ctx, attempts); err != nil {
+			log.Printf("Failed to record %d publish attempts: %v", len(attempts), err)
+		}
+	}
+	if len(sent) > 0 {
+		if err := b.repo.MarkProcessedBatch(ctx, sent); err != nil {
+			log.Printf("Failed to mark %d events as processed: %v", len(sent), err)
+		}
+	}
+	if len(nextAttempts) > 0 {
+		if err := b.repo.ScheduleRetryBatch(ctx, nextAttempts); err != nil {
+			log.Printf("Failed to schedule retries for %d events: %v", len(nextAttempts), err)
+		}
+	}
+	if len(deferred) > 0 {
+		if err := b.repo.DeferBatch(ctx, deferred); err != nil {
+			log.Printf("Failed to defer %d events: %v", len(deferred), err)
+		}
+	}
+}
+
+func (b *statusBatcher) pending() int {
+	return len(b.sent) + len(b.nextAttempts) + len(b.deferred)
+}
@@ -0,0 +1,72 @@
+package processor
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// workerPool runs event handlers concurrently while keeping events that share a
+// routing key in order. Each routing key is pinned to a single worker, so events
+// for the same key are handled one after another while other keys progress
+// independently.
+type workerPool struct {
+	queues []chan schema.OutboxEvent
+	wg     sync.WaitGroup
+}
+
+// newWorkerPool starts size workers, each with a queue holding up to queueSize events.
+func newWorkerPool(size, queueSize int, handle func(schema.OutboxEvent)) *workerPool {
+	if size <= 0 {
+		size = 1
+	}
+
+	pool := &workerPool{queues: make([]chan schema.OutboxEvent, size)}
+	for i := range pool.queues {
+		queue := make(chan schema.OutboxEvent, queueSize)
+		pool.queues[i] = queue
+
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for event := range queue {
+				handle(event)
+			}
+		}()
+	}
+	return pool
+}
+
+// Submit hands the event to the worker that owns its routing key.
+// It blocks while that worker's queue is full and reports false if ctx is done first.
+func (w *workerPool) Submit(ctx context.Context, event schema.OutboxEvent) bool {
+	select {
+	case w.queues[w.shard(event)] <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Close stops accepting events and waits until the queued ones are handled.
+func (w *workerPool) Close() {
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+}
+
+// shard maps an event to a worker. Events without a routing key have no
+// ordering requirement, so they are spread by ID instead.
+func (w *workerPool) shard(event schema.OutboxEvent) int {
+	key := event.RoutingKey
+	if key == "" {
+		key = event.ID
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(w.queues)))
+}
@@ -0,0 +1,100 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+func TestWorkerPool_PreservesOrderPerRoutingKey(t *testing.T) {
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+
+	pool := newWorkerPool(4, 10, func(event schema.OutboxEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled[event.RoutingKey] = append(handled[event.RoutingKey], event.ID)
+	})
+
+	expected := make(map[string][]string)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i%5)
+		id := fmt.Sprintf("%d", i)
+		expected[key] = append(expected[key], id)
+		pool.Submit(context.Background(), schema.OutboxEvent{ID: id, RoutingKey: key})
+	}
+	pool.Close()
+
+	assert.Equal(t, expected, handled)
+}
+
+func TestWorkerPool_SlowKeyDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan string, 10)
+
+	pool := newWorkerPool(2, 10, func(event schema.OutboxEvent) {
+		if event.RoutingKey == "slow" {
+			<-release
+		}
+		done <- event.ID
+	})
+
+	pool.Submit(context.Background(), schema.OutboxEvent{ID: "slow-1", RoutingKey: "slow"})
+
+	// Find a key that is served by the other worker.
+	fast := schema.OutboxEvent{ID: "fast-1"}
+	for i := 0; ; i++ {
+		fast.RoutingKey = fmt.Sprintf("fast-%d", i)
+		if pool.shard(fast) != pool.shard(schema.OutboxEvent{RoutingKey: "slow"}) {
+			break
+		}
+	}
+	pool.Submit(context.Background(), fast)
+
+	select {
+	case id := <-done:
+		assert.Equal(t, "fast-1", id)
+	case <-time.After(time.Second):
+		t.Fatal("event with a different routing key was blocked by the slow one")
+	}
+
+	close(release)
+	pool.Close()
+	assert.Equal(t, "slow-1", <-done)
+}
+
+func TestWorkerPool_EventsWithoutRoutingKeyAreSpread(t *testing.T) {
+	pool := newWorkerPool(4, 1, func(schema.OutboxEvent) {})
+	defer pool.Close()
+
+	shards := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		shards[pool.shard(schema.OutboxEvent{ID: fmt.Sprintf("id-%d", i)})] = true
+	}
+	assert.Len(t, shards, 4)
+}
+
+func TestWorkerPool_SubmitStopsWhenContextIsDone(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	pool := newWorkerPool(1, 1, func(schema.OutboxEvent) {
+		started <- struct{}{}
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.True(t, pool.Submit(ctx, schema.OutboxEvent{ID: "1", RoutingKey: "k"}))
+	<-started
+	assert.True(t, pool.Submit(ctx, schema.OutboxEvent{ID: "2", RoutingKey: "k"})) // fills the queue
+
+	cancel()
+	assert.False(t, pool.Submit(ctx, schema.OutboxEvent{ID: "3", RoutingKey: "k"}))
+
+	close(release)
+	pool.Close()
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"log"
+	"os/signal"
+	"syscall"
 
 	"github.com/zoff-tech/go-outbox/broker"
 	"github.com/zoff-tech/go-outbox/config"
@@ -12,7 +14,9 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
+	// Cancel the context on SIGTERM/SIGINT so the processor can shut down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
 	// Load configuration from file or environment
 	cfg, err := config.LoadFromFile("./config")
@@ -34,7 +38,7 @@ func main() {
 	defer shutdownTelemetry() // Ensure telemetry is properly shut down on exit
 
 	// Initialize the repository
-	repo, err := store.NewRepository(ctx, cfg.Database)
+	repo, err := store.NewRepository(ctx, cfg.Database, cfg.RetryPolicy())
 	if err != nil {
 		log.Fatal("Failed to initialize repository: ", err)
 	}
@@ -45,9 +49,26 @@ func main() {
 		log.Fatal("Failed to initialize broker: ", err)
 	}
 
+	// Purge processed events in the background, according to the retention settings
+	janitor := processor.NewJanitor(repo, cfg.Retention)
+	janitorDone := make(chan struct{})
+	go func() {
+		janitor.Run(ctx)
+		close(janitorDone)
+	}()
+
 	// Create the outbox processor
 	processor := processor.NewOutboxProcessor(repo, broker, cfg)
 
-	// Run the processor (blocks until context is canceled or an error occurs)
+	// Run the processor (blocks until a shutdown signal is received and in-flight events are drained)
 	processor.ProcessEvents(ctx)
+	<-janitorDone
+
+	if err := broker.Close(); err != nil {
+		log.Printf("Failed to close broker: %v", err)
+	}
+	if err := repo.Close(); err != nil {
+		log.Printf("Failed to close repository: %v", err)
+	}
+	log.Println("Outbox sidecar stopped")
 }
@@ -2,31 +2,121 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/spanner"
+	sppb "cloud.google.com/go/spanner/apiv1/spannerpb"
+	"github.com/zoff-tech/go-outbox/config"
 	"github.com/zoff-tech/go-outbox/schema"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type SpannerRepository struct {
-	client *spanner.Client
+	client      *spanner.Client
+	retryPolicy *config.RetryPolicy
+	// instanceID is recorded in locked_by for the events this replica claims.
+	instanceID    string
+	leaseDuration time.Duration
+	// attemptHistory keeps every publish attempt in outbox_event_attempts.
+	attemptHistory bool
 }
 
+// FetchPending reads and claims due events in a single read-write transaction. Spanner
+// locks the rows read by the transaction, and the claim re-checks that the events are
+// still claimable, so concurrent replicas never claim the same event.
 func (s *SpannerRepository) FetchPending(ctx context.Context, batchSize int) ([]schema.OutboxEvent, error) {
+	var claimed []schema.OutboxEvent
+	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		// The function is re-run when the transaction aborts, so start from scratch.
+		claimed = nil
+		now := time.Now()
+
+		events, err := s.queryClaimable(ctx, txn, now, batchSize)
+		if err != nil {
+			return err
+		}
+
+		// Events already retried beyond their limit (possible after the limit was
+		// lowered) are marked failed and not returned.
+		var claimedIDs, exceededIDs []string
+		for _, event := range events {
+			if event.RetryCount > s.retryPolicy.MaxRetriesFor(event.Entity) {
+				exceededIDs = append(exceededIDs, event.ID)
+				continue
+			}
+			claimedIDs = append(claimedIDs, event.ID)
+			claimed = append(claimed, event)
+		}
+
+		if len(exceededIDs) > 0 {
+			if _, err := txn.Update(ctx, spanner.Statement{
+				SQL: `UPDATE outbox SET status = @status, locked_by = NULL, locked_until = NULL, updated_at = @now
+                      WHERE id IN UNNEST(@ids) AND (` + claimableCondition + `)`,
+				Params: claimParams(now, map[string]interface{}{
+					"status": schema.StatusFailed,
+					"ids":    exceededIDs,
+				}),
+			}); err != nil {
+				return err
+			}
+		}
+		if len(claimedIDs) > 0 {
+			count, err := txn.Update(ctx, spanner.Statement{
+				SQL: `UPDATE outbox SET status = @status, locked_by = @lockedBy, locked_until = @lockedUntil, updated_at = @now
+                      WHERE id IN UNNEST(@ids) AND (` + claimableCondition + `)`,
+				Params: claimParams(now, map[string]interface{}{
+					"status":      schema.StatusProcessing,
+					"lockedBy":    s.instanceID,
+					"lockedUntil": now.Add(s.leaseDuration),
+					"ids":         claimedIDs,
+				}),
+			})
+			if err != nil {
+				return err
+			}
+			// The rows read by this transaction are locked, so they are all still claimable.
+			// Should another transaction have claimed some anyway, abort so that the client
+			// retries the whole transaction instead of returning events that are not ours.
+			if count != int64(len(claimedIDs)) {
+				return spanner.ToSpannerError(status.Errorf(codes.Aborted, "claimed %d of %d outbox events", count, len(claimedIDs)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// claimableCondition matches events that are due, or whose lease has expired.
+const claimableCondition = `(status = @statusPending AND (next_attempt_at IS NULL OR next_attempt_at <= @now))
+                 OR (status = @statusProcessing AND (locked_until IS NULL OR locked_until < @now))`
+
+func claimParams(now time.Time, params map[string]interface{}) map[string]interface{} {
+	params["statusPending"] = schema.StatusPending
+	params["statusProcessing"] = schema.StatusProcessing
+	params["now"] = now
+	return params
+}
+
+func (s *SpannerRepository) queryClaimable(ctx context.Context, txn *spanner.ReadWriteTransaction, now time.Time, batchSize int) ([]schema.OutboxEvent, error) {
 	stmt := spanner.Statement{
-		SQL: `SELECT id, entity, entity_type, payload, retry_count, headers, routing_key FROM outbox
-              WHERE (status = @statusPending OR (status = @statusProcessing AND updated_at < @lockExpiration))
+		SQL: `SELECT id, entity, entity_type, payload, retry_count, headers, routing_key, created_at FROM outbox
+              WHERE ` + claimableCondition + `
+              ORDER BY created_at
               LIMIT @batchSize`,
-		Params: map[string]interface{}{
-			"statusPending":    schema.StatusPending,
-			"statusProcessing": schema.StatusProcessing,
-			"lockExpiration":   time.Now().Add(-lockExpiration),
-			"batchSize":        batchSize,
-		},
+		Params: claimParams(now, map[string]interface{}{
+			"batchSize": batchSize,
+		}),
 	}
 
-	iter := s.client.Single().Query(ctx, stmt)
+	iter := txn.Query(ctx, stmt)
 	defer iter.Stop()
 
 	var events []schema.OutboxEvent
@@ -40,79 +130,348 @@ func (s *SpannerRepository) FetchPending(ctx context.Context, batchSize int) ([]
 		}
 
 		var event schema.OutboxEvent
+		var retryCount int64
+		var headers spanner.GenericColumnValue
 		if err := row.Columns(
 			&event.ID,
 			&event.Entity,
 			&event.EntityType,
 			&event.Payload,
-			&event.RetryCount,
-			&event.Headers,
-			&event.RoutingKey); err != nil {
+			&retryCount,
+			&headers,
+			&event.RoutingKey,
+			&event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.RetryCount = int(retryCount)
+		if event.Headers, err = decodeSpannerHeaders(headers); err != nil {
 			return nil, err
 		}
 		events = append(events, event)
 	}
+	return events, nil
+}
 
-	// Update status and updated_at for fetched events
-	for _, event := range events {
-		if event.RetryCount >= maxRetries {
-			if err := s.SetStatus(ctx, event.ID, schema.StatusFailed); err != nil {
-				return nil, err
-			}
-		} else {
-			if err := s.SetStatusAndIncrementRetry(ctx, event.ID, schema.StatusProcessing); err != nil {
-				return nil, err
-			}
+// decodeSpannerHeaders decodes the headers column, which holds a JSON object either as
+// JSON or as STRING, and may be NULL.
+func decodeSpannerHeaders(column spanner.GenericColumnValue) (map[string]string, error) {
+	var raw spanner.NullString
+	if column.Type.Code == sppb.TypeCode_JSON {
+		var value spanner.NullJSON
+		if err := column.Decode(&value); err != nil {
+			return nil, err
 		}
+		raw = spanner.NullString{StringVal: value.String(), Valid: value.Valid}
+	} else if err := column.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if !raw.Valid || raw.StringVal == "" {
+		return nil, nil
 	}
 
-	return events, nil
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw.StringVal), &headers); err != nil {
+		return nil, errors.New("failed to parse headers: " + err.Error())
+	}
+	return headers, nil
 }
 
+// SetStatus sets the status of an event claimed by this instance and releases its lease.
 func (s *SpannerRepository) SetStatus(ctx context.Context, eventID string, status schema.Status) error {
+	return s.updateOwned(ctx, spanner.Statement{
+		SQL: `UPDATE outbox SET status = @status, locked_by = NULL, locked_until = NULL, updated_at = @now
+              WHERE id = @id AND locked_by = @lockedBy`,
+		Params: map[string]interface{}{
+			"status": status,
+			"now":    time.Now(),
+			"id":     eventID,
+		},
+	})
+}
+
+func (s *SpannerRepository) SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error {
+	return s.updateOwned(ctx, spanner.Statement{
+		SQL: `UPDATE outbox SET status = @status, retry_count = retry_count + 1, locked_by = NULL, locked_until = NULL, updated_at = @now
+              WHERE id = @id AND locked_by = @lockedBy`,
+		Params: map[string]interface{}{
+			"status": status,
+			"now":    time.Now(),
+			"id":     eventID,
+		},
+	})
+}
+
+func (s *SpannerRepository) ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) error {
+	return s.updateOwned(ctx, spanner.Statement{
+		SQL: `UPDATE outbox SET status = @status, retry_count = retry_count + 1, next_attempt_at = @nextAttemptAt, locked_by = NULL, locked_until = NULL, updated_at = @now
+              WHERE id = @id AND locked_by = @lockedBy`,
+		Params: map[string]interface{}{
+			"status":        schema.StatusPending,
+			"nextAttemptAt": nextAttemptAt,
+			"now":           time.Now(),
+			"id":            eventID,
+		},
+	})
+}
+
+func (s *SpannerRepository) ScheduleRetryBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return s.deferBatch(ctx, nextAttempts, 1)
+}
+
+func (s *SpannerRepository) DeferBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return s.deferBatch(ctx, nextAttempts, 0)
+}
+
+// deferBatch sets the events back to pending until their next attempts, adding retries to
+// their retry counts.
+func (s *SpannerRepository) deferBatch(ctx context.Context, nextAttempts map[string]time.Time, retries int64) error {
+	ids, _ := sortedRetries(nextAttempts)
+	return s.updateOwnedBatch(ctx, ids, []string{"retry_count"}, func(id string, row *spanner.Row, now time.Time) (*spanner.Mutation, error) {
+		var retryCount int64
+		if err := row.Column(1, &retryCount); err != nil {
+			return nil, err
+		}
+		return spanner.Update("outbox",
+			[]string{"id", "status", "retry_count", "next_attempt_at", "locked_by", "locked_until", "updated_at"},
+			[]interface{}{id, string(schema.StatusPending), retryCount + retries, nextAttempts[id], spanner.NullString{}, spanner.NullTime{}, now}), nil
+	})
+}
+
+func (s *SpannerRepository) IncrementRetryCount(ctx context.Context, eventID string) error {
+	return s.updateOwned(ctx, spanner.Statement{
+		SQL: `UPDATE outbox SET retry_count = retry_count + 1, updated_at = @now WHERE id = @id AND locked_by = @lockedBy`,
+		Params: map[string]interface{}{
+			"now": time.Now(),
+			"id":  eventID,
+		},
+	})
+}
+
+func (s *SpannerRepository) RenewLease(ctx context.Context, eventID string) error {
+	now := time.Now()
+	return s.updateOwned(ctx, spanner.Statement{
+		SQL: `UPDATE outbox SET locked_until = @lockedUntil, updated_at = @now
+              WHERE id = @id AND status = @status AND locked_by = @lockedBy`,
+		Params: map[string]interface{}{
+			"lockedUntil": now.Add(s.leaseDuration),
+			"now":         now,
+			"id":          eventID,
+			"status":      schema.StatusProcessing,
+		},
+	})
+}
+
+func (s *SpannerRepository) MarkProcessed(ctx context.Context, eventID, messageID string) error {
+	now := time.Now()
+	return s.updateOwned(ctx, spanner.Statement{
+		SQL: `UPDATE outbox SET status = @status, sent_at = @now, message_id = @messageID, locked_by = NULL, locked_until = NULL, updated_at = @now
+              WHERE id = @id AND locked_by = @lockedBy`,
+		Params: map[string]interface{}{
+			"status":    schema.StatusSent,
+			"now":       now,
+			"messageID": spanner.NullString{StringVal: messageID, Valid: messageID != ""},
+			"id":        eventID,
+		},
+	})
+}
+
+func (s *SpannerRepository) MarkProcessedBatch(ctx context.Context, sent []SentEvent) error {
+	ids := make([]string, len(sent))
+	events := make(map[string]SentEvent, len(sent))
+	for i, event := range sent {
+		ids[i] = event.EventID
+		events[event.EventID] = event
+	}
+	return s.updateOwnedBatch(ctx, ids, nil, func(id string, _ *spanner.Row, now time.Time) (*spanner.Mutation, error) {
+		event := events[id]
+		return spanner.Update("outbox",
+			[]string{"id", "status", "sent_at", "message_id", "locked_by", "locked_until", "updated_at"},
+			[]interface{}{id, string(schema.StatusSent), event.SentAt, spanner.NullString{StringVal: event.MessageID, Valid: event.MessageID != ""},
+				spanner.NullString{}, spanner.NullTime{}, now}), nil
+	})
+}
+
+// RecordAttempts writes the last errors and the attempt history as mutations of a single
+// commit. Events that no longer exist are skipped.
+func (s *SpannerRepository) RecordAttempts(ctx context.Context, attempts []schema.EventAttempt) error {
+	attempts, failedIDs, lastErrors := attributeAttempts(attempts, s.instanceID)
+	if len(failedIDs) == 0 && (!s.attemptHistory || len(attempts) == 0) {
+		return nil
+	}
+
 	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		stmt := spanner.Statement{
-			SQL: `UPDATE outbox SET status = @status, updated_at = CURRENT_TIMESTAMP() WHERE id = @id`,
-			Params: map[string]interface{}{
-				"status": status,
-				"id":     eventID,
-			},
+		// Update and interleaved Insert mutations fail on missing events, so write only
+		// those that still exist.
+		ids := failedIDs
+		if s.attemptHistory {
+			ids = nil
+			for _, attempt := range attempts {
+				ids = append(ids, attempt.EventID)
+			}
 		}
-		_, err := txn.Update(ctx, stmt)
-		return err
+		existing := make(map[string]bool)
+		iter := txn.Query(ctx, spanner.Statement{
+			SQL:    `SELECT id FROM outbox WHERE id IN UNNEST(@ids)`,
+			Params: map[string]interface{}{"ids": ids},
+		})
+		err := iter.Do(func(row *spanner.Row) error {
+			var id string
+			if err := row.Columns(&id); err != nil {
+				return err
+			}
+			existing[id] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var mutations []*spanner.Mutation
+		for i, id := range failedIDs {
+			if existing[id] {
+				mutations = append(mutations, spanner.Update("outbox",
+					[]string{"id", "last_error"},
+					[]interface{}{id, lastErrors[i]}))
+			}
+		}
+		if s.attemptHistory {
+			for _, attempt := range attempts {
+				if !existing[attempt.EventID] {
+					continue
+				}
+				mutations = append(mutations, spanner.Insert("outbox_event_attempts",
+					[]string{"event_id", "attempted_at", "instance_id", "broker", "error"},
+					[]interface{}{attempt.EventID, attempt.AttemptedAt, attempt.InstanceID, attempt.Broker,
+						spanner.NullString{StringVal: attempt.Error, Valid: attempt.Failed()}}))
+			}
+		}
+		return txn.BufferWrite(mutations)
 	})
 	return err
 }
 
-func (s *SpannerRepository) SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error {
+// Purge reads the oldest matching events and deletes them as mutations of a single commit.
+// With archive set, the rows are copied to outbox_archive in the same commit. The attempts
+// of the events are deleted explicitly rather than through the interleaving cascade, which
+// keeps the purge working on schemas without it.
+func (s *SpannerRepository) Purge(ctx context.Context, status schema.Status, before time.Time, limit int, archive bool) (int, error) {
+	columns := "id"
+	if archive {
+		columns = "*"
+	}
+
+	var purged int
 	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		stmt := spanner.Statement{
-			SQL: `UPDATE outbox SET status = @status, retry_count = retry_count + 1, updated_at = CURRENT_TIMESTAMP() WHERE id = @id`,
+		purged = 0
+		iter := txn.Query(ctx, spanner.Statement{
+			SQL: `SELECT ` + columns + ` FROM outbox WHERE status = @status AND updated_at < @before
+                  ORDER BY updated_at LIMIT @limit`,
 			Params: map[string]interface{}{
 				"status": status,
-				"id":     eventID,
+				"before": before,
+				"limit":  limit,
 			},
+		})
+		var mutations []*spanner.Mutation
+		err := iter.Do(func(row *spanner.Row) error {
+			var id string
+			if err := row.ColumnByName("id", &id); err != nil {
+				return err
+			}
+			if archive {
+				values := make([]interface{}, row.Size())
+				for i := range values {
+					var value spanner.GenericColumnValue
+					if err := row.Column(i, &value); err != nil {
+						return err
+					}
+					values[i] = value
+				}
+				mutations = append(mutations, spanner.InsertOrUpdate("outbox_archive", row.ColumnNames(), values))
+			}
+			mutations = append(mutations,
+				spanner.Delete("outbox_event_attempts", spanner.KeyRange{Start: spanner.Key{id}, End: spanner.Key{id}, Kind: spanner.ClosedClosed}),
+				spanner.Delete("outbox", spanner.Key{id}))
+			purged++
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		_, err := txn.Update(ctx, stmt)
-		return err
+		return txn.BufferWrite(mutations)
 	})
-	return err
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
 }
 
-func (s *SpannerRepository) IncrementRetryCount(ctx context.Context, eventID string) error {
+func (s *SpannerRepository) Close() error {
+	s.client.Close()
+	return nil
+}
+
+// updateOwnedBatch reads the events among ids still leased to this instance, along with the
+// given columns, and buffers the mutation built for each of them, so the whole batch costs a
+// query and a commit. The mutations are committed even when some leases were lost, in which
+// case it returns ErrLeaseLost.
+func (s *SpannerRepository) updateOwnedBatch(ctx context.Context, ids []string, columns []string,
+	mutation func(id string, row *spanner.Row, now time.Time) (*spanner.Mutation, error)) error {
+	var owned int
 	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		stmt := spanner.Statement{
-			SQL: `UPDATE outbox SET retry_count = retry_count + 1, updated_at = CURRENT_TIMESTAMP() WHERE id = @id`,
+		owned = 0
+		now := time.Now()
+
+		iter := txn.Query(ctx, spanner.Statement{
+			SQL: `SELECT ` + strings.Join(append([]string{"id"}, columns...), ", ") + `
+                  FROM outbox WHERE id IN UNNEST(@ids) AND locked_by = @lockedBy`,
 			Params: map[string]interface{}{
-				"id": eventID,
+				"ids":      ids,
+				"lockedBy": s.instanceID,
 			},
+		})
+		var mutations []*spanner.Mutation
+		err := iter.Do(func(row *spanner.Row) error {
+			var id string
+			if err := row.Column(0, &id); err != nil {
+				return err
+			}
+			m, err := mutation(id, row, now)
+			if err != nil {
+				return err
+			}
+			mutations = append(mutations, m)
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		_, err := txn.Update(ctx, stmt)
-		return err
+
+		owned = len(mutations)
+		return txn.BufferWrite(mutations)
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	if owned < len(ids) {
+		return ErrLeaseLost
+	}
+	return nil
 }
 
-func (s *SpannerRepository) MarkProcessed(ctx context.Context, eventID string) error {
-	return s.SetStatus(ctx, eventID, schema.StatusSent)
+// updateOwned runs an update restricted by @lockedBy to events whose lease this instance
+// holds and returns ErrLeaseLost when it matched no row.
+func (s *SpannerRepository) updateOwned(ctx context.Context, stmt spanner.Statement) error {
+	stmt.Params["lockedBy"] = s.instanceID
+	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		count, err := txn.Update(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrLeaseLost
+		}
+		return nil
+	})
+	return err
 }
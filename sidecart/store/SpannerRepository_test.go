@@ -2,21 +2,48 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/spanner"
+	dbadmin "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
 	"cloud.google.com/go/spanner/spannertest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
 	"github.com/zoff-tech/go-outbox/schema"
 )
 
-func setupSpannerTestServer(t *testing.T) (*spanner.Client, func()) {
+// setupSpannerTestServer starts an in-memory Spanner server with the schema from
+// deployment/spanner applied and returns a client connected to it.
+func setupSpannerTestServer(t testing.TB) (*spanner.Client, func()) {
 	server, err := spannertest.NewServer("localhost:0")
-	assert.NoError(t, err)
+	require.NoError(t, err)
+	server.SetLogger(func(string, ...interface{}) {}) // spannertest logs every statement
+	t.Setenv("SPANNER_EMULATOR_HOST", server.Addr)
 
-	conn, err := spanner.NewClient(context.Background(), server.Addr)
-	assert.NoError(t, err)
+	ctx := context.Background()
+	database := "projects/test-project/instances/test-instance/databases/test-database"
+	admin, err := dbadmin.NewDatabaseAdminClient(ctx)
+	require.NoError(t, err)
+	defer admin.Close()
+
+	op, err := admin.UpdateDatabaseDdl(ctx, &databasepb.UpdateDatabaseDdlRequest{
+		Database:   database,
+		Statements: spannerMigrations(t),
+	})
+	require.NoError(t, err)
+	require.NoError(t, op.Wait(ctx))
+
+	conn, err := spanner.NewClient(ctx, database)
+	require.NoError(t, err)
 
 	return conn, func() {
 		conn.Close()
@@ -24,42 +51,148 @@ func setupSpannerTestServer(t *testing.T) (*spanner.Client, func()) {
 	}
 }
 
-func SpannerTestFetchPending(t *testing.T) {
+// spannerMigrations returns the DDL statements of the up migrations in order. spannertest
+// does not support the JSON type, so JSON columns are created as STRING(MAX).
+func spannerMigrations(t testing.TB) []string {
+	files, err := filepath.Glob("../../deployment/spanner/*.up.sql")
+	require.NoError(t, err)
+	sort.Strings(files)
+
+	jsonType := regexp.MustCompile(`\bJSON\b`)
+	var statements []string
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		require.NoError(t, err)
+		for _, statement := range strings.Split(string(content), ";") {
+			if statement = strings.TrimSpace(statement); statement != "" {
+				statements = append(statements, jsonType.ReplaceAllString(statement, "STRING(MAX)"))
+			}
+		}
+	}
+	return statements
+}
+
+// insertSpannerTestEvent inserts an event with the given status and retry count.
+func insertSpannerTestEvent(t testing.TB, client *spanner.Client, id string, status schema.Status, retryCount int) {
+	_, err := client.Apply(context.Background(), []*spanner.Mutation{
+		spanner.Insert("outbox",
+			[]string{"id", "entity", "entity_type", "payload", "status", "created_at", "updated_at", "headers", "retry_count", "routing_key"},
+			[]interface{}{id, "orders", "direct", []byte(`{}`), string(status), time.Now(), time.Now(), `{"tenant":"acme"}`, retryCount, "order.created"}),
+	})
+	require.NoError(t, err)
+}
+
+// leaseSpannerTestEvent leases an event to the given instance until the given time.
+func leaseSpannerTestEvent(t testing.TB, client *spanner.Client, id, instanceID string, lockedUntil time.Time) {
+	_, err := client.Apply(context.Background(), []*spanner.Mutation{
+		spanner.Update("outbox", []string{"id", "locked_by", "locked_until"}, []interface{}{id, instanceID, lockedUntil}),
+	})
+	require.NoError(t, err)
+}
+
+func newSpannerTestRepository(client *spanner.Client, instanceID string) OutBoxRepository {
+	return NewSpannerRepositoryFactory(client, config.DbSettings{InstanceID: instanceID}, nil)
+}
+
+func readSpannerTestClaim(t *testing.T, client *spanner.Client, id string) (string, spanner.NullString) {
+	row, err := client.Single().ReadRow(context.Background(), "outbox", spanner.Key{id}, []string{"status", "locked_by"})
+	require.NoError(t, err)
+
+	var status string
+	var lockedBy spanner.NullString
+	require.NoError(t, row.Columns(&status, &lockedBy))
+	return status, lockedBy
+}
+
+func TestSpannerFetchPending(t *testing.T) {
 	client, cleanup := setupSpannerTestServer(t)
 	defer cleanup()
 
-	repo := NewSpannerRepositoryFactory(client)
+	repo := newSpannerTestRepository(client, "instance-a")
+	insertSpannerTestEvent(t, client, "1", schema.StatusPending, 0)
 
-	// Insert mock data into the Spanner test server
 	ctx := context.Background()
-	_, err := client.Apply(ctx, []*spanner.Mutation{
-		spanner.Insert("outbox", []string{"id", "status", "retry_count", "updated_at"}, []interface{}{"1", "pending", 0, time.Now()}),
-	})
+	events, err := repo.FetchPending(ctx, 10)
 	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "1", events[0].ID)
+	assert.Equal(t, "orders", events[0].Entity)
+	assert.Equal(t, map[string]string{"tenant": "acme"}, events[0].Headers)
+	assert.False(t, events[0].CreatedAt.IsZero())
 
-	// Call FetchPending
-	events, err := repo.FetchPending(ctx, 10)
+	status, lockedBy := readSpannerTestClaim(t, client, "1")
+	assert.Equal(t, string(schema.StatusProcessing), status)
+	assert.Equal(t, spanner.NullString{StringVal: "instance-a", Valid: true}, lockedBy)
+}
+
+func TestSpannerFetchPending_DoesNotReturnEventsClaimedByAnotherInstance(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	first := newSpannerTestRepository(client, "instance-a")
+	second := newSpannerTestRepository(client, "instance-b")
+	insertSpannerTestEvent(t, client, "1", schema.StatusPending, 0)
+
+	ctx := context.Background()
+	events, err := first.FetchPending(ctx, 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+
+	events, err = second.FetchPending(ctx, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	_, lockedBy := readSpannerTestClaim(t, client, "1")
+	assert.Equal(t, "instance-a", lockedBy.StringVal)
+}
+
+func TestSpannerFetchPending_ReclaimsExpiredLeases(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	repo := newSpannerTestRepository(client, "instance-b")
+	insertSpannerTestEvent(t, client, "1", schema.StatusProcessing, 0)
+	leaseSpannerTestEvent(t, client, "1", "instance-a", time.Now().Add(-time.Second))
+	insertSpannerTestEvent(t, client, "2", schema.StatusProcessing, 0)
+	leaseSpannerTestEvent(t, client, "2", "instance-a", time.Now().Add(time.Minute))
+
+	events, err := repo.FetchPending(context.Background(), 10)
 	assert.NoError(t, err)
 	assert.Len(t, events, 1)
 	assert.Equal(t, "1", events[0].ID)
-	assert.Equal(t, schema.StatusPending, events[0].Status)
+
+	_, lockedBy := readSpannerTestClaim(t, client, "1")
+	assert.Equal(t, "instance-b", lockedBy.StringVal)
 }
 
-func SpannerTestSetStatus(t *testing.T) {
+func TestSpannerFetchPending_MarksEventsOverTheirRetryLimitFailed(t *testing.T) {
 	client, cleanup := setupSpannerTestServer(t)
 	defer cleanup()
 
-	repo := NewSpannerRepositoryFactory(client)
+	repo := NewSpannerRepositoryFactory(client, config.DbSettings{InstanceID: "instance-a"}, config.NewRetryPolicy(3, nil))
+	insertSpannerTestEvent(t, client, "1", schema.StatusPending, 4)
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	status, _ := readSpannerTestClaim(t, client, "1")
+	assert.Equal(t, string(schema.StatusFailed), status)
+}
+
+func TestSpannerSetStatus(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	repo := newSpannerTestRepository(client, "instance-a")
 
 	// Insert mock data into the Spanner test server
 	ctx := context.Background()
-	_, err := client.Apply(ctx, []*spanner.Mutation{
-		spanner.Insert("outbox", []string{"id", "status", "retry_count", "updated_at"}, []interface{}{"1", "pending", 0, time.Now()}),
-	})
-	assert.NoError(t, err)
+	insertSpannerTestEvent(t, client, "1", schema.StatusPending, 0)
+	leaseSpannerTestEvent(t, client, "1", "instance-a", time.Now().Add(time.Minute))
 
 	// Call SetStatus
-	err = repo.SetStatus(ctx, "1", schema.StatusProcessing)
+	err := repo.SetStatus(ctx, "1", schema.StatusProcessing)
 	assert.NoError(t, err)
 
 	// Verify the status was updated
@@ -75,24 +208,22 @@ func SpannerTestSetStatus(t *testing.T) {
 	var status string
 	err = row.Columns(&status)
 	assert.NoError(t, err)
-	assert.Equal(t, schema.StatusProcessing, status)
+	assert.Equal(t, string(schema.StatusProcessing), status)
 }
 
-func SpannerTestSetStatusAndIncrementRetry(t *testing.T) {
+func TestSpannerSetStatusAndIncrementRetry(t *testing.T) {
 	client, cleanup := setupSpannerTestServer(t)
 	defer cleanup()
 
-	repo := NewSpannerRepositoryFactory(client)
+	repo := newSpannerTestRepository(client, "instance-a")
 
 	// Insert mock data into the Spanner test server
 	ctx := context.Background()
-	_, err := client.Apply(ctx, []*spanner.Mutation{
-		spanner.Insert("outbox", []string{"id", "status", "retry_count", "updated_at"}, []interface{}{"1", "pending", 0, time.Now()}),
-	})
-	assert.NoError(t, err)
+	insertSpannerTestEvent(t, client, "1", schema.StatusPending, 0)
+	leaseSpannerTestEvent(t, client, "1", "instance-a", time.Now().Add(time.Minute))
 
 	// Call SetStatusAndIncrementRetry
-	err = repo.SetStatusAndIncrementRetry(ctx, "1", schema.StatusProcessing)
+	err := repo.SetStatusAndIncrementRetry(ctx, "1", schema.StatusProcessing)
 	assert.NoError(t, err)
 
 	// Verify the status and retry count were updated
@@ -109,25 +240,23 @@ func SpannerTestSetStatusAndIncrementRetry(t *testing.T) {
 	var retryCount int64
 	err = row.Columns(&status, &retryCount)
 	assert.NoError(t, err)
-	assert.Equal(t, schema.StatusProcessing, status)
+	assert.Equal(t, string(schema.StatusProcessing), status)
 	assert.Equal(t, int64(1), retryCount)
 }
 
-func SpannerTestIncrementRetryCount(t *testing.T) {
+func TestSpannerIncrementRetryCount(t *testing.T) {
 	client, cleanup := setupSpannerTestServer(t)
 	defer cleanup()
 
-	repo := NewSpannerRepositoryFactory(client)
+	repo := newSpannerTestRepository(client, "instance-a")
 
 	// Insert mock data into the Spanner test server
 	ctx := context.Background()
-	_, err := client.Apply(ctx, []*spanner.Mutation{
-		spanner.Insert("outbox", []string{"id", "status", "retry_count", "updated_at"}, []interface{}{"1", "pending", 0, time.Now()}),
-	})
-	assert.NoError(t, err)
+	insertSpannerTestEvent(t, client, "1", schema.StatusPending, 0)
+	leaseSpannerTestEvent(t, client, "1", "instance-a", time.Now().Add(time.Minute))
 
 	// Call IncrementRetryCount
-	err = repo.IncrementRetryCount(ctx, "1")
+	err := repo.IncrementRetryCount(ctx, "1")
 	assert.NoError(t, err)
 
 	// Verify the retry count was incremented
@@ -146,26 +275,24 @@ func SpannerTestIncrementRetryCount(t *testing.T) {
 	assert.Equal(t, int64(1), retryCount)
 }
 
-func SpannerTestMarkProcessed(t *testing.T) {
+func TestSpannerMarkProcessed(t *testing.T) {
 	client, cleanup := setupSpannerTestServer(t)
 	defer cleanup()
 
-	repo := NewSpannerRepositoryFactory(client)
+	repo := newSpannerTestRepository(client, "instance-a")
 
 	// Insert mock data into the Spanner test server
 	ctx := context.Background()
-	_, err := client.Apply(ctx, []*spanner.Mutation{
-		spanner.Insert("outbox", []string{"id", "status", "retry_count", "updated_at"}, []interface{}{"1", "pending", 0, time.Now()}),
-	})
-	assert.NoError(t, err)
+	insertSpannerTestEvent(t, client, "1", schema.StatusPending, 0)
+	leaseSpannerTestEvent(t, client, "1", "instance-a", time.Now().Add(time.Minute))
 
 	// Call MarkProcessed
-	err = repo.MarkProcessed(ctx, "1")
+	err := repo.MarkProcessed(ctx, "1", "msg-1")
 	assert.NoError(t, err)
 
-	// Verify the status was updated
+	// Verify the status, send time and message ID were updated
 	iter := client.Single().Query(ctx, spanner.Statement{
-		SQL:    `SELECT status FROM outbox WHERE id = @id`,
+		SQL:    `SELECT status, sent_at, message_id FROM outbox WHERE id = @id`,
 		Params: map[string]interface{}{"id": "1"},
 	})
 	defer iter.Stop()
@@ -174,7 +301,220 @@ func SpannerTestMarkProcessed(t *testing.T) {
 	assert.NoError(t, err)
 
 	var status string
-	err = row.Columns(&status)
+	var sentAt spanner.NullTime
+	var messageID spanner.NullString
+	err = row.Columns(&status, &sentAt, &messageID)
 	assert.NoError(t, err)
-	assert.Equal(t, schema.StatusSent, status)
+	assert.Equal(t, string(schema.StatusSent), status)
+	assert.WithinDuration(t, time.Now(), sentAt.Time, time.Minute)
+	assert.Equal(t, "msg-1", messageID.StringVal)
+}
+
+func TestSpannerUpdates_FailWhenTheLeaseIsHeldByAnotherInstance(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	repo := newSpannerTestRepository(client, "instance-a")
+	insertSpannerTestEvent(t, client, "1", schema.StatusProcessing, 0)
+	leaseSpannerTestEvent(t, client, "1", "instance-b", time.Now().Add(time.Minute))
+
+	ctx := context.Background()
+	assert.ErrorIs(t, repo.MarkProcessed(ctx, "1", ""), ErrLeaseLost)
+	assert.ErrorIs(t, repo.ScheduleRetry(ctx, "1", time.Now()), ErrLeaseLost)
+	assert.ErrorIs(t, repo.RenewLease(ctx, "1"), ErrLeaseLost)
+
+	status, lockedBy := readSpannerTestClaim(t, client, "1")
+	assert.Equal(t, string(schema.StatusProcessing), status)
+	assert.Equal(t, "instance-b", lockedBy.StringVal)
+}
+
+func TestSpannerRenewLease(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	repo := newSpannerTestRepository(client, "instance-a")
+	insertSpannerTestEvent(t, client, "1", schema.StatusProcessing, 0)
+	leaseSpannerTestEvent(t, client, "1", "instance-a", time.Now().Add(time.Second))
+
+	assert.NoError(t, repo.RenewLease(context.Background(), "1"))
+
+	row, err := client.Single().ReadRow(context.Background(), "outbox", spanner.Key{"1"}, []string{"locked_until"})
+	require.NoError(t, err)
+	var lockedUntil time.Time
+	require.NoError(t, row.Columns(&lockedUntil))
+	assert.WithinDuration(t, time.Now().Add(DefaultLeaseDuration), lockedUntil, time.Minute)
+}
+
+func TestSpannerMarkProcessedBatch(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	repo := newSpannerTestRepository(client, "instance-a")
+	for _, id := range []string{"1", "2", "3"} {
+		insertSpannerTestEvent(t, client, id, schema.StatusProcessing, 0)
+		leaseSpannerTestEvent(t, client, id, "instance-a", time.Now().Add(time.Minute))
+	}
+	leaseSpannerTestEvent(t, client, "3", "instance-b", time.Now().Add(time.Minute))
+
+	err := repo.MarkProcessedBatch(context.Background(), []SentEvent{
+		{EventID: "1", MessageID: "msg-1", SentAt: time.Now()},
+		{EventID: "2", SentAt: time.Now()},
+		{EventID: "3", MessageID: "msg-3", SentAt: time.Now()},
+	})
+	assert.ErrorIs(t, err, ErrLeaseLost)
+
+	// The events still leased to the instance are updated regardless.
+	for id, expected := range map[string]schema.Status{"1": schema.StatusSent, "2": schema.StatusSent, "3": schema.StatusProcessing} {
+		status, _ := readSpannerTestClaim(t, client, id)
+		assert.Equal(t, string(expected), status, id)
+	}
+
+	row, err := client.Single().ReadRow(context.Background(), "outbox", spanner.Key{"1"}, []string{"sent_at", "message_id"})
+	require.NoError(t, err)
+	var sentAt spanner.NullTime
+	var messageID spanner.NullString
+	require.NoError(t, row.Columns(&sentAt, &messageID))
+	assert.True(t, sentAt.Valid)
+	assert.Equal(t, "msg-1", messageID.StringVal)
+}
+
+func TestSpannerScheduleRetryBatch(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	repo := newSpannerTestRepository(client, "instance-a")
+	for _, id := range []string{"1", "2"} {
+		insertSpannerTestEvent(t, client, id, schema.StatusProcessing, 1)
+		leaseSpannerTestEvent(t, client, id, "instance-a", time.Now().Add(time.Minute))
+	}
+	nextAttempts := map[string]time.Time{
+		"1": time.Now().Add(time.Second).Truncate(time.Microsecond),
+		"2": time.Now().Add(time.Minute).Truncate(time.Microsecond),
+	}
+
+	err := repo.ScheduleRetryBatch(context.Background(), nextAttempts)
+	assert.NoError(t, err)
+
+	for id, nextAttemptAt := range nextAttempts {
+		row, err := client.Single().ReadRow(context.Background(), "outbox", spanner.Key{id},
+			[]string{"status", "retry_count", "next_attempt_at", "locked_by"})
+		require.NoError(t, err)
+
+		var status string
+		var retryCount int64
+		var storedAttempt time.Time
+		var lockedBy spanner.NullString
+		require.NoError(t, row.Columns(&status, &retryCount, &storedAttempt, &lockedBy))
+		assert.Equal(t, string(schema.StatusPending), status)
+		assert.Equal(t, int64(2), retryCount)
+		assert.True(t, nextAttemptAt.Equal(storedAttempt), id)
+		assert.False(t, lockedBy.Valid)
+	}
+}
+
+func TestSpannerRecordAttempts(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	repo := NewSpannerRepositoryFactory(client, config.DbSettings{InstanceID: "instance-a", RecordAttempts: true}, nil)
+	insertSpannerTestEvent(t, client, "1", schema.StatusProcessing, 0)
+	first, second := time.Now().Add(-time.Second), time.Now()
+
+	err := repo.RecordAttempts(context.Background(), []schema.EventAttempt{
+		{EventID: "1", AttemptedAt: first, Broker: "gcp-pubsub", Error: "nack"},
+		{EventID: "1", AttemptedAt: second, Broker: "gcp-pubsub"},
+		{EventID: "deleted", AttemptedAt: second, Broker: "gcp-pubsub", Error: "nack"},
+	})
+	assert.NoError(t, err)
+
+	row, err := client.Single().ReadRow(context.Background(), "outbox", spanner.Key{"1"}, []string{"last_error"})
+	require.NoError(t, err)
+	var lastError spanner.NullString
+	require.NoError(t, row.Columns(&lastError))
+	assert.Equal(t, "nack", lastError.StringVal)
+
+	var attempts []schema.EventAttempt
+	err = client.Single().Read(context.Background(), "outbox_event_attempts", spanner.AllKeys(),
+		[]string{"event_id", "attempted_at", "instance_id", "broker", "error"}).Do(func(row *spanner.Row) error {
+		var attempt schema.EventAttempt
+		var attemptError spanner.NullString
+		if err := row.Columns(&attempt.EventID, &attempt.AttemptedAt, &attempt.InstanceID, &attempt.Broker, &attemptError); err != nil {
+			return err
+		}
+		attempt.Error = attemptError.StringVal
+		attempts = append(attempts, attempt)
+		return nil
+	})
+	require.NoError(t, err)
+	if assert.Len(t, attempts, 2) {
+		assert.Equal(t, "instance-a", attempts[0].InstanceID)
+		assert.Equal(t, "nack", attempts[0].Error)
+		assert.WithinDuration(t, second, attempts[1].AttemptedAt, time.Microsecond)
+		assert.False(t, attempts[1].Failed())
+	}
+}
+
+func TestSpannerPurge(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("archive=%t", archive), func(t *testing.T) {
+			client, cleanup := setupSpannerTestServer(t)
+			defer cleanup()
+
+			repo := NewSpannerRepositoryFactory(client, config.DbSettings{RecordAttempts: true}, nil)
+			ctx := context.Background()
+			for _, id := range []string{"1", "2", "3"} {
+				insertSpannerTestEvent(t, client, id, schema.StatusSent, 0)
+			}
+			insertSpannerTestEvent(t, client, "4", schema.StatusPending, 0)
+			require.NoError(t, repo.RecordAttempts(ctx, []schema.EventAttempt{{EventID: "1", AttemptedAt: time.Now(), Broker: "gcp-pubsub"}}))
+
+			// Two batches purge the sent events; the pending one is kept.
+			purged, err := repo.Purge(ctx, schema.StatusSent, time.Now().Add(time.Second), 2, archive)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, purged)
+			purged, err = repo.Purge(ctx, schema.StatusSent, time.Now().Add(time.Second), 2, archive)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, purged)
+
+			assert.Equal(t, []string{"4"}, readSpannerTestIDs(t, client, "outbox"))
+			assert.Empty(t, readSpannerTestIDs(t, client, "outbox_event_attempts"))
+			if archive {
+				assert.Equal(t, []string{"1", "2", "3"}, readSpannerTestIDs(t, client, "outbox_archive"))
+			} else {
+				assert.Empty(t, readSpannerTestIDs(t, client, "outbox_archive"))
+			}
+		})
+	}
+}
+
+func TestSpannerPurge_KeepsRecentEvents(t *testing.T) {
+	client, cleanup := setupSpannerTestServer(t)
+	defer cleanup()
+
+	repo := newSpannerTestRepository(client, "instance-a")
+	insertSpannerTestEvent(t, client, "1", schema.StatusSent, 0)
+
+	purged, err := repo.Purge(context.Background(), schema.StatusSent, time.Now().Add(-time.Hour), 10, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, purged)
+	assert.Equal(t, []string{"1"}, readSpannerTestIDs(t, client, "outbox"))
+}
+
+// readSpannerTestIDs returns the first key column of every row in table.
+func readSpannerTestIDs(t *testing.T, client *spanner.Client, table string) []string {
+	column := "id"
+	if table == "outbox_event_attempts" {
+		column = "event_id"
+	}
+	var ids []string
+	err := client.Single().Read(context.Background(), table, spanner.AllKeys(), []string{column}).Do(func(row *spanner.Row) error {
+		var id string
+		if err := row.Columns(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	require.NoError(t, err)
+	return ids
 }
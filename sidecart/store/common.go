@@ -1,19 +1,100 @@
 package store
 
 import (
+	"errors"
+	"os"
+	"sort"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/zoff-tech/go-outbox/schema"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
-const lockExpiration = 5 * time.Minute
-const maxRetries = 3
+// DefaultLeaseDuration is how long a claim lasts unless it is renewed. Once it expires,
+// another instance may claim the event.
+const DefaultLeaseDuration = 5 * time.Minute
 
-func addDBStatsToSpan(span trace.Span, statement string, eventsCount int, duration time.Duration) {
+// ErrLeaseLost is returned by status updates when the calling instance no longer holds the
+// lease of the event: it expired and the event was claimed by another instance.
+var ErrLeaseLost = errors.New("lease lost: the event is claimed by another instance")
+
+// resolveLeaseDuration returns the configured lease duration, or DefaultLeaseDuration.
+func resolveLeaseDuration(configured time.Duration) time.Duration {
+	if configured > 0 {
+		return configured
+	}
+	return DefaultLeaseDuration
+}
+
+// resolveInstanceID returns the configured instance ID. It defaults to the host name,
+// which is unique per pod, and falls back to a random ID when that is unavailable.
+func resolveInstanceID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return uuid.NewString()
+}
+
+// sortedRetries splits the next attempts of ScheduleRetryBatch into parallel slices ordered by event ID.
+func sortedRetries(nextAttempts map[string]time.Time) ([]string, []time.Time) {
+	ids := make([]string, 0, len(nextAttempts))
+	for id := range nextAttempts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	times := make([]time.Time, len(ids))
+	for i, id := range ids {
+		times[i] = nextAttempts[id]
+	}
+	return ids, times
+}
+
+// attributeAttempts returns attempts with the ones that carry no instance ID attributed
+// to instanceID, and the IDs and last errors of the events that have a failed attempt,
+// sorted by ID.
+func attributeAttempts(attempts []schema.EventAttempt, instanceID string) ([]schema.EventAttempt, []string, []string) {
+	attributed := make([]schema.EventAttempt, len(attempts))
+	lastErrors := make(map[string]string)
+	for i, attempt := range attempts {
+		if attempt.InstanceID == "" {
+			attempt.InstanceID = instanceID
+		}
+		attributed[i] = attempt
+		if attempt.Failed() {
+			lastErrors[attempt.EventID] = attempt.Error
+		}
+	}
+
+	failedIDs := make([]string, 0, len(lastErrors))
+	for id := range lastErrors {
+		failedIDs = append(failedIDs, id)
+	}
+	sort.Strings(failedIDs)
+	errs := make([]string, len(failedIDs))
+	for i, id := range failedIDs {
+		errs[i] = lastErrors[id]
+	}
+	return attributed, failedIDs, errs
+}
+
+// Values of the db.system span attribute, as defined by the OpenTelemetry semantic conventions.
+const (
+	dbSystemPostgreSQL = "postgresql"
+	dbSystemMySQL      = "mysql"
+	dbSystemSQLite     = "sqlite"
+	dbSystemMongoDB    = "mongodb"
+)
+
+func addDBStatsToSpan(span trace.Span, dbSystem, statement string, eventsCount int, duration time.Duration) {
 	span.SetAttributes(
 		attribute.Int("eventsCount", eventsCount),
-		attribute.String("db.system", "postgresql"),
+		attribute.String("db.system", dbSystem),
 		attribute.String("db.statement", statement),
 		attribute.Float64("db.execution_time_ms", float64(duration.Milliseconds())),
 	)
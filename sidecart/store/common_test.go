@@ -0,0 +1,36 @@
+package store
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans records the spans ended during the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+// spanAttribute returns the value of the attribute key of the last span named name.
+func spanAttribute(recorder *tracetest.SpanRecorder, name string, key attribute.Key) string {
+	spans := recorder.Ended()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name() != name {
+			continue
+		}
+		for _, kv := range spans[i].Attributes() {
+			if kv.Key == key {
+				return kv.Value.Emit()
+			}
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"github.com/zoff-tech/go-outbox/store"
+	"github.com/zoff-tech/go-outbox/store/storetest"
+)
+
+// Every repository runs the conformance suite of storetest. The Postgres, MySQL and MongoDB
+// runs are skipped unless their OUTBOX_TEST_* variable points at a database.
+
+// sqlHarness returns a harness inserting into the outbox_events table of db. query is the
+// INSERT statement taking id, entity, entity_type, payload, status, created_at, updated_at,
+// headers, retry_count and routing_key, in that order.
+func sqlHarness(db *sql.DB, query string, newRepository func(instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository) storetest.Harness {
+	return storetest.Harness{
+		NewRepository: func(t *testing.T, instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository {
+			return newRepository(instanceID, leaseDuration, retryPolicy)
+		},
+		Insert: func(t *testing.T, events ...schema.OutboxEvent) {
+			for _, event := range events {
+				var headers interface{}
+				if event.Headers != nil {
+					encoded, err := json.Marshal(event.Headers)
+					require.NoError(t, err)
+					headers = string(encoded)
+				}
+				_, err := db.Exec(query, event.ID, event.Entity, event.EntityType, event.Payload, string(event.Status),
+					event.CreatedAt, event.UpdatedAt, headers, event.RetryCount, event.RoutingKey)
+				require.NoError(t, err)
+			}
+		},
+	}
+}
+
+func TestPostgresRepository_Conformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) storetest.Harness {
+		db, _ := store.OpenPostgresTestDB(t)
+		return sqlHarness(db,
+			`INSERT INTO outbox_events (id, entity, entity_type, payload, status, created_at, updated_at, headers, retry_count, routing_key)
+             VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			func(instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository {
+				return &store.PostgresRepository{Db: db, RetryPolicy: retryPolicy, InstanceID: instanceID, LeaseDuration: leaseDuration}
+			})
+	})
+}
+
+func TestMySQLRepository_Conformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) storetest.Harness {
+		db := store.OpenMySQLTestDB(t)
+		return sqlHarness(db,
+			`INSERT INTO outbox_events (id, entity, entity_type, payload, status, created_at, updated_at, headers, retry_count, routing_key)
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			func(instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository {
+				return &store.MySQLRepository{Db: db, RetryPolicy: retryPolicy, InstanceID: instanceID, LeaseDuration: leaseDuration}
+			})
+	})
+}
+
+func TestSQLiteRepository_Conformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) storetest.Harness {
+		db := store.OpenSQLiteTestDB(t)
+		harness := sqlHarness(db,
+			`INSERT INTO outbox_events (id, entity, entity_type, payload, status, created_at, updated_at, headers, retry_count, routing_key)
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			func(instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository {
+				return &store.SQLiteRepository{Db: db, RetryPolicy: retryPolicy, InstanceID: instanceID, LeaseDuration: leaseDuration}
+			})
+		// The repository compares timestamps as UTC text, so the application writes UTC.
+		insert := harness.Insert
+		harness.Insert = func(t *testing.T, events ...schema.OutboxEvent) {
+			for i := range events {
+				events[i].CreatedAt, events[i].UpdatedAt = events[i].CreatedAt.UTC(), events[i].UpdatedAt.UTC()
+			}
+			insert(t, events...)
+		}
+		return harness
+	})
+}
+
+func TestSpannerRepository_Conformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) storetest.Harness {
+		client, cleanup := store.SetupSpannerTestServer(t)
+		t.Cleanup(cleanup)
+		return storetest.Harness{
+			NewRepository: func(t *testing.T, instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository {
+				return store.NewSpannerRepositoryFactory(client, config.DbSettings{InstanceID: instanceID, LeaseDuration: leaseDuration}, retryPolicy)
+			},
+			Insert: func(t *testing.T, events ...schema.OutboxEvent) {
+				var mutations []*spanner.Mutation
+				for _, event := range events {
+					headers := spanner.NullString{}
+					if event.Headers != nil {
+						encoded, err := json.Marshal(event.Headers)
+						require.NoError(t, err)
+						headers = spanner.NullString{StringVal: string(encoded), Valid: true}
+					}
+					mutations = append(mutations, spanner.Insert("outbox",
+						[]string{"id", "entity", "entity_type", "payload", "status", "created_at", "updated_at", "headers", "retry_count", "routing_key"},
+						[]interface{}{event.ID, event.Entity, event.EntityType, event.Payload, string(event.Status), event.CreatedAt, event.UpdatedAt, headers, event.RetryCount, event.RoutingKey}))
+				}
+				_, err := client.Apply(context.Background(), mutations)
+				require.NoError(t, err)
+			},
+		}
+	})
+}
+
+func TestMongoRepository_Conformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) storetest.Harness {
+		client, database := store.ConnectMongoTestClient(t)
+		require.NoError(t, store.NewMongoRepository(client, config.DbSettings{DBName: database}, nil).EnsureIndexes(context.Background()))
+		return storetest.Harness{
+			NewRepository: func(t *testing.T, instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository {
+				return store.NewMongoRepository(client, config.DbSettings{DBName: database, InstanceID: instanceID, LeaseDuration: leaseDuration}, retryPolicy)
+			},
+			Insert: func(t *testing.T, events ...schema.OutboxEvent) {
+				documents := make([]interface{}, len(events))
+				for i, event := range events {
+					documents[i] = event
+				}
+				_, err := client.Database(database).Collection("outbox_events").InsertMany(context.Background(), documents)
+				require.NoError(t, err)
+			},
+		}
+	})
+}
@@ -0,0 +1,10 @@
+package store
+
+// Test helpers of the backends, shared with the conformance tests in package store_test.
+var (
+	OpenPostgresTestDB     = openPostgresTestDB
+	OpenMySQLTestDB        = openMySQLTestDB
+	OpenSQLiteTestDB       = openSQLiteTestDB
+	SetupSpannerTestServer = setupSpannerTestServer
+	ConnectMongoTestClient = connectMongoTestClient
+)
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// resumeTokenCollection stores the change-stream resume token of every outbox collection
+	// and sidecar instance.
+	resumeTokenCollection = "outbox_resume_tokens"
+	// resumeTokenSaveInterval limits how often the resume token is written back.
+	resumeTokenSaveInterval = time.Second
+	watchRetryInterval      = 5 * time.Second
+
+	// Server error codes returned when change streams cannot be used.
+	errCodeChangeStreamUnsupported = 40573 // $changeStream is only supported on replica sets
+	errCodeChangeStreamHistoryLost = 286   // the resume token is no longer in the oplog
+)
+
+// Watch opens a change stream on the outbox collection and wakes the processor whenever
+// events are inserted. The resume token of the last seen change is persisted in the
+// outbox_resume_tokens collection, so a restarted sidecar resumes where it stopped. Each
+// instance keeps its own token: replicas watch independently and must not move each
+// other's position.
+// Deployments without change streams (a standalone server rather than a replica set)
+// fall back to polling. Watching stops when ctx is done or the repository is closed.
+func (m *MongoRepository) Watch(ctx context.Context) {
+	ctx, m.stopWatching = context.WithCancel(ctx)
+	m.notifications = make(chan struct{}, 1)
+
+	go func() {
+		for {
+			err := m.watch(ctx)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case isChangeStreamUnsupported(err):
+				log.Printf("MongoDB change streams are not supported by this deployment, falling back to polling: %v", err)
+				return
+			case isChangeStreamHistoryLost(err):
+				log.Printf("MongoDB resume token is no longer available, watching from now on: %v", err)
+				if err := m.deleteResumeToken(ctx); err != nil {
+					log.Printf("Failed to delete MongoDB resume token: %v", err)
+				}
+				// Events inserted since the lost token are still pending, fetch them now.
+				wake(m.notifications)
+				continue
+			case err != nil:
+				log.Printf("MongoDB change stream failed, retrying in %s: %v", watchRetryInterval, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryInterval):
+			}
+		}
+	}()
+}
+
+// Notifications implements Notifier. It returns nil unless Watch was called.
+func (m *MongoRepository) Notifications() <-chan struct{} {
+	return m.notifications
+}
+
+// watch consumes the change stream until it fails or ctx is done.
+func (m *MongoRepository) watch(ctx context.Context) error {
+	token, err := m.loadResumeToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	opts := options.ChangeStream()
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}}
+
+	stream, err := m.events().Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.WithoutCancel(ctx))
+
+	var lastSaved time.Time
+	for stream.Next(ctx) {
+		wake(m.notifications)
+
+		if time.Since(lastSaved) >= resumeTokenSaveInterval {
+			if err := m.saveResumeToken(ctx, stream.ResumeToken()); err != nil {
+				log.Printf("Failed to save MongoDB resume token: %v", err)
+			} else {
+				lastSaved = time.Now()
+			}
+		}
+	}
+
+	// Persist the latest position so that a restart does not replay changes.
+	if token := stream.ResumeToken(); token != nil {
+		if err := m.saveResumeToken(context.WithoutCancel(ctx), token); err != nil {
+			log.Printf("Failed to save MongoDB resume token: %v", err)
+		}
+	}
+	return stream.Err()
+}
+
+func (m *MongoRepository) resumeTokens() *mongo.Collection {
+	return m.client.Database(m.database).Collection(resumeTokenCollection)
+}
+
+// resumeTokenID identifies the resume token of this instance's change stream on the outbox
+// collection.
+func (m *MongoRepository) resumeTokenID() bson.D {
+	return bson.D{{Key: "collection", Value: m.collection}, {Key: "instance_id", Value: m.instanceID}}
+}
+
+func (m *MongoRepository) loadResumeToken(ctx context.Context) (bson.Raw, error) {
+	var document struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := m.resumeTokens().FindOne(ctx, bson.M{"_id": m.resumeTokenID()}).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return document.Token, err
+}
+
+func (m *MongoRepository) saveResumeToken(ctx context.Context, token bson.Raw) error {
+	_, err := m.resumeTokens().UpdateOne(ctx,
+		bson.M{"_id": m.resumeTokenID()},
+		bson.M{"$set": bson.M{"token": token, "updated_at": time.Now()}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *MongoRepository) deleteResumeToken(ctx context.Context) error {
+	_, err := m.resumeTokens().DeleteOne(ctx, bson.M{"_id": m.resumeTokenID()})
+	return err
+}
+
+func isChangeStreamUnsupported(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(errCodeChangeStreamUnsupported)
+}
+
+func isChangeStreamHistoryLost(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(errCodeChangeStreamHistoryLost)
+}
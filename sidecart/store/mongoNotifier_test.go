@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// connectMongoTestClient connects to the deployment in OUTBOX_TEST_MONGO_URI and returns a
+// freshly named database for the test. The test is skipped when the variable is not set.
+// Change streams require a replica set, e.g. a single-node one started with
+// `mongod --replSet rs0` followed by `rs.initiate()`.
+func connectMongoTestClient(t testing.TB) (*mongo.Client, string) {
+	uri := os.Getenv("OUTBOX_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("OUTBOX_TEST_MONGO_URI is not set, skipping MongoDB integration test")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	require.NoError(t, err)
+
+	database := fmt.Sprintf("outbox_test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		client.Database(database).Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return client, database
+}
+
+func TestMongoRepository_WatchWakesOnInsert(t *testing.T) {
+	client, database := connectMongoTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo := NewMongoRepository(client, config.DbSettings{DBName: database}, nil)
+	repo.Watch(ctx)
+
+	// Watch opens the change stream in the background, so keep inserting until it reports.
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		_, err := client.Database(database).Collection("outbox_events").InsertOne(ctx, bson.M{
+			"id":         fmt.Sprintf("watch-%d", i),
+			"status":     "pending",
+			"created_at": time.Now(),
+			"updated_at": time.Now(),
+		})
+		require.NoError(t, err)
+
+		select {
+		case <-repo.Notifications():
+			cancel()
+			assert.Eventually(t, func() bool {
+				token, err := repo.loadResumeToken(context.Background())
+				return err == nil && token != nil
+			}, 5*time.Second, 50*time.Millisecond, "resume token was not persisted")
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	t.Fatal("no notification received after inserting outbox events")
+}
+
+func TestMongoRepository_ResumeTokensArePerInstance(t *testing.T) {
+	client, database := connectMongoTestClient(t)
+	ctx := context.Background()
+
+	a := NewMongoRepository(client, config.DbSettings{DBName: database, InstanceID: "instance-a"}, nil)
+	b := NewMongoRepository(client, config.DbSettings{DBName: database, InstanceID: "instance-b"}, nil)
+	token, err := bson.Marshal(bson.D{{Key: "_data", Value: "8265"}})
+	require.NoError(t, err)
+	require.NoError(t, a.saveResumeToken(ctx, token))
+
+	loaded, err := b.loadResumeToken(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, loaded, "instance-b must not resume from the token of instance-a")
+
+	require.NoError(t, b.deleteResumeToken(ctx))
+	loaded, err = a.loadResumeToken(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw(token), loaded)
+}
+
+func TestMongoRepository_NotificationsDisabledByDefault(t *testing.T) {
+	repo := NewMongoRepository(nil, config.DbSettings{DBName: "db"}, nil)
+	assert.Nil(t, repo.Notifications())
+}
+
+func TestIsChangeStreamUnsupported(t *testing.T) {
+	standalone := mongo.CommandError{Code: 40573, Message: "The $changeStream stage is only supported on replica sets"}
+
+	assert.True(t, isChangeStreamUnsupported(standalone))
+	assert.True(t, isChangeStreamUnsupported(fmt.Errorf("watch: %w", standalone)))
+	assert.False(t, isChangeStreamUnsupported(mongo.CommandError{Code: 286}))
+	assert.False(t, isChangeStreamUnsupported(errors.New("connection refused")))
+	assert.True(t, isChangeStreamHistoryLost(mongo.CommandError{Code: 286}))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/zoff-tech/go-outbox/config"
 	"github.com/zoff-tech/go-outbox/schema"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -12,19 +13,68 @@ import (
 )
 
 type MongoRepository struct {
-	client     *mongo.Client
-	database   string
-	collection string
+	client        *mongo.Client
+	database      string
+	collection    string
+	retryPolicy   *config.RetryPolicy
+	instanceID    string
+	leaseDuration time.Duration
+	// attemptHistory keeps every publish attempt in the outbox_event_attempts collection.
+	attemptHistory bool
+
+	notifications chan struct{}
+	stopWatching  context.CancelFunc
 }
 
-func NewMongoRepository(client *mongo.Client, database, collection string) *MongoRepository {
+// NewMongoRepository creates a repository on the collection in cfg (default "outbox_events")
+// of database cfg.DBName.
+func NewMongoRepository(client *mongo.Client, cfg config.DbSettings, retryPolicy *config.RetryPolicy) *MongoRepository {
+	collection := cfg.Collection
+	if collection == "" {
+		collection = defaultMongoCollection
+	}
 	return &MongoRepository{
-		client:     client,
-		database:   database,
-		collection: collection,
+		client:         client,
+		database:       cfg.DBName,
+		collection:     collection,
+		retryPolicy:    retryPolicy,
+		instanceID:     resolveInstanceID(cfg.InstanceID),
+		leaseDuration:  resolveLeaseDuration(cfg.LeaseDuration),
+		attemptHistory: cfg.RecordAttempts,
 	}
 }
 
+// EnsureIndexes creates the indexes the repository relies on: a unique index on the
+// event ID used by status updates, and compound indexes serving the due-event and
+// expired-lease lookups of FetchPending and the lookup of purged events. With attempt
+// history enabled, it also indexes the attempts by event.
+func (m *MongoRepository) EnsureIndexes(ctx context.Context) error {
+	if m.attemptHistory {
+		if _, err := m.attempts().Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "event_id", Value: 1}, {Key: "attempted_at", Value: 1}},
+		}); err != nil {
+			return err
+		}
+	}
+
+	_, err := m.events().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "locked_until", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}},
+		},
+	})
+	return err
+}
+
 func (m *MongoRepository) FetchPending(ctx context.Context, batchSize int) ([]schema.OutboxEvent, error) {
 	tracer := otel.Tracer("go-outbox")
 	ctx, span := tracer.Start(ctx, "FetchPending")
@@ -32,15 +82,8 @@ func (m *MongoRepository) FetchPending(ctx context.Context, batchSize int) ([]sc
 
 	startTime := time.Now()
 
-	collection := m.client.Database(m.database).Collection(m.collection)
-	filter := bson.M{
-		"$or": []bson.M{
-			{"status": schema.StatusPending},
-			{"status": schema.StatusProcessing, "updated_at": bson.M{"$lt": time.Now().Add(-lockExpiration)}},
-		},
-	}
-	opts := options.Find().SetLimit(int64(batchSize)).SetSort(bson.D{{Key: "updated_at", Value: 1}})
-	cursor, err := collection.Find(ctx, filter, opts)
+	opts := options.Find().SetLimit(int64(batchSize)).SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := m.events().Find(ctx, claimableFilter(time.Now()), opts)
 	if err != nil {
 		span.RecordError(err)
 		return nil, err
@@ -62,76 +105,367 @@ func (m *MongoRepository) FetchPending(ctx context.Context, batchSize int) ([]sc
 		return nil, err
 	}
 
-	// Update status and updated_at for fetched events
+	// Claim the fetched events. The claim only matches events that are still claimable, so
+	// an event found by several instances at once is claimed by one of them. Events already
+	// retried beyond their limit (possible after the limit was lowered) are marked failed
+	// and not returned.
+	var candidateIDs, exceededIDs []string
 	for _, event := range events {
-		if event.RetryCount >= maxRetries {
-			if err := m.SetStatus(ctx, event.ID, schema.StatusFailed); err != nil {
-				return nil, err
-			}
-		} else {
-			if err := m.SetStatusAndIncrementRetry(ctx, event.ID, schema.StatusProcessing); err != nil {
-				return nil, err
-			}
+		if event.RetryCount > m.retryPolicy.MaxRetriesFor(event.Entity) {
+			exceededIDs = append(exceededIDs, event.ID)
+			continue
 		}
+		candidateIDs = append(candidateIDs, event.ID)
 	}
 
-	addDBStatsToSpan(span, "FetchPending", len(events), time.Since(startTime))
+	now := time.Now()
+	if len(exceededIDs) > 0 {
+		filter := claimableFilter(now)
+		filter["id"] = bson.M{"$in": exceededIDs}
+		update := bson.M{
+			"$set":   bson.M{"status": schema.StatusFailed, "updated_at": now},
+			"$unset": bson.M{"locked_by": "", "locked_until": ""},
+		}
+		if _, err := m.events().UpdateMany(ctx, filter, update); err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+	}
 
-	return events, nil
+	claimed, err := m.claim(ctx, events, candidateIDs, now)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	addDBStatsToSpan(span, dbSystemMongoDB, "FetchPending", len(claimed), time.Since(startTime))
+
+	return claimed, nil
 }
 
-func (m *MongoRepository) MarkProcessed(ctx context.Context, eventID string) error {
+// claim leases the candidate events to this instance and returns those it obtained. The
+// lease expiry written by this claim identifies them among the candidates.
+func (m *MongoRepository) claim(ctx context.Context, events []schema.OutboxEvent, candidateIDs []string, now time.Time) ([]schema.OutboxEvent, error) {
+	if len(candidateIDs) == 0 {
+		return nil, nil
+	}
+
+	// MongoDB stores dates with millisecond precision.
+	lockedUntil := now.Add(m.leaseDuration).Truncate(time.Millisecond)
+	filter := claimableFilter(now)
+	filter["id"] = bson.M{"$in": candidateIDs}
+	update := bson.M{"$set": bson.M{
+		"status":       schema.StatusProcessing,
+		"locked_by":    m.instanceID,
+		"locked_until": lockedUntil,
+		"updated_at":   now,
+	}}
+	if _, err := m.events().UpdateMany(ctx, filter, update); err != nil {
+		return nil, err
+	}
+
+	cursor, err := m.events().Find(ctx,
+		bson.M{"id": bson.M{"$in": candidateIDs}, "locked_by": m.instanceID, "locked_until": lockedUntil},
+		options.Find().SetProjection(bson.M{"id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var documents []struct {
+		ID string `bson:"id"`
+	}
+	if err := cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+
+	obtained := make(map[string]bool, len(documents))
+	for _, document := range documents {
+		obtained[document.ID] = true
+	}
+	var claimed []schema.OutboxEvent
+	for _, event := range events {
+		if obtained[event.ID] {
+			claimed = append(claimed, event)
+		}
+	}
+	return claimed, nil
+}
+
+// claimableFilter matches events that are due, or whose lease has expired.
+func claimableFilter(now time.Time) bson.M {
+	return bson.M{
+		"$or": []bson.M{
+			{"status": schema.StatusPending, "$or": []bson.M{
+				{"next_attempt_at": nil},
+				{"next_attempt_at": bson.M{"$lte": now}},
+			}},
+			{"status": schema.StatusProcessing, "$or": []bson.M{
+				{"locked_until": nil},
+				{"locked_until": bson.M{"$lt": now}},
+			}},
+		},
+	}
+}
+
+func (m *MongoRepository) MarkProcessed(ctx context.Context, eventID, messageID string) error {
 	tracer := otel.Tracer("go-outbox")
 	ctx, span := tracer.Start(ctx, "MarkProcessed")
 	defer span.End()
 
 	startTime := time.Now()
-	if err := m.SetStatus(ctx, eventID, schema.StatusSent); err != nil {
+	if err := m.updateOwned(ctx, eventID, sentUpdate(messageID, startTime, startTime)); err != nil {
 		span.RecordError(err)
 		return err
 	}
 
-	addDBStatsToSpan(span, "MarkProcessed", 1, time.Since(startTime))
+	addDBStatsToSpan(span, dbSystemMongoDB, "MarkProcessed", 1, time.Since(startTime))
+
+	return nil
+}
+
+func (m *MongoRepository) MarkProcessedBatch(ctx context.Context, sent []SentEvent) error {
+	now := time.Now()
+	models := make([]mongo.WriteModel, len(sent))
+	for i, event := range sent {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"id": event.EventID, "locked_by": m.instanceID}).
+			SetUpdate(sentUpdate(event.MessageID, event.SentAt, now))
+	}
 
+	result, err := m.events().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount < int64(len(sent)) {
+		return ErrLeaseLost
+	}
 	return nil
 }
 
+// sentUpdate marks an event sent at sentAt as the broker message messageID and releases its lease.
+func sentUpdate(messageID string, sentAt, now time.Time) bson.M {
+	set := bson.M{
+		"status":     schema.StatusSent,
+		"sent_at":    sentAt,
+		"updated_at": now,
+	}
+	if messageID != "" {
+		set["message_id"] = messageID
+	}
+	return bson.M{
+		"$set":   set,
+		"$unset": bson.M{"locked_by": "", "locked_until": ""},
+	}
+}
+
+// SetStatus sets the status of an event claimed by this instance and releases its lease.
 func (m *MongoRepository) SetStatus(ctx context.Context, eventID string, status schema.Status) error {
-	collection := m.client.Database(m.database).Collection(m.collection)
-	filter := bson.M{"id": eventID}
 	update := bson.M{
 		"$set": bson.M{
 			"status":     status,
 			"updated_at": time.Now(),
 		},
+		"$unset": bson.M{"locked_by": "", "locked_until": ""},
 	}
-	_, err := collection.UpdateOne(ctx, filter, update)
-	return err
+	return m.updateOwned(ctx, eventID, update)
 }
 
 func (m *MongoRepository) SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error {
-	collection := m.client.Database(m.database).Collection(m.collection)
-	filter := bson.M{"id": eventID}
 	update := bson.M{
 		"$set": bson.M{
 			"status":     status,
 			"updated_at": time.Now(),
 		},
-		"$inc": bson.M{"retry_count": 1},
+		"$unset": bson.M{"locked_by": "", "locked_until": ""},
+		"$inc":   bson.M{"retry_count": 1},
 	}
-	_, err := collection.UpdateOne(ctx, filter, update)
-	return err
+	return m.updateOwned(ctx, eventID, update)
+}
+
+func (m *MongoRepository) ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) error {
+	update := bson.M{
+		"$set": bson.M{
+			"status":          schema.StatusPending,
+			"next_attempt_at": nextAttemptAt,
+			"updated_at":      time.Now(),
+		},
+		"$unset": bson.M{"locked_by": "", "locked_until": ""},
+		"$inc":   bson.M{"retry_count": 1},
+	}
+	return m.updateOwned(ctx, eventID, update)
+}
+
+func (m *MongoRepository) ScheduleRetryBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return m.deferBatch(ctx, nextAttempts, 1)
+}
+
+func (m *MongoRepository) DeferBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return m.deferBatch(ctx, nextAttempts, 0)
+}
+
+// deferBatch sets the events back to pending until their next attempts, adding retries to
+// their retry counts.
+func (m *MongoRepository) deferBatch(ctx context.Context, nextAttempts map[string]time.Time, retries int) error {
+	ids, times := sortedRetries(nextAttempts)
+	now := time.Now()
+	models := make([]mongo.WriteModel, len(ids))
+	for i, id := range ids {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"id": id, "locked_by": m.instanceID}).
+			SetUpdate(bson.M{
+				"$set": bson.M{
+					"status":          schema.StatusPending,
+					"next_attempt_at": times[i],
+					"updated_at":      now,
+				},
+				"$unset": bson.M{"locked_by": "", "locked_until": ""},
+				"$inc":   bson.M{"retry_count": retries},
+			})
+	}
+
+	result, err := m.events().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount < int64(len(ids)) {
+		return ErrLeaseLost
+	}
+	return nil
 }
 
 func (m *MongoRepository) IncrementRetryCount(ctx context.Context, eventID string) error {
-	collection := m.client.Database(m.database).Collection(m.collection)
-	filter := bson.M{"id": eventID}
 	update := bson.M{
 		"$set": bson.M{
 			"updated_at": time.Now(),
 		},
 		"$inc": bson.M{"retry_count": 1},
 	}
-	_, err := collection.UpdateOne(ctx, filter, update)
+	return m.updateOwned(ctx, eventID, update)
+}
+
+func (m *MongoRepository) RenewLease(ctx context.Context, eventID string) error {
+	now := time.Now()
+	filter := bson.M{"id": eventID, "status": schema.StatusProcessing, "locked_by": m.instanceID}
+	update := bson.M{
+		"$set": bson.M{
+			"locked_until": now.Add(m.leaseDuration),
+			"updated_at":   now,
+		},
+	}
+	result, err := m.events().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (m *MongoRepository) RecordAttempts(ctx context.Context, attempts []schema.EventAttempt) error {
+	attempts, failedIDs, lastErrors := attributeAttempts(attempts, m.instanceID)
+	if len(failedIDs) > 0 {
+		models := make([]mongo.WriteModel, len(failedIDs))
+		for i, id := range failedIDs {
+			models[i] = mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"id": id}).
+				SetUpdate(bson.M{"$set": bson.M{"last_error": lastErrors[i]}})
+		}
+		if _, err := m.events().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+	}
+	if !m.attemptHistory || len(attempts) == 0 {
+		return nil
+	}
+
+	documents := make([]interface{}, len(attempts))
+	for i, attempt := range attempts {
+		documents[i] = attempt
+	}
+	_, err := m.attempts().InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
 	return err
 }
+
+// Purge finds the oldest matching events and deletes them. With archive set, the events are
+// first upserted into the archive collection, so a purge interrupted between the two steps
+// is completed by the next one without duplicating archived events.
+func (m *MongoRepository) Purge(ctx context.Context, status schema.Status, before time.Time, limit int, archive bool) (int, error) {
+	filter := bson.M{"status": status, "updated_at": bson.M{"$lt": before}}
+	opts := options.Find().SetLimit(int64(limit)).SetSort(bson.D{{Key: "updated_at", Value: 1}})
+	if !archive {
+		opts.SetProjection(bson.M{"id": 1})
+	}
+	cursor, err := m.events().Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	var documents []bson.M
+	if err := cursor.All(ctx, &documents); err != nil {
+		return 0, err
+	}
+	if len(documents) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]interface{}, len(documents))
+	for i, document := range documents {
+		ids[i] = document["id"]
+	}
+	if archive {
+		models := make([]mongo.WriteModel, len(documents))
+		for i, document := range documents {
+			delete(document, "_id")
+			models[i] = mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"id": document["id"]}).
+				SetReplacement(document).
+				SetUpsert(true)
+		}
+		if _, err := m.archive().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return 0, err
+		}
+	}
+
+	filter["id"] = bson.M{"$in": ids}
+	result, err := m.events().DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if m.attemptHistory {
+		if _, err := m.attempts().DeleteMany(ctx, bson.M{"event_id": bson.M{"$in": ids}}); err != nil {
+			return int(result.DeletedCount), err
+		}
+	}
+	return int(result.DeletedCount), nil
+}
+
+// updateOwned applies update to the event if this instance holds its lease and returns
+// ErrLeaseLost otherwise.
+func (m *MongoRepository) updateOwned(ctx context.Context, eventID string, update bson.M) error {
+	result, err := m.events().UpdateOne(ctx, bson.M{"id": eventID, "locked_by": m.instanceID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (m *MongoRepository) events() *mongo.Collection {
+	return m.client.Database(m.database).Collection(m.collection)
+}
+
+func (m *MongoRepository) attempts() *mongo.Collection {
+	return m.client.Database(m.database).Collection(mongoAttemptsCollection)
+}
+
+func (m *MongoRepository) archive() *mongo.Collection {
+	return m.client.Database(m.database).Collection(m.collection + "_archive")
+}
+
+func (m *MongoRepository) Close() error {
+	if m.stopWatching != nil {
+		m.stopWatching()
+	}
+	return m.client.Disconnect(context.Background())
+}
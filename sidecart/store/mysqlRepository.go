@@ -0,0 +1,386 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"go.opentelemetry.io/otel"
+)
+
+// MySQLRepository stores the outbox in MySQL 8 or MariaDB 10.6+, which both support
+// SELECT ... FOR UPDATE SKIP LOCKED. Open the database with OpenMySQL.
+type MySQLRepository struct {
+	Db          *sql.DB
+	RetryPolicy *config.RetryPolicy
+	// InstanceID owns the leases of the events claimed through this repository.
+	InstanceID string
+	// LeaseDuration is how long a claim lasts unless renewed (default DefaultLeaseDuration).
+	LeaseDuration time.Duration
+	// AttemptHistory keeps every publish attempt in outbox_event_attempts.
+	AttemptHistory bool
+}
+
+// OpenMySQL opens the database in dsn with the options the repository relies on: DATETIME
+// columns are read as time.Time in UTC, and updates report the rows they matched rather
+// than the rows they changed, which is how lost leases are detected.
+func OpenMySQL(dsn string) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	cfg.ClientFoundRows = true
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+func (m *MySQLRepository) FetchPending(ctx context.Context, batchSize int) ([]schema.OutboxEvent, error) {
+	var claimed []schema.OutboxEvent
+	err := m.withTransaction(ctx, "FetchPending", func(ctx context.Context, tx *sql.Tx) error {
+		now := time.Now()
+		rows, err := tx.QueryContext(ctx,
+			`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key, created_at FROM outbox_events
+             WHERE ((status='pending' AND (next_attempt_at IS NULL OR next_attempt_at <= ?)) OR (status='processing' AND (locked_until IS NULL OR locked_until < ?)))
+             ORDER BY created_at LIMIT ? FOR UPDATE SKIP LOCKED`, now, now, batchSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var events []schema.OutboxEvent
+		for rows.Next() {
+			var event schema.OutboxEvent
+			var rawHeaders sql.NullString
+			if err := rows.Scan(&event.ID,
+				&event.Entity,
+				&event.EntityType,
+				&event.Payload,
+				&event.RetryCount,
+				&rawHeaders,
+				&event.RoutingKey,
+				&event.CreatedAt); err != nil {
+				return err
+			}
+
+			if rawHeaders.String != "" {
+				if err := json.Unmarshal([]byte(rawHeaders.String), &event.Headers); err != nil {
+					return errors.New("failed to parse headers: " + err.Error())
+				}
+			}
+
+			events = append(events, event)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Claim the fetched events, which are locked by this transaction. Events already
+		// retried beyond their limit (possible after the limit was lowered) are marked
+		// failed and not returned.
+		var claimedIDs, exceededIDs []string
+		for _, event := range events {
+			if event.RetryCount > m.RetryPolicy.MaxRetriesFor(event.Entity) {
+				exceededIDs = append(exceededIDs, event.ID)
+				continue
+			}
+			claimedIDs = append(claimedIDs, event.ID)
+			claimed = append(claimed, event)
+		}
+
+		if len(exceededIDs) > 0 {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events SET status=?, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id IN (`+placeholders(len(exceededIDs))+`)`,
+				append([]interface{}{schema.StatusFailed, now}, stringArgs(exceededIDs)...)...); err != nil {
+				return err
+			}
+		}
+		if len(claimedIDs) > 0 {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events SET status=?, locked_by=?, locked_until=?, updated_at=? WHERE id IN (`+placeholders(len(claimedIDs))+`)`,
+				append([]interface{}{schema.StatusProcessing, m.InstanceID, now.Add(resolveLeaseDuration(m.LeaseDuration)), now}, stringArgs(claimedIDs)...)...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (m *MySQLRepository) MarkProcessed(ctx context.Context, eventID, messageID string) error {
+	now := time.Now()
+	return m.execOwned(ctx, "MarkProcessed",
+		`UPDATE outbox_events SET status=?, sent_at=?, message_id=NULLIF(?, ''), locked_by=NULL, locked_until=NULL, updated_at=? WHERE id=? AND locked_by=?`,
+		schema.StatusSent, now, messageID, now, eventID, m.InstanceID)
+}
+
+// MarkProcessedBatch joins the events with a derived table of their send times and
+// message IDs, so the batch is a single statement.
+func (m *MySQLRepository) MarkProcessedBatch(ctx context.Context, sent []SentEvent) error {
+	if len(sent) == 0 {
+		return nil
+	}
+	var args []interface{}
+	for _, event := range sent {
+		args = append(args, event.EventID, event.SentAt, event.MessageID)
+	}
+	args = append(args, schema.StatusSent, time.Now(), m.InstanceID)
+	return m.execOwnedBatch(ctx, "MarkProcessedBatch", len(sent),
+		`UPDATE outbox_events AS e JOIN (`+derivedRows(len(sent), "id", "sent_at", "message_id")+`) AS s ON e.id = s.id
+         SET e.status=?, e.sent_at = s.sent_at, e.message_id = NULLIF(s.message_id, ''), e.locked_by=NULL, e.locked_until=NULL, e.updated_at=?
+         WHERE e.locked_by=?`,
+		args...)
+}
+
+// SetStatus sets the status of an event claimed by this instance and releases its lease.
+func (m *MySQLRepository) SetStatus(ctx context.Context, eventID string, status schema.Status) error {
+	return m.execOwned(ctx, "SetStatus",
+		`UPDATE outbox_events SET status=?, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id=? AND locked_by=?`,
+		status, time.Now(), eventID, m.InstanceID)
+}
+
+func (m *MySQLRepository) SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error {
+	return m.execOwned(ctx, "SetStatusAndIncrementRetry",
+		`UPDATE outbox_events SET status=?, retry_count = retry_count + 1, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id=? AND locked_by=?`,
+		status, time.Now(), eventID, m.InstanceID)
+}
+
+func (m *MySQLRepository) ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) error {
+	return m.execOwned(ctx, "ScheduleRetry",
+		`UPDATE outbox_events SET status=?, retry_count = retry_count + 1, next_attempt_at=?, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id=? AND locked_by=?`,
+		schema.StatusPending, nextAttemptAt, time.Now(), eventID, m.InstanceID)
+}
+
+func (m *MySQLRepository) ScheduleRetryBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return m.deferBatch(ctx, "ScheduleRetryBatch", nextAttempts, 1)
+}
+
+func (m *MySQLRepository) DeferBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return m.deferBatch(ctx, "DeferBatch", nextAttempts, 0)
+}
+
+// deferBatch sets the events back to pending until their next attempts, adding retries to
+// their retry counts.
+func (m *MySQLRepository) deferBatch(ctx context.Context, op string, nextAttempts map[string]time.Time, retries int) error {
+	if len(nextAttempts) == 0 {
+		return nil
+	}
+	ids, times := sortedRetries(nextAttempts)
+	var args []interface{}
+	for i, id := range ids {
+		args = append(args, id, times[i])
+	}
+	args = append(args, schema.StatusPending, retries, time.Now(), m.InstanceID)
+	return m.execOwnedBatch(ctx, op, len(ids),
+		`UPDATE outbox_events AS e JOIN (`+derivedRows(len(ids), "id", "next_attempt_at")+`) AS r ON e.id = r.id
+         SET e.status=?, e.retry_count = e.retry_count + ?, e.next_attempt_at = r.next_attempt_at, e.locked_by=NULL, e.locked_until=NULL, e.updated_at=?
+         WHERE e.locked_by=?`,
+		args...)
+}
+
+func (m *MySQLRepository) IncrementRetryCount(ctx context.Context, eventID string) error {
+	return m.execOwned(ctx, "IncrementRetryCount",
+		`UPDATE outbox_events SET retry_count = retry_count + 1, updated_at=? WHERE id=? AND locked_by=?`,
+		time.Now(), eventID, m.InstanceID)
+}
+
+func (m *MySQLRepository) RenewLease(ctx context.Context, eventID string) error {
+	now := time.Now()
+	return m.execOwned(ctx, "RenewLease",
+		`UPDATE outbox_events SET locked_until=?, updated_at=? WHERE id=? AND status=? AND locked_by=?`,
+		now.Add(resolveLeaseDuration(m.LeaseDuration)), now, eventID, schema.StatusProcessing, m.InstanceID)
+}
+
+// RecordAttempts writes the last errors and the attempt history in one transaction.
+// Attempts of events that no longer exist are skipped.
+func (m *MySQLRepository) RecordAttempts(ctx context.Context, attempts []schema.EventAttempt) error {
+	attempts, failedIDs, lastErrors := attributeAttempts(attempts, m.InstanceID)
+	if len(failedIDs) == 0 && (!m.AttemptHistory || len(attempts) == 0) {
+		return nil
+	}
+	return m.withTransaction(ctx, "RecordAttempts", func(ctx context.Context, tx *sql.Tx) error {
+		if len(failedIDs) > 0 {
+			var args []interface{}
+			for i, id := range failedIDs {
+				args = append(args, id, lastErrors[i])
+			}
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events AS e JOIN (`+derivedRows(len(failedIDs), "id", "error")+`) AS a ON e.id = a.id
+                 SET e.last_error = a.error`, args...); err != nil {
+				return err
+			}
+		}
+		if !m.AttemptHistory || len(attempts) == 0 {
+			return nil
+		}
+
+		var args []interface{}
+		for _, attempt := range attempts {
+			args = append(args, attempt.EventID, attempt.AttemptedAt, attempt.InstanceID, attempt.Broker, attempt.Error)
+		}
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO outbox_event_attempts (event_id, attempted_at, instance_id, broker, error)
+             SELECT a.id, a.attempted_at, a.instance_id, a.broker, NULLIF(a.error, '')
+             FROM (`+derivedRows(len(attempts), "id", "attempted_at", "instance_id", "broker", "error")+`) AS a
+             JOIN outbox_events AS e ON e.id = a.id`, args...)
+		return err
+	})
+}
+
+// Purge locks the oldest matching events, skipping rows locked by other transactions, and
+// deletes them by ID. With archive set, they are copied to outbox_events_archive first.
+// Their attempts are deleted by the foreign key cascade.
+func (m *MySQLRepository) Purge(ctx context.Context, status schema.Status, before time.Time, limit int, archive bool) (int, error) {
+	var purged int64
+	err := m.withTransaction(ctx, "Purge", func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT id FROM outbox_events WHERE status=? AND updated_at < ? ORDER BY updated_at LIMIT ? FOR UPDATE SKIP LOCKED`,
+			status, before, limit)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil || len(ids) == 0 {
+			return err
+		}
+
+		if archive {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO outbox_events_archive SELECT * FROM outbox_events WHERE id IN (`+placeholders(len(ids))+`)`,
+				stringArgs(ids)...); err != nil {
+				return err
+			}
+		}
+		result, err := tx.ExecContext(ctx,
+			`DELETE FROM outbox_events WHERE id IN (`+placeholders(len(ids))+`)`, stringArgs(ids)...)
+		if err != nil {
+			return err
+		}
+		purged, err = result.RowsAffected()
+		return err
+	})
+	return int(purged), err
+}
+
+func (m *MySQLRepository) Close() error {
+	return m.Db.Close()
+}
+
+// execOwned runs an update restricted to events whose lease this instance holds and
+// returns ErrLeaseLost when it matched no row.
+func (m *MySQLRepository) execOwned(ctx context.Context, spanName string, query string, args ...interface{}) error {
+	return m.withTransaction(ctx, spanName, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrLeaseLost
+		}
+		return nil
+	})
+}
+
+// execOwnedBatch runs an update of expected events restricted to those whose lease this
+// instance holds. The update is committed even when some leases were lost, in which case
+// it returns ErrLeaseLost.
+func (m *MySQLRepository) execOwnedBatch(ctx context.Context, spanName string, expected int, query string, args ...interface{}) error {
+	var affected int64
+	err := m.withTransaction(ctx, spanName, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		affected, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if affected < int64(expected) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (m *MySQLRepository) withTransaction(ctx context.Context, spanName string, fn func(ctx context.Context, tx *sql.Tx) error) (err error) {
+	tracer := otel.Tracer("go-outbox")
+	ctx, span := tracer.Start(ctx, spanName)
+	defer span.End()
+
+	startTime := time.Now()
+	tx, err := m.Db.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			span.RecordError(err)
+		} else if err = tx.Commit(); err != nil {
+			span.RecordError(err)
+		}
+	}()
+
+	if err = fn(ctx, tx); err != nil {
+		return err
+	}
+
+	addDBStatsToSpan(span, dbSystemMySQL, spanName, 0, time.Since(startTime))
+	return nil
+}
+
+// placeholders returns n comma-separated placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// derivedRows returns a derived table of n rows of placeholders for the given columns, built
+// with UNION ALL since MariaDB does not support VALUES ROW(...) tables.
+func derivedRows(n int, columns ...string) string {
+	first := make([]string, len(columns))
+	for i, column := range columns {
+		first[i] = "? AS " + column
+	}
+	rows := []string{"SELECT " + strings.Join(first, ", ")}
+	for i := 1; i < n; i++ {
+		rows = append(rows, "SELECT "+placeholders(len(columns)))
+	}
+	return strings.Join(rows, " UNION ALL ")
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
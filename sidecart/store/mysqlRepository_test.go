@@ -0,0 +1,249 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// openMySQLTestDB connects to the database in OUTBOX_TEST_MYSQL_DSN and recreates the outbox
+// schema from deployment/migrations/mysql. The test is skipped when the variable is not set,
+// e.g. run `docker compose up mysql` and use OUTBOX_TEST_MYSQL_DSN="user:pass@tcp(localhost:3306)/appdb".
+func openMySQLTestDB(t testing.TB) *sql.DB {
+	dsn := os.Getenv("OUTBOX_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("OUTBOX_TEST_MYSQL_DSN is not set, skipping MySQL integration test")
+	}
+
+	db, err := OpenMySQL(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	migrations := filepath.Join("..", "..", "deployment", "migrations", "mysql")
+	downs, err := filepath.Glob(filepath.Join(migrations, "*.down.sql"))
+	require.NoError(t, err)
+	sort.Sort(sort.Reverse(sort.StringSlice(downs)))
+	ups, err := filepath.Glob(filepath.Join(migrations, "*.up.sql"))
+	require.NoError(t, err)
+	sort.Strings(ups)
+
+	// The driver runs one statement per call unless multiStatements is set in the DSN.
+	for _, file := range append(downs, ups...) {
+		statements, err := os.ReadFile(file)
+		require.NoError(t, err)
+		for _, statement := range strings.Split(string(statements), ";") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			_, err = db.Exec(statement)
+			require.NoError(t, err, file)
+		}
+	}
+
+	return db
+}
+
+func insertMySQLTestEvent(t testing.TB, db *sql.DB, id string, createdAt time.Time) {
+	_, err := db.Exec(`INSERT INTO outbox_events (id, entity, entity_type, payload, headers, routing_key, created_at, updated_at)
+		VALUES (?, 'orders', 'direct', 'payload', '{"trace":"abc"}', 'key', ?, ?)`, id, createdAt, createdAt)
+	require.NoError(t, err)
+}
+
+func readMySQLTestEvent(t *testing.T, db *sql.DB, id string) (status string, lockedBy, messageID sql.NullString, retryCount int) {
+	err := db.QueryRow(`SELECT status, locked_by, message_id, retry_count FROM outbox_events WHERE id=?`, id).
+		Scan(&status, &lockedBy, &messageID, &retryCount)
+	require.NoError(t, err)
+	return status, lockedBy, messageID, retryCount
+}
+
+func TestMySQLFetchPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &MySQLRepository{Db: db, InstanceID: "instance-a"}
+
+	createdAt := time.Now().Add(-time.Minute)
+	rows := sqlmock.NewRows([]string{"id", "entity", "entity_type", "payload", "retry_count", "headers", "routing_key", "created_at"}).
+		AddRow("1", "entity1", "type1", []byte("payload1"), 0, []byte(`{"header1":"value1"}`), "key1", createdAt).
+		AddRow("2", "entity2", "type2", []byte("payload2"), 3, nil, "key2", createdAt)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key, created_at FROM outbox_events WHERE \(\(status='pending' AND \(next_attempt_at IS NULL OR next_attempt_at <= \?\)\) OR \(status='processing' AND \(locked_until IS NULL OR locked_until < \?\)\)\) ORDER BY created_at LIMIT \? FOR UPDATE SKIP LOCKED`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 10).
+		WillReturnRows(rows)
+	mock.ExpectExec(`UPDATE outbox_events SET status=\?, locked_by=\?, locked_until=\?, updated_at=\? WHERE id IN \(\?, \?\)`).
+		WithArgs(schema.StatusProcessing, "instance-a", sqlmock.AnyArg(), sqlmock.AnyArg(), "1", "2").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, map[string]string{"header1": "value1"}, events[0].Headers)
+	assert.Equal(t, createdAt, events[0].CreatedAt)
+	assert.Nil(t, events[1].Headers)
+	assert.Equal(t, 3, events[1].RetryCount)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLMarkProcessedBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &MySQLRepository{Db: db, InstanceID: "instance-a"}
+
+	first, second := time.Now().Add(-time.Second), time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events AS e JOIN \(SELECT \? AS id, \? AS sent_at, \? AS message_id UNION ALL SELECT \?, \?, \?\) AS s ON e.id = s.id SET e.status=\?, e.sent_at = s.sent_at, e.message_id = NULLIF\(s.message_id, ''\), e.locked_by=NULL, e.locked_until=NULL, e.updated_at=\? WHERE e.locked_by=\?`).
+		WithArgs("1", first, "msg-1", "2", second, "", schema.StatusSent, sqlmock.AnyArg(), "instance-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = repo.MarkProcessedBatch(context.Background(), []SentEvent{
+		{EventID: "1", MessageID: "msg-1", SentAt: first},
+		{EventID: "2", SentAt: second},
+	})
+	assert.ErrorIs(t, err, ErrLeaseLost)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLPurge_Archive(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &MySQLRepository{Db: db}
+	before := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM outbox_events WHERE status=\? AND updated_at < \? ORDER BY updated_at LIMIT \? FOR UPDATE SKIP LOCKED`).
+		WithArgs(schema.StatusSent, before, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1").AddRow("2"))
+	mock.ExpectExec(`INSERT INTO outbox_events_archive SELECT \* FROM outbox_events WHERE id IN \(\?, \?\)`).
+		WithArgs("1", "2").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM outbox_events WHERE id IN \(\?, \?\)`).
+		WithArgs("1", "2").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	purged, err := repo.Purge(context.Background(), schema.StatusSent, before, 100, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, purged)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLRepository_SpansReportTheDBSystem(t *testing.T) {
+	spans := recordSpans(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := &MySQLRepository{Db: db, InstanceID: "instance-a"}
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events AS e JOIN`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, repo.DeferBatch(context.Background(), map[string]time.Time{"1": time.Now()}))
+	assert.Equal(t, "mysql", spanAttribute(spans, "DeferBatch", "db.system"))
+}
+
+func TestMySQLRepository_ClaimsAndPublishes(t *testing.T) {
+	db := openMySQLTestDB(t)
+	ctx := context.Background()
+
+	repo := &MySQLRepository{Db: db, RetryPolicy: &config.RetryPolicy{MaxRetries: 3}, InstanceID: "instance-a", AttemptHistory: true}
+	other := &MySQLRepository{Db: db, RetryPolicy: &config.RetryPolicy{MaxRetries: 3}, InstanceID: "instance-b"}
+
+	now := time.Now().UTC()
+	insertMySQLTestEvent(t, db, "1", now.Add(-2*time.Minute))
+	insertMySQLTestEvent(t, db, "2", now.Add(-time.Minute))
+	insertMySQLTestEvent(t, db, "3", now)
+
+	events, err := repo.FetchPending(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "1", events[0].ID)
+	assert.Equal(t, map[string]string{"trace": "abc"}, events[0].Headers)
+	assert.WithinDuration(t, now.Add(-2*time.Minute), events[0].CreatedAt, time.Millisecond)
+
+	// Claimed events are leased, so the other instance only gets the remaining one.
+	events, err = other.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "3", events[0].ID)
+
+	assert.ErrorIs(t, other.MarkProcessed(ctx, "1", "msg-1"), ErrLeaseLost)
+	require.NoError(t, repo.MarkProcessed(ctx, "1", "msg-1"))
+	status, lockedBy, messageID, _ := readMySQLTestEvent(t, db, "1")
+	assert.Equal(t, string(schema.StatusSent), status)
+	assert.False(t, lockedBy.Valid)
+	assert.Equal(t, "msg-1", messageID.String)
+
+	require.NoError(t, repo.ScheduleRetryBatch(ctx, map[string]time.Time{"2": now.Add(time.Hour)}))
+	status, lockedBy, _, retryCount := readMySQLTestEvent(t, db, "2")
+	assert.Equal(t, string(schema.StatusPending), status)
+	assert.False(t, lockedBy.Valid)
+	assert.Equal(t, 1, retryCount)
+
+	// The batch commits the owned event and reports the lost one.
+	err = other.MarkProcessedBatch(ctx, []SentEvent{{EventID: "3", SentAt: now}, {EventID: "2", SentAt: now}})
+	assert.ErrorIs(t, err, ErrLeaseLost)
+	status, _, _, _ = readMySQLTestEvent(t, db, "3")
+	assert.Equal(t, string(schema.StatusSent), status)
+}
+
+func TestMySQLRepository_RecordAttemptsAndPurge(t *testing.T) {
+	db := openMySQLTestDB(t)
+	ctx := context.Background()
+
+	repo := &MySQLRepository{Db: db, InstanceID: "instance-a", AttemptHistory: true}
+	old := time.Now().UTC().Add(-time.Hour)
+	insertMySQLTestEvent(t, db, "1", old.Add(-time.Minute))
+	insertMySQLTestEvent(t, db, "2", old)
+	_, err := db.Exec(`UPDATE outbox_events SET status='sent'`)
+	require.NoError(t, err)
+
+	err = repo.RecordAttempts(ctx, []schema.EventAttempt{
+		{EventID: "1", AttemptedAt: old, Broker: "rabbitmq", Error: "connection refused"},
+		{EventID: "1", AttemptedAt: old.Add(time.Second), Broker: "rabbitmq"},
+		{EventID: "missing", AttemptedAt: old, Broker: "rabbitmq"},
+	})
+	require.NoError(t, err)
+
+	var lastError string
+	require.NoError(t, db.QueryRow(`SELECT last_error FROM outbox_events WHERE id='1'`).Scan(&lastError))
+	assert.Equal(t, "connection refused", lastError)
+	var attempts int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM outbox_event_attempts WHERE event_id='1' AND instance_id='instance-a'`).Scan(&attempts))
+	assert.Equal(t, 2, attempts)
+
+	purged, err := repo.Purge(ctx, schema.StatusSent, time.Now(), 1, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	var remaining, archived int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM outbox_events`).Scan(&remaining))
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM outbox_events_archive`).Scan(&archived))
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM outbox_event_attempts`).Scan(&attempts))
+	assert.Equal(t, 1, remaining)
+	assert.Equal(t, 1, archived)
+	assert.Equal(t, 0, attempts)
+}
@@ -0,0 +1,19 @@
+package store
+
+// Notifier is implemented by repositories that can signal new outbox events as soon as
+// they are committed, so the processor does not have to wait for the next poll.
+type Notifier interface {
+	// Notifications returns a channel that receives a value whenever new events may be
+	// available. It returns nil when notifications are not enabled, in which case the
+	// processor relies on polling alone.
+	Notifications() <-chan struct{}
+}
+
+// wake performs a non-blocking send on a wake-up channel. Wake-ups are coalesced: if
+// one is already pending, the processor fetches everything in a single poll anyway.
+func wake(notifications chan struct{}) {
+	select {
+	case notifications <- struct{}{}:
+	default:
+	}
+}
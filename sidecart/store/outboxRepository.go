@@ -2,20 +2,60 @@ package store
 
 import (
 	"context"
+	"time"
 
 	"github.com/zoff-tech/go-outbox/schema"
 )
 
+// SentEvent describes the publish of an outbox event that is to be marked processed.
+type SentEvent struct {
+	EventID   string
+	MessageID string    // ID the broker assigned to the message, if any
+	SentAt    time.Time // when the broker accepted the message
+}
+
 // OutBoxRepository defines the database operations for outbox events.
+//
+// FetchPending claims the events it returns by leasing them to the calling instance. The
+// updates below only apply while that lease is held and return ErrLeaseLost otherwise.
 type OutBoxRepository interface {
-	// FetchPending retrieves unprocessed outbox events (e.g., status = "pending").
+	// FetchPending claims unprocessed outbox events (e.g., status = "pending") whose next attempt
+	// is due, along with events whose lease expired.
 	FetchPending(ctx context.Context, batchSize int) ([]schema.OutboxEvent, error)
-	// MarkProcessed marks an outbox event as processed (sent) to avoid reprocessing.
-	MarkProcessed(ctx context.Context, eventID string) error
-	// SetStatus sets the status of an outbox event.
+	// MarkProcessed marks an outbox event as processed (sent) to avoid reprocessing, setting
+	// sent_at to the current time and storing the ID of the broker message.
+	MarkProcessed(ctx context.Context, eventID, messageID string) error
+	// MarkProcessedBatch marks several outbox events as processed in a single round trip.
+	// It returns ErrLeaseLost when any of them is no longer leased to this instance.
+	MarkProcessedBatch(ctx context.Context, sent []SentEvent) error
+	// SetStatus sets the status of an outbox event and releases its lease.
 	SetStatus(ctx context.Context, eventID string, status schema.Status) error
 	// SetStatusAndIncrementRetry sets the status of an outbox event and increments the retry count.
 	SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error
+	// ScheduleRetry sets an outbox event back to pending, increments the retry count and
+	// defers the next attempt until nextAttemptAt.
+	ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) error
+	// ScheduleRetryBatch does what ScheduleRetry does for several outbox events, each with its
+	// own next attempt time, in a single round trip. It returns ErrLeaseLost when any of them
+	// is no longer leased to this instance.
+	ScheduleRetryBatch(ctx context.Context, nextAttempts map[string]time.Time) error
+	// DeferBatch sets outbox events back to pending and defers their next attempts, like
+	// ScheduleRetryBatch, but without incrementing their retry counts. It holds back events
+	// that were not attempted, e.g. behind an earlier event of their routing key that is
+	// retried. It returns ErrLeaseLost when any of them is no longer leased to this instance.
+	DeferBatch(ctx context.Context, nextAttempts map[string]time.Time) error
 	// IncrementRetryCount increments the retry count of an outbox event.
 	IncrementRetryCount(ctx context.Context, eventID string) error
+	// RecordAttempts stores the error of each failed attempt as the last error of its event
+	// and, when attempt history is enabled, appends the attempts to outbox_event_attempts.
+	// Attempts without an instance ID are attributed to this instance.
+	RecordAttempts(ctx context.Context, attempts []schema.EventAttempt) error
+	// Purge deletes up to limit events in the given status last updated before the given
+	// time, along with their attempt history, and returns how many it deleted. With archive
+	// set, the events are moved to the archive first.
+	Purge(ctx context.Context, status schema.Status, before time.Time, limit int, archive bool) (int, error)
+	// RenewLease extends the lease of a claimed outbox event by the lease duration.
+	RenewLease(ctx context.Context, eventID string) error
+	// Close releases the underlying database connection.
+	Close() error
 }
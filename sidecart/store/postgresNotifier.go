@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Listen subscribes to NOTIFY messages on channel over a dedicated connection and turns
+// them into wake-ups on Notifications. The trigger installed by the
+// 0003_notify_outbox_events migration notifies the channel given as its argument,
+// outbox_events by default, whenever rows are inserted into outbox_events.
+//
+// Listen does not wait for the connection to be established: until it is, and whenever
+// it is lost, the processor keeps polling.
+func (p *PostgresRepository) Listen(dsn, channel string) {
+	p.notifications = make(chan struct{}, 1)
+	p.listener = pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Postgres listener on channel %s: %v", channel, err)
+		}
+	})
+
+	go func() {
+		if err := p.listener.Listen(channel); err != nil {
+			log.Printf("Failed to listen on Postgres channel %s: %v", channel, err)
+			return
+		}
+		log.Printf("Listening for outbox notifications on Postgres channel %s", channel)
+
+		// A nil notification is delivered after the connection was re-established.
+		// Inserts made in the meantime were not announced, so it wakes the processor too.
+		for range p.listener.Notify {
+			wake(p.notifications)
+		}
+	}()
+}
+
+// Notifications implements Notifier. It returns nil unless Listen was called.
+func (p *PostgresRepository) Notifications() <-chan struct{} {
+	return p.notifications
+}
+
+// CheckNotifyTrigger returns an error unless a trigger on outbox_events notifies channel,
+// in which case listening on it would never wake the processor.
+func (p *PostgresRepository) CheckNotifyTrigger(ctx context.Context, channel string) error {
+	var exists bool
+	err := p.Db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM pg_trigger
+         WHERE tgrelid = to_regclass('outbox_events') AND tgfoid = to_regproc('notify_outbox_events')
+         AND tgargs = convert_to($1, 'UTF8') || '\x00'::bytea)`, channel).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check the notify trigger of channel %s: %w", channel, err)
+	}
+	if !exists {
+		return fmt.Errorf("no trigger on outbox_events notifies channel %s; create one with EXECUTE FUNCTION notify_outbox_events('%s')", channel, channel)
+	}
+	return nil
+}
@@ -5,29 +5,43 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"log"
 	"time"
 
+	"github.com/lib/pq"
+	"github.com/zoff-tech/go-outbox/config"
 	"github.com/zoff-tech/go-outbox/schema"
 	"go.opentelemetry.io/otel"
 )
 
 type PostgresRepository struct {
-	Db *sql.DB // using database/sql
+	Db          *sql.DB // using database/sql
+	RetryPolicy *config.RetryPolicy
+	// InstanceID owns the leases of the events claimed through this repository.
+	InstanceID string
+	// LeaseDuration is how long a claim lasts unless renewed (default DefaultLeaseDuration).
+	LeaseDuration time.Duration
+	// AttemptHistory keeps every publish attempt in outbox_event_attempts.
+	AttemptHistory bool
+
+	listener      *pq.Listener
+	notifications chan struct{}
 }
 
 func (p *PostgresRepository) FetchPending(ctx context.Context, batchSize int) ([]schema.OutboxEvent, error) {
 	return p.withTransaction(ctx, "FetchPending", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
+		now := time.Now()
 		rows, err := tx.QueryContext(ctx,
-			`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key FROM outbox_events
-             WHERE (status='pending' OR (status='processing' AND updated_at < $1)) 
-             FOR UPDATE SKIP LOCKED LIMIT $2`, time.Now().Add(-lockExpiration), batchSize)
+			`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key, created_at FROM outbox_events
+             WHERE ((status='pending' AND (next_attempt_at IS NULL OR next_attempt_at <= $1)) OR (status='processing' AND (locked_until IS NULL OR locked_until < $1)))
+             ORDER BY created_at FOR UPDATE SKIP LOCKED LIMIT $2`, now, batchSize)
 		if err != nil {
 			return nil, err
 		}
 		defer rows.Close()
 
 		var events []schema.OutboxEvent
-		var rawHeaders string // Use a temporary variable to store the raw headers
+		var rawHeaders sql.NullString // Use a temporary variable to store the raw headers, which may be NULL
 
 		for rows.Next() {
 			var event schema.OutboxEvent
@@ -37,13 +51,14 @@ func (p *PostgresRepository) FetchPending(ctx context.Context, batchSize int) ([
 				&event.Payload,
 				&event.RetryCount,
 				&rawHeaders,
-				&event.RoutingKey); err != nil {
+				&event.RoutingKey,
+				&event.CreatedAt); err != nil {
 				return nil, err
 			}
 
 			// Convert rawHeaders to a map[string]string
-			if rawHeaders != "" {
-				if err := json.Unmarshal([]byte(rawHeaders), &event.Headers); err != nil {
+			if rawHeaders.String != "" {
+				if err := json.Unmarshal([]byte(rawHeaders.String), &event.Headers); err != nil {
 					return nil, errors.New("failed to parse headers: " + err.Error())
 				}
 			}
@@ -55,80 +70,250 @@ func (p *PostgresRepository) FetchPending(ctx context.Context, batchSize int) ([
 			return nil, err
 		}
 
-		// Update status and updated_at for fetched events
+		// Claim the fetched events, which are locked by this transaction. Events already
+		// retried beyond their limit (possible after the limit was lowered) are marked
+		// failed and not returned.
+		var claimed []schema.OutboxEvent
+		var claimedIDs, exceededIDs []string
 		for _, event := range events {
-			if event.RetryCount >= maxRetries {
-				if err := p.SetStatus(ctx, event.ID, schema.StatusFailed); err != nil {
-					return nil, err
-				}
-			} else {
-				if err := p.SetStatusAndIncrementRetry(ctx, event.ID, schema.StatusProcessing); err != nil {
-					return nil, err
-				}
+			if event.RetryCount > p.RetryPolicy.MaxRetriesFor(event.Entity) {
+				exceededIDs = append(exceededIDs, event.ID)
+				continue
+			}
+			claimedIDs = append(claimedIDs, event.ID)
+			claimed = append(claimed, event)
+		}
+
+		if len(exceededIDs) > 0 {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events SET status=$1, locked_by=NULL, locked_until=NULL, updated_at=$2 WHERE id = ANY($3)`,
+				schema.StatusFailed, now, pq.Array(exceededIDs)); err != nil {
+				return nil, err
+			}
+		}
+		if len(claimedIDs) > 0 {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events SET status=$1, locked_by=$2, locked_until=$3, updated_at=$4 WHERE id = ANY($5)`,
+				schema.StatusProcessing, p.InstanceID, now.Add(resolveLeaseDuration(p.LeaseDuration)), now, pq.Array(claimedIDs)); err != nil {
+				return nil, err
 			}
 		}
 
-		return events, nil
+		return claimed, nil
 	})
 }
 
-func (p *PostgresRepository) MarkProcessed(ctx context.Context, eventID string) error {
+func (p *PostgresRepository) MarkProcessed(ctx context.Context, eventID, messageID string) error {
 	_, err := p.withTransaction(ctx, "MarkProcessed", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
-		if err := p.SetStatus(ctx, eventID, schema.StatusSent); err != nil {
-			return nil, err
-		}
-		return nil, nil
+		now := time.Now()
+		return nil, p.execOwned(ctx, tx,
+			`UPDATE outbox_events SET status=$1, sent_at=$2, message_id=NULLIF($3, ''), locked_by=NULL, locked_until=NULL, updated_at=$2 WHERE id=$4 AND locked_by=$5`,
+			schema.StatusSent, now, messageID, eventID, p.InstanceID)
 	})
 	return err
 }
 
+func (p *PostgresRepository) MarkProcessedBatch(ctx context.Context, sent []SentEvent) error {
+	ids := make([]string, len(sent))
+	sentAt := make([]time.Time, len(sent))
+	messageIDs := make([]string, len(sent))
+	for i, event := range sent {
+		ids[i], sentAt[i], messageIDs[i] = event.EventID, event.SentAt, event.MessageID
+	}
+	return p.execOwnedBatch(ctx, "MarkProcessedBatch", len(sent),
+		`UPDATE outbox_events AS e SET status=$1, sent_at = s.sent_at, message_id = NULLIF(s.message_id, ''), locked_by=NULL, locked_until=NULL, updated_at=$2
+         FROM unnest($3::text[], $4::timestamp[], $5::text[]) AS s(id, sent_at, message_id)
+         WHERE e.id = s.id AND e.locked_by=$6`,
+		schema.StatusSent, time.Now(), pq.Array(ids), pq.Array(sentAt), pq.Array(messageIDs), p.InstanceID)
+}
+
+// SetStatus sets the status of an event claimed by this instance and releases its lease.
 func (p *PostgresRepository) SetStatus(ctx context.Context, eventID string, status schema.Status) error {
 	_, err := p.withTransaction(ctx, "SetStatus", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
-		_, err := tx.ExecContext(ctx,
-			`UPDATE outbox_events SET status=$1, updated_at=$2 WHERE id=$3`,
-			status, time.Now(), eventID)
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
+		return nil, p.execOwned(ctx, tx,
+			`UPDATE outbox_events SET status=$1, locked_by=NULL, locked_until=NULL, updated_at=$2 WHERE id=$3 AND locked_by=$4`,
+			status, time.Now(), eventID, p.InstanceID)
 	})
 	return err
 }
 
 func (p *PostgresRepository) SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error {
 	_, err := p.withTransaction(ctx, "SetStatusAndIncrementRetry", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
-		_, err := tx.ExecContext(ctx,
-			`UPDATE outbox_events SET status=$1, retry_count = retry_count + 1, updated_at=$2 WHERE id=$3`,
-			status, time.Now(), eventID)
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
+		return nil, p.execOwned(ctx, tx,
+			`UPDATE outbox_events SET status=$1, retry_count = retry_count + 1, locked_by=NULL, locked_until=NULL, updated_at=$2 WHERE id=$3 AND locked_by=$4`,
+			status, time.Now(), eventID, p.InstanceID)
+	})
+	return err
+}
+
+func (p *PostgresRepository) ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) error {
+	_, err := p.withTransaction(ctx, "ScheduleRetry", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
+		return nil, p.execOwned(ctx, tx,
+			`UPDATE outbox_events SET status=$1, retry_count = retry_count + 1, next_attempt_at=$2, locked_by=NULL, locked_until=NULL, updated_at=$3 WHERE id=$4 AND locked_by=$5`,
+			schema.StatusPending, nextAttemptAt, time.Now(), eventID, p.InstanceID)
 	})
 	return err
 }
 
+func (p *PostgresRepository) ScheduleRetryBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return p.deferBatch(ctx, "ScheduleRetryBatch", nextAttempts, 1)
+}
+
+func (p *PostgresRepository) DeferBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return p.deferBatch(ctx, "DeferBatch", nextAttempts, 0)
+}
+
+// deferBatch sets the events back to pending until their next attempts, adding retries to
+// their retry counts.
+func (p *PostgresRepository) deferBatch(ctx context.Context, op string, nextAttempts map[string]time.Time, retries int) error {
+	ids, times := sortedRetries(nextAttempts)
+	return p.execOwnedBatch(ctx, op, len(ids),
+		`UPDATE outbox_events AS e SET status=$1, retry_count = e.retry_count + $2, next_attempt_at = r.next_attempt_at, locked_by=NULL, locked_until=NULL, updated_at=$3
+         FROM unnest($4::text[], $5::timestamp[]) AS r(id, next_attempt_at)
+         WHERE e.id = r.id AND e.locked_by=$6`,
+		schema.StatusPending, retries, time.Now(), pq.Array(ids), pq.Array(times), p.InstanceID)
+}
+
 func (p *PostgresRepository) IncrementRetryCount(ctx context.Context, eventID string) error {
 	_, err := p.withTransaction(ctx, "IncrementRetryCount", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
+		return nil, p.execOwned(ctx, tx,
+			`UPDATE outbox_events SET retry_count = retry_count + 1, updated_at=$1 WHERE id=$2 AND locked_by=$3`,
+			time.Now(), eventID, p.InstanceID)
+	})
+	return err
+}
+
+func (p *PostgresRepository) RenewLease(ctx context.Context, eventID string) error {
+	_, err := p.withTransaction(ctx, "RenewLease", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
+		now := time.Now()
+		return nil, p.execOwned(ctx, tx,
+			`UPDATE outbox_events SET locked_until=$1, updated_at=$2 WHERE id=$3 AND status=$4 AND locked_by=$5`,
+			now.Add(resolveLeaseDuration(p.LeaseDuration)), now, eventID, schema.StatusProcessing, p.InstanceID)
+	})
+	return err
+}
+
+// RecordAttempts writes the last errors and the attempt history in one transaction.
+// Attempts of events that no longer exist are skipped.
+func (p *PostgresRepository) RecordAttempts(ctx context.Context, attempts []schema.EventAttempt) error {
+	attempts, failedIDs, lastErrors := attributeAttempts(attempts, p.InstanceID)
+	if len(failedIDs) == 0 && (!p.AttemptHistory || len(attempts) == 0) {
+		return nil
+	}
+	_, err := p.withTransaction(ctx, "RecordAttempts", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
+		if len(failedIDs) > 0 {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events AS e SET last_error = a.error
+                 FROM unnest($1::text[], $2::text[]) AS a(id, error)
+                 WHERE e.id = a.id`,
+				pq.Array(failedIDs), pq.Array(lastErrors)); err != nil {
+				return nil, err
+			}
+		}
+		if !p.AttemptHistory || len(attempts) == 0 {
+			return nil, nil
+		}
+
+		ids := make([]string, len(attempts))
+		attemptedAt := make([]time.Time, len(attempts))
+		instances := make([]string, len(attempts))
+		brokers := make([]string, len(attempts))
+		errs := make([]string, len(attempts))
+		for i, attempt := range attempts {
+			ids[i], attemptedAt[i], instances[i], brokers[i], errs[i] =
+				attempt.EventID, attempt.AttemptedAt, attempt.InstanceID, attempt.Broker, attempt.Error
+		}
 		_, err := tx.ExecContext(ctx,
-			`UPDATE outbox_events SET retry_count = retry_count + 1, updated_at=$1 WHERE id=$2`,
-			time.Now(), eventID)
+			`INSERT INTO outbox_event_attempts (event_id, attempted_at, instance_id, broker, error)
+             SELECT a.id, a.attempted_at, a.instance_id, a.broker, NULLIF(a.error, '')
+             FROM unnest($1::text[], $2::timestamp[], $3::text[], $4::text[], $5::text[]) AS a(id, attempted_at, instance_id, broker, error)
+             JOIN outbox_events AS e ON e.id = a.id`,
+			pq.Array(ids), pq.Array(attemptedAt), pq.Array(instances), pq.Array(brokers), pq.Array(errs))
+		return nil, err
+	})
+	return err
+}
+
+// Purge deletes the oldest matching events with a single statement, skipping rows locked
+// by other transactions so that it never waits on the relay.
+func (p *PostgresRepository) Purge(ctx context.Context, status schema.Status, before time.Time, limit int, archive bool) (int, error) {
+	query := `DELETE FROM outbox_events WHERE id IN (` + purgeCandidates + `)`
+	if archive {
+		query = `WITH purged AS (DELETE FROM outbox_events WHERE id IN (` + purgeCandidates + `) RETURNING *)
+                 INSERT INTO outbox_events_archive SELECT * FROM purged`
+	}
+
+	var affected int64
+	_, err := p.withTransaction(ctx, "Purge", func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
+		result, err := tx.ExecContext(ctx, query, status, before, limit)
 		if err != nil {
 			return nil, err
 		}
-		return nil, nil
+		affected, err = result.RowsAffected()
+		return nil, err
 	})
-	return err
+	return int(affected), err
+}
+
+// purgeCandidates selects the events Purge deletes.
+const purgeCandidates = `SELECT id FROM outbox_events WHERE status=$1 AND updated_at < $2
+                         ORDER BY updated_at LIMIT $3 FOR UPDATE SKIP LOCKED`
+
+// execOwned runs an update restricted to events whose lease this instance holds and
+// returns ErrLeaseLost when it matched no row.
+func (p *PostgresRepository) execOwned(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) error {
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// execOwnedBatch runs an update of expected events restricted to those whose lease this
+// instance holds. The update is committed even when some leases were lost, in which case
+// it returns ErrLeaseLost.
+func (p *PostgresRepository) execOwnedBatch(ctx context.Context, spanName string, expected int, query string, args ...interface{}) error {
+	var affected int64
+	_, err := p.withTransaction(ctx, spanName, func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error) {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		affected, err = result.RowsAffected()
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+	if affected < int64(expected) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (p *PostgresRepository) Close() error {
+	if p.listener != nil {
+		if err := p.listener.Close(); err != nil {
+			log.Printf("Failed to close Postgres listener: %v", err)
+		}
+	}
+	return p.Db.Close()
 }
 
-func (p *PostgresRepository) withTransaction(ctx context.Context, spanName string, fn func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error)) ([]schema.OutboxEvent, error) {
+func (p *PostgresRepository) withTransaction(ctx context.Context, spanName string, fn func(ctx context.Context, tx *sql.Tx) ([]schema.OutboxEvent, error)) (events []schema.OutboxEvent, err error) {
 	tracer := otel.Tracer("go-outbox")
 	ctx, span := tracer.Start(ctx, spanName)
 	defer span.End()
 
 	tx, ok := ctx.Value("tx").(*sql.Tx)
 	if !ok {
-		var err error
 		tx, err = p.Db.BeginTx(ctx, nil)
 		if err != nil {
 			span.RecordError(err)
@@ -137,20 +322,21 @@ func (p *PostgresRepository) withTransaction(ctx context.Context, spanName strin
 		defer func() {
 			if err != nil {
 				tx.Rollback()
-			} else {
-				tx.Commit()
+			} else if err = tx.Commit(); err != nil {
+				span.RecordError(err)
+				events = nil
 			}
 		}()
 		ctx = context.WithValue(ctx, "tx", tx)
 	}
 
-	events, err := fn(ctx, tx)
+	events, err = fn(ctx, tx)
 	if err != nil {
 		span.RecordError(err)
 		return nil, err
 	}
 
-	addDBStatsToSpan(span, spanName, len(events), time.Since(time.Now()))
+	addDBStatsToSpan(span, dbSystemPostgreSQL, spanName, len(events), time.Since(time.Now()))
 
 	return events, nil
 }
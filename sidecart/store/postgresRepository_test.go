@@ -3,9 +3,12 @@ package store
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"github.com/zoff-tech/go-outbox/config"
 	"github.com/zoff-tech/go-outbox/schema"
 )
 
@@ -14,25 +17,21 @@ func TestFetchPending(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &PostgresRepository{Db: db}
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
 
 	// Mock rows for the SELECT query
-	rows := sqlmock.NewRows([]string{"id", "entity", "entity_type", "payload", "retry_count", "headers", "routing_key"}).
-		AddRow("1", "entity1", "type1", []byte("payload1"), 0, []byte(`{"header1":"value1"}`), "key1").
-		AddRow("2", "entity2", "type2", []byte("payload2"), 3, []byte(`{"header2":"value2"}`), "key2")
+	createdAt := time.Now().Add(-time.Minute)
+	rows := sqlmock.NewRows([]string{"id", "entity", "entity_type", "payload", "retry_count", "headers", "routing_key", "created_at"}).
+		AddRow("1", "entity1", "type1", []byte("payload1"), 0, []byte(`{"header1":"value1"}`), "key1", createdAt).
+		AddRow("2", "entity2", "type2", []byte("payload2"), 3, []byte(`{"header2":"value2"}`), "key2", createdAt)
 
 	mock.ExpectBegin()
-	mock.ExpectQuery(`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key FROM outbox_events WHERE \(status='pending' OR \(status='processing' AND updated_at < \$1\)\) FOR UPDATE SKIP LOCKED LIMIT \$2`).
+	mock.ExpectQuery(`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key, created_at FROM outbox_events WHERE \(\(status='pending' AND \(next_attempt_at IS NULL OR next_attempt_at <= \$1\)\) OR \(status='processing' AND \(locked_until IS NULL OR locked_until < \$1\)\)\) ORDER BY created_at FOR UPDATE SKIP LOCKED LIMIT \$2`).
 		WithArgs(sqlmock.AnyArg(), 10).
 		WillReturnRows(rows)
-		// Accept both possible update queries
-	// Accept both possible update queries and status values
-	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, retry_count = retry_count \+ 1, updated_at=\$2 WHERE id=\$3`).
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "1").
-		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, updated_at=\$2 WHERE id=\$3`).
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "2").
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, locked_by=\$2, locked_until=\$3, updated_at=\$4 WHERE id = ANY\(\$5\)`).
+		WithArgs(schema.StatusProcessing, "instance-a", sqlmock.AnyArg(), sqlmock.AnyArg(), pq.Array([]string{"1", "2"})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
 	mock.ExpectCommit()
 
 	ctx := context.Background()
@@ -46,6 +45,7 @@ func TestFetchPending(t *testing.T) {
 	assert.Equal(t, []byte("payload1"), events[0].Payload)
 	assert.Equal(t, 0, events[0].RetryCount)
 	assert.Equal(t, "key1", events[0].RoutingKey)
+	assert.Equal(t, createdAt, events[0].CreatedAt)
 
 	assert.Equal(t, "2", events[1].ID)
 	assert.Equal(t, "entity2", events[1].Entity)
@@ -57,21 +57,51 @@ func TestFetchPending(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestFetchPending_MarksEventsOverTheirRetryLimitFailed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, RetryPolicy: config.NewRetryPolicy(5, map[string]int{"analytics": 2})}
+
+	rows := sqlmock.NewRows([]string{"id", "entity", "entity_type", "payload", "retry_count", "headers", "routing_key", "created_at"}).
+		AddRow("1", "payments", "type1", []byte("payload1"), 3, `{}`, "key1", time.Now()).
+		AddRow("2", "analytics", "type2", []byte("payload2"), 3, `{}`, "key2", time.Now())
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key, created_at FROM outbox_events`).
+		WillReturnRows(rows)
+	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, locked_by=NULL, locked_until=NULL, updated_at=\$2 WHERE id = ANY\(\$3\)`).
+		WithArgs(schema.StatusFailed, sqlmock.AnyArg(), pq.Array([]string{"2"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, locked_by=\$2, locked_until=\$3, updated_at=\$4 WHERE id = ANY\(\$5\)`).
+		WithArgs(schema.StatusProcessing, "", sqlmock.AnyArg(), sqlmock.AnyArg(), pq.Array([]string{"1"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "1", events[0].ID)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestMarkProcessed(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &PostgresRepository{Db: db}
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, updated_at=\$2 WHERE id=\$3`).
-		WithArgs(schema.StatusSent, sqlmock.AnyArg(), "1").
+	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, sent_at=\$2, message_id=NULLIF\(\$3, ''\), locked_by=NULL, locked_until=NULL, updated_at=\$2 WHERE id=\$4 AND locked_by=\$5`).
+		WithArgs(schema.StatusSent, sqlmock.AnyArg(), "msg-1", "1", "instance-a").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	ctx := context.Background()
-	err = repo.MarkProcessed(ctx, "1")
+	err = repo.MarkProcessed(ctx, "1", "msg-1")
 	assert.NoError(t, err)
 
 	assert.NoError(t, mock.ExpectationsWereMet())
@@ -82,16 +112,16 @@ func TestSetStatus(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &PostgresRepository{Db: db}
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, updated_at=\$2 WHERE id=\$3`).
-		WithArgs(schema.StatusProcessing, sqlmock.AnyArg(), "1").
+	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, locked_by=NULL, locked_until=NULL, updated_at=\$2 WHERE id=\$3 AND locked_by=\$4`).
+		WithArgs(schema.StatusPending, sqlmock.AnyArg(), "1", "instance-a").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	ctx := context.Background()
-	err = repo.SetStatus(ctx, "1", schema.StatusProcessing)
+	err = repo.SetStatus(ctx, "1", schema.StatusPending)
 	assert.NoError(t, err)
 
 	assert.NoError(t, mock.ExpectationsWereMet())
@@ -102,11 +132,11 @@ func TestSetStatusAndIncrementRetry(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &PostgresRepository{Db: db}
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, retry_count = retry_count \+ 1, updated_at=\$2 WHERE id=\$3`).
-		WithArgs(schema.StatusProcessing, sqlmock.AnyArg(), "1").
+	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, retry_count = retry_count \+ 1, locked_by=NULL, locked_until=NULL, updated_at=\$2 WHERE id=\$3 AND locked_by=\$4`).
+		WithArgs(schema.StatusProcessing, sqlmock.AnyArg(), "1", "instance-a").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
@@ -117,16 +147,37 @@ func TestSetStatusAndIncrementRetry(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestScheduleRetry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
+	nextAttemptAt := time.Now().Add(time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, retry_count = retry_count \+ 1, next_attempt_at=\$2, locked_by=NULL, locked_until=NULL, updated_at=\$3 WHERE id=\$4 AND locked_by=\$5`).
+		WithArgs(schema.StatusPending, nextAttemptAt, sqlmock.AnyArg(), "1", "instance-a").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	ctx := context.Background()
+	err = repo.ScheduleRetry(ctx, "1", nextAttemptAt)
+	assert.NoError(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestIncrementRetryCount(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &PostgresRepository{Db: db}
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`UPDATE outbox_events SET retry_count = retry_count \+ 1, updated_at=\$1 WHERE id=\$2`).
-		WithArgs(sqlmock.AnyArg(), "1").
+	mock.ExpectExec(`UPDATE outbox_events SET retry_count = retry_count \+ 1, updated_at=\$1 WHERE id=\$2 AND locked_by=\$3`).
+		WithArgs(sqlmock.AnyArg(), "1", "instance-a").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
@@ -136,3 +187,210 @@ func TestIncrementRetryCount(t *testing.T) {
 
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestMarkProcessedBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
+
+	first, second := time.Now().Add(-time.Second), time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events AS e SET status=\$1, sent_at = s.sent_at, message_id = NULLIF\(s.message_id, ''\), locked_by=NULL, locked_until=NULL, updated_at=\$2 FROM unnest\(\$3::text\[\], \$4::timestamp\[\], \$5::text\[\]\) AS s\(id, sent_at, message_id\) WHERE e.id = s.id AND e.locked_by=\$6`).
+		WithArgs(schema.StatusSent, sqlmock.AnyArg(), pq.Array([]string{"1", "2"}), pq.Array([]time.Time{first, second}), pq.Array([]string{"msg-1", ""}), "instance-a").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	err = repo.MarkProcessedBatch(context.Background(), []SentEvent{
+		{EventID: "1", MessageID: "msg-1", SentAt: first},
+		{EventID: "2", SentAt: second},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMarkProcessedBatch_CommitsOwnedEventsWhenSomeLeasesAreLost(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events AS e SET status=\$1`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = repo.MarkProcessedBatch(context.Background(), []SentEvent{{EventID: "1", SentAt: time.Now()}, {EventID: "2", SentAt: time.Now()}})
+	assert.ErrorIs(t, err, ErrLeaseLost)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestScheduleRetryBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
+	first, second := time.Now().Add(time.Second), time.Now().Add(time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events AS e SET status=\$1, retry_count = e.retry_count \+ \$2, next_attempt_at = r.next_attempt_at, locked_by=NULL, locked_until=NULL, updated_at=\$3 FROM unnest\(\$4::text\[\], \$5::timestamp\[\]\) AS r\(id, next_attempt_at\) WHERE e.id = r.id AND e.locked_by=\$6`).
+		WithArgs(schema.StatusPending, 1, sqlmock.AnyArg(), pq.Array([]string{"1", "2"}), pq.Array([]time.Time{first, second}), "instance-a").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	err = repo.ScheduleRetryBatch(context.Background(), map[string]time.Time{"2": second, "1": first})
+	assert.NoError(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMarkProcessed_LeaseLost(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events SET status=\$1, sent_at=\$2`).
+		WithArgs(schema.StatusSent, sqlmock.AnyArg(), "", "1", "instance-a").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = repo.MarkProcessed(context.Background(), "1", "")
+	assert.ErrorIs(t, err, ErrLeaseLost)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRenewLease(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a", LeaseDuration: time.Minute}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events SET locked_until=\$1, updated_at=\$2 WHERE id=\$3 AND status=\$4 AND locked_by=\$5`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "1", schema.StatusProcessing, "instance-a").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err = repo.RenewLease(context.Background(), "1")
+	assert.NoError(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecordAttempts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a", AttemptHistory: true}
+	first, second := time.Now().Add(-time.Second), time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events AS e SET last_error = a.error FROM unnest\(\$1::text\[\], \$2::text\[\]\) AS a\(id, error\) WHERE e.id = a.id`).
+		WithArgs(pq.Array([]string{"1"}), pq.Array([]string{"nack"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO outbox_event_attempts \(event_id, attempted_at, instance_id, broker, error\)`).
+		WithArgs(pq.Array([]string{"1", "2"}), pq.Array([]time.Time{first, second}), pq.Array([]string{"instance-a", "instance-b"}),
+			pq.Array([]string{"rabbitmq", "rabbitmq"}), pq.Array([]string{"nack", ""})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	err = repo.RecordAttempts(context.Background(), []schema.EventAttempt{
+		{EventID: "1", AttemptedAt: first, Broker: "rabbitmq", Error: "nack"},
+		{EventID: "2", AttemptedAt: second, InstanceID: "instance-b", Broker: "rabbitmq"},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecordAttempts_OnlySetsLastErrorWithoutHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events AS e SET last_error = a.error`).
+		WithArgs(pq.Array([]string{"1"}), pq.Array([]string{"timeout"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = repo.RecordAttempts(context.Background(), []schema.EventAttempt{
+		{EventID: "1", AttemptedAt: time.Now(), Broker: "rabbitmq", Error: "nack"},
+		{EventID: "1", AttemptedAt: time.Now(), Broker: "rabbitmq", Error: "timeout"},
+		{EventID: "2", AttemptedAt: time.Now(), Broker: "rabbitmq"},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPurge(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db}
+	before := time.Now().Add(-time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM outbox_events WHERE id IN \(SELECT id FROM outbox_events WHERE status=\$1 AND updated_at < \$2 ORDER BY updated_at LIMIT \$3 FOR UPDATE SKIP LOCKED\)`).
+		WithArgs(schema.StatusSent, before, 100).
+		WillReturnResult(sqlmock.NewResult(0, 42))
+	mock.ExpectCommit()
+
+	purged, err := repo.Purge(context.Background(), schema.StatusSent, before, 100, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, purged)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPurge_Archive(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db}
+	before := time.Now().Add(-time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`WITH purged AS \(DELETE FROM outbox_events WHERE id IN \(SELECT id FROM outbox_events WHERE status=\$1 .*\) RETURNING \*\) INSERT INTO outbox_events_archive SELECT \* FROM purged`).
+		WithArgs(schema.StatusCanceled, before, 100).
+		WillReturnResult(sqlmock.NewResult(0, 7))
+	mock.ExpectCommit()
+
+	purged, err := repo.Purge(context.Background(), schema.StatusCanceled, before, 100, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, purged)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresRepository_SpansReportTheDBSystem(t *testing.T) {
+	spans := recordSpans(t)
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := &PostgresRepository{Db: db, InstanceID: "instance-a"}
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events AS e SET status=\$1`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.DeferBatch(context.Background(), map[string]time.Time{"1": time.Now()}))
+	assert.Equal(t, "postgresql", spanAttribute(spans, "DeferBatch", "db.system"))
+}
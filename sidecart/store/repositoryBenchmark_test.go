@@ -0,0 +1,321 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The benchmarks below compare claiming a batch of events, and writing their outcome, one
+// event at a time with the batch methods. Run them with
+//
+//	go test ./store -run '^$' -bench .
+//
+// The Postgres ones need OUTBOX_TEST_POSTGRES_DSN (see openPostgresTestDB) and the MongoDB
+// ones OUTBOX_TEST_MONGO_URI (see connectMongoTestClient).
+
+const benchmarkBatchSize = 100
+
+func benchmarkEventIDs(iteration int) []string {
+	ids := make([]string, benchmarkBatchSize)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("bench-%d-%d", iteration, i)
+	}
+	return ids
+}
+
+// sentEvents describes the publish of the given events, as the processor reports it.
+func sentEvents(ids []string) []SentEvent {
+	sent := make([]SentEvent, len(ids))
+	for i, id := range ids {
+		sent[i] = SentEvent{EventID: id, MessageID: "msg-" + id, SentAt: time.Now()}
+	}
+	return sent
+}
+
+func BenchmarkPostgresClaimOneByOne(b *testing.B) {
+	benchmarkPostgresClaim(b, func(repo *PostgresRepository) (int, error) {
+		return claimPostgresOneByOne(context.Background(), repo.Db, benchmarkBatchSize)
+	})
+}
+
+func BenchmarkPostgresFetchPending(b *testing.B) {
+	benchmarkPostgresClaim(b, func(repo *PostgresRepository) (int, error) {
+		events, err := repo.FetchPending(context.Background(), benchmarkBatchSize)
+		return len(events), err
+	})
+}
+
+// claimPostgresOneByOne claims pending events the way FetchPending did before claims were
+// batched: with one UPDATE, the former SetStatusAndIncrementRetry, per selected event.
+func claimPostgresOneByOne(ctx context.Context, db *sql.DB, batchSize int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id FROM outbox_events WHERE status='pending' ORDER BY created_at FOR UPDATE SKIP LOCKED LIMIT $1`, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE outbox_events SET status='processing', retry_count = retry_count + 1, locked_by='bench', locked_until=$1, updated_at=$2 WHERE id=$3`,
+			time.Now().Add(time.Hour), time.Now(), id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), tx.Commit()
+}
+
+func benchmarkPostgresClaim(b *testing.B, claim func(repo *PostgresRepository) (int, error)) {
+	db, _ := openPostgresTestDB(b)
+	repo := &PostgresRepository{Db: db, InstanceID: "bench"}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, id := range benchmarkEventIDs(i) {
+			insertPostgresTestEvent(b, db, id)
+		}
+		b.StartTimer()
+
+		claimed, err := claim(repo)
+		require.NoError(b, err)
+		require.Equal(b, benchmarkBatchSize, claimed)
+	}
+}
+
+func BenchmarkPostgresMarkProcessed(b *testing.B) {
+	benchmarkPostgres(b, func(repo *PostgresRepository, ids []string) error {
+		for _, id := range ids {
+			if err := repo.MarkProcessed(context.Background(), id, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkPostgresMarkProcessedBatch(b *testing.B) {
+	benchmarkPostgres(b, func(repo *PostgresRepository, ids []string) error {
+		return repo.MarkProcessedBatch(context.Background(), sentEvents(ids))
+	})
+}
+
+func BenchmarkPostgresScheduleRetry(b *testing.B) {
+	benchmarkPostgres(b, func(repo *PostgresRepository, ids []string) error {
+		for _, id := range ids {
+			if err := repo.ScheduleRetry(context.Background(), id, time.Now().Add(time.Minute)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkPostgresScheduleRetryBatch(b *testing.B) {
+	benchmarkPostgres(b, func(repo *PostgresRepository, ids []string) error {
+		nextAttempts := make(map[string]time.Time, len(ids))
+		for _, id := range ids {
+			nextAttempts[id] = time.Now().Add(time.Minute)
+		}
+		return repo.ScheduleRetryBatch(context.Background(), nextAttempts)
+	})
+}
+
+func benchmarkPostgres(b *testing.B, update func(repo *PostgresRepository, ids []string) error) {
+	db, _ := openPostgresTestDB(b)
+	repo := &PostgresRepository{Db: db, InstanceID: "bench"}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		ids := benchmarkEventIDs(i)
+		for _, id := range ids {
+			insertPostgresTestEvent(b, db, id)
+		}
+		_, err := db.Exec(`UPDATE outbox_events SET status='processing', locked_by='bench', locked_until=now() + interval '1 hour'
+             WHERE id = ANY($1)`, pq.Array(ids))
+		require.NoError(b, err)
+		b.StartTimer()
+
+		require.NoError(b, update(repo, ids))
+	}
+}
+
+func BenchmarkSpannerMarkProcessed(b *testing.B) {
+	benchmarkSpanner(b, func(repo OutBoxRepository, ids []string) error {
+		for _, id := range ids {
+			if err := repo.MarkProcessed(context.Background(), id, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkSpannerMarkProcessedBatch(b *testing.B) {
+	benchmarkSpanner(b, func(repo OutBoxRepository, ids []string) error {
+		return repo.MarkProcessedBatch(context.Background(), sentEvents(ids))
+	})
+}
+
+func BenchmarkSpannerScheduleRetry(b *testing.B) {
+	benchmarkSpanner(b, func(repo OutBoxRepository, ids []string) error {
+		for _, id := range ids {
+			if err := repo.ScheduleRetry(context.Background(), id, time.Now().Add(time.Minute)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkSpannerScheduleRetryBatch(b *testing.B) {
+	benchmarkSpanner(b, func(repo OutBoxRepository, ids []string) error {
+		nextAttempts := make(map[string]time.Time, len(ids))
+		for _, id := range ids {
+			nextAttempts[id] = time.Now().Add(time.Minute)
+		}
+		return repo.ScheduleRetryBatch(context.Background(), nextAttempts)
+	})
+}
+
+func benchmarkSpanner(b *testing.B, update func(repo OutBoxRepository, ids []string) error) {
+	client, cleanup := setupSpannerTestServer(b)
+	defer cleanup()
+	repo := NewSpannerRepositoryFactory(client, config.DbSettings{InstanceID: "bench"}, nil)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var mutations []*spanner.Mutation
+		ids := benchmarkEventIDs(i)
+		for _, id := range ids {
+			mutations = append(mutations, spanner.Insert("outbox",
+				[]string{"id", "entity", "entity_type", "payload", "status", "created_at", "updated_at", "retry_count", "routing_key", "locked_by", "locked_until"},
+				[]interface{}{id, "orders", "direct", []byte(`{}`), string(schema.StatusProcessing), time.Now(), time.Now(), 0, "", "bench", time.Now().Add(time.Hour)}))
+		}
+		_, err := client.Apply(context.Background(), mutations)
+		require.NoError(b, err)
+		b.StartTimer()
+
+		require.NoError(b, update(repo, ids))
+	}
+}
+
+func BenchmarkMongoClaimOneByOne(b *testing.B) {
+	benchmarkMongo(b, false, func(repo *MongoRepository, ids []string) error {
+		ctx := context.Background()
+		cursor, err := repo.events().Find(ctx, claimableFilter(time.Now()))
+		if err != nil {
+			return err
+		}
+		var events []schema.OutboxEvent
+		if err := cursor.All(ctx, &events); err != nil {
+			return err
+		}
+		// One UpdateOne per event, as before claims were batched.
+		for _, event := range events {
+			filter := claimableFilter(time.Now())
+			filter["id"] = event.ID
+			update := bson.M{"$set": bson.M{
+				"status":       schema.StatusProcessing,
+				"locked_by":    repo.instanceID,
+				"locked_until": time.Now().Add(time.Hour),
+				"updated_at":   time.Now(),
+			}}
+			if _, err := repo.events().UpdateOne(ctx, filter, update); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkMongoFetchPending(b *testing.B) {
+	benchmarkMongo(b, false, func(repo *MongoRepository, ids []string) error {
+		events, err := repo.FetchPending(context.Background(), benchmarkBatchSize)
+		if err == nil && len(events) != len(ids) {
+			err = fmt.Errorf("claimed %d of %d events", len(events), len(ids))
+		}
+		return err
+	})
+}
+
+func BenchmarkMongoMarkProcessed(b *testing.B) {
+	benchmarkMongo(b, true, func(repo *MongoRepository, ids []string) error {
+		for _, id := range ids {
+			if err := repo.MarkProcessed(context.Background(), id, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkMongoMarkProcessedBatch(b *testing.B) {
+	benchmarkMongo(b, true, func(repo *MongoRepository, ids []string) error {
+		return repo.MarkProcessedBatch(context.Background(), sentEvents(ids))
+	})
+}
+
+// benchmarkMongo inserts a batch of pending events, or of events claimed by the benchmark
+// repository if claimed is set, before every run of update.
+func benchmarkMongo(b *testing.B, claimed bool, update func(repo *MongoRepository, ids []string) error) {
+	client, database := connectMongoTestClient(b)
+	repo := NewMongoRepository(client, config.DbSettings{DBName: database, InstanceID: "bench", LeaseDuration: time.Hour}, nil)
+	require.NoError(b, repo.EnsureIndexes(context.Background()))
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		ids := benchmarkEventIDs(i)
+		require.NoError(b, insertMongoBenchmarkEvents(repo.events(), ids, claimed))
+		b.StartTimer()
+
+		require.NoError(b, update(repo, ids))
+	}
+}
+
+func insertMongoBenchmarkEvents(events *mongo.Collection, ids []string, claimed bool) error {
+	documents := make([]interface{}, len(ids))
+	now := time.Now()
+	for i, id := range ids {
+		document := bson.M{
+			"id": id, "entity": "orders", "entity_type": "direct", "payload": []byte(`{}`),
+			"status": schema.StatusPending, "created_at": now, "updated_at": now, "retry_count": 0,
+		}
+		if claimed {
+			document["status"] = schema.StatusProcessing
+			document["locked_by"] = "bench"
+			document["locked_until"] = now.Add(time.Hour)
+		}
+		documents[i] = document
+	}
+	_, err := events.InsertMany(context.Background(), documents)
+	return err
+}
@@ -7,28 +7,94 @@ import (
 
 	"cloud.google.com/go/spanner"
 	"github.com/zoff-tech/go-outbox/config"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
 
-var NewSpannerRepositoryFactory = func(client *spanner.Client) OutBoxRepository {
-	return &SpannerRepository{client: client}
+// defaultMongoCollection is the outbox collection used when DbSettings.Collection is empty.
+const defaultMongoCollection = "outbox_events"
+
+// mongoAttemptsCollection holds the attempt history of MongoDB outboxes.
+const mongoAttemptsCollection = "outbox_event_attempts"
+
+var NewSpannerRepositoryFactory = func(client *spanner.Client, cfg config.DbSettings, retryPolicy *config.RetryPolicy) OutBoxRepository {
+	return &SpannerRepository{
+		client:         client,
+		retryPolicy:    retryPolicy,
+		instanceID:     resolveInstanceID(cfg.InstanceID),
+		leaseDuration:  resolveLeaseDuration(cfg.LeaseDuration),
+		attemptHistory: cfg.RecordAttempts,
+	}
 }
 
-func NewRepository(ctx context.Context, cfg config.DbSettings) (OutBoxRepository, error) {
+// NewRepository creates the repository selected by cfg.Type. The retry policy decides
+// when fetched events have exhausted their retries and must not be claimed again.
+func NewRepository(ctx context.Context, cfg config.DbSettings, retryPolicy *config.RetryPolicy) (OutBoxRepository, error) {
 	switch cfg.Type {
 	case "postgres":
 		db, err := sql.Open("postgres", cfg.DSN)
 		if err != nil {
 			return nil, err
 		}
-		return &PostgresRepository{Db: db}, nil
+		repo := &PostgresRepository{
+			Db:             db,
+			RetryPolicy:    retryPolicy,
+			InstanceID:     resolveInstanceID(cfg.InstanceID),
+			LeaseDuration:  cfg.LeaseDuration,
+			AttemptHistory: cfg.RecordAttempts,
+		}
+		if cfg.NotifyChannel != "" {
+			if err := repo.CheckNotifyTrigger(ctx, cfg.NotifyChannel); err != nil {
+				db.Close()
+				return nil, err
+			}
+			repo.Listen(cfg.DSN, cfg.NotifyChannel)
+		}
+		return repo, nil
+	case "mysql":
+		db, err := OpenMySQL(cfg.DSN)
+		if err != nil {
+			return nil, err
+		}
+		return &MySQLRepository{
+			Db:             db,
+			RetryPolicy:    retryPolicy,
+			InstanceID:     resolveInstanceID(cfg.InstanceID),
+			LeaseDuration:  cfg.LeaseDuration,
+			AttemptHistory: cfg.RecordAttempts,
+		}, nil
+	case "sqlite":
+		db, err := OpenSQLite(cfg.DSN, cfg.BusyTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &SQLiteRepository{
+			Db:             db,
+			RetryPolicy:    retryPolicy,
+			InstanceID:     resolveInstanceID(cfg.InstanceID),
+			LeaseDuration:  cfg.LeaseDuration,
+			AttemptHistory: cfg.RecordAttempts,
+		}, nil
 	case "spanner":
 		client, err := spanner.NewClient(ctx, cfg.URI)
 		if err != nil {
 			return nil, err
 		}
-		return NewSpannerRepositoryFactory(client), nil
+		return NewSpannerRepositoryFactory(client, cfg, retryPolicy), nil
+	case "mongo":
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.URI))
+		if err != nil {
+			return nil, err
+		}
+		repo := NewMongoRepository(client, cfg, retryPolicy)
+		if err := repo.EnsureIndexes(ctx); err != nil {
+			client.Disconnect(ctx)
+			return nil, fmt.Errorf("failed to create MongoDB indexes: %w", err)
+		}
+		repo.Watch(ctx)
+		return repo, nil
 	default:
 		return nil, fmt.Errorf("unsupported DB type: %s", cfg.Type)
 	}
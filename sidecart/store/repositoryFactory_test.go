@@ -4,13 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"cloud.google.com/go/spanner"
 	"cloud.google.com/go/spanner/spannertest"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var sqlOpen = sql.Open
@@ -33,7 +37,7 @@ func TestNewRepository_Postgres(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	repo, err := NewRepository(ctx, cfg)
+	repo, err := NewRepository(ctx, cfg, nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, repo)
 	assert.IsType(t, &PostgresRepository{}, repo)
@@ -41,28 +45,89 @@ func TestNewRepository_Postgres(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
-// func TestNewRepository_Mongo(t *testing.T) {
-// 	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
-// 	defer mt.Client.Disconnect(context.Background())
-
-// 	cfg := config.DbSettings{
-// 		Type:   "mongo",
-// 		URI:    "mongodb://localhost:27017",
-// 		DBName: "testdb",
-// 	}
-
-// 	ctx := context.Background()
-// 	mt.Run("create mongo repository", func(mt *mtest.T) {
-// 		client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.URI))
-// 		assert.NoError(t, err)
-// 		defer client.Disconnect(ctx)
-
-// 		repo, err := NewRepository(ctx, cfg)
-// 		assert.NoError(t, err)
-// 		assert.NotNil(t, repo)
-// 		assert.IsType(t, &MongoRepository{}, repo)
-// 	})
-// }
+func TestNewRepository_MySQL(t *testing.T) {
+	cfg := config.DbSettings{
+		Type:           "mysql",
+		DSN:            "user:pass@tcp(localhost:3306)/appdb",
+		InstanceID:     "sidecar-0",
+		RecordAttempts: true,
+	}
+
+	// The connection is opened lazily, so no server is needed.
+	repo, err := NewRepository(context.Background(), cfg, nil)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	mysqlRepo, ok := repo.(*MySQLRepository)
+	require.True(t, ok)
+	assert.Equal(t, "sidecar-0", mysqlRepo.InstanceID)
+	assert.True(t, mysqlRepo.AttemptHistory)
+
+	_, err = NewRepository(context.Background(), config.DbSettings{Type: "mysql", DSN: "not a dsn"}, nil)
+	assert.Error(t, err)
+}
+
+func TestNewRepository_SQLite(t *testing.T) {
+	cfg := config.DbSettings{
+		Type:       "sqlite",
+		DSN:        filepath.Join(t.TempDir(), "outbox.db"),
+		InstanceID: "sidecar-0",
+	}
+
+	repo, err := NewRepository(context.Background(), cfg, nil)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	sqliteRepo, ok := repo.(*SQLiteRepository)
+	require.True(t, ok)
+	assert.Equal(t, "sidecar-0", sqliteRepo.InstanceID)
+	assert.NoError(t, sqliteRepo.Db.Ping())
+}
+
+func TestNewRepository_Mongo(t *testing.T) {
+	client, database := connectMongoTestClient(t)
+
+	cfg := config.DbSettings{
+		Type:   "mongo",
+		URI:    os.Getenv("OUTBOX_TEST_MONGO_URI"),
+		DBName: database,
+	}
+
+	ctx := context.Background()
+	repo, err := NewRepository(ctx, cfg, nil)
+	require.NoError(t, err)
+	defer repo.Close()
+	assert.IsType(t, &MongoRepository{}, repo)
+
+	// The repository creates its indexes on the default collection.
+	collection := client.Database(database).Collection(defaultMongoCollection)
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	require.NoError(t, err)
+	var names []string
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	assert.Contains(t, names, "id_1")
+	assert.Contains(t, names, "status_1_next_attempt_at_1")
+	assert.Contains(t, names, "status_1_locked_until_1")
+	assert.Contains(t, names, "status_1_updated_at_1")
+
+	event := schema.NewEvent("1", "orders", "direct", []byte(`{"id":42}`), nil, "order.created")
+	_, err = collection.InsertOne(ctx, event)
+	require.NoError(t, err)
+
+	events, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, event.ID, events[0].ID)
+	assert.NoError(t, repo.MarkProcessed(ctx, event.ID, "msg-1"))
+
+	var stored schema.OutboxEvent
+	require.NoError(t, collection.FindOne(ctx, bson.M{"id": event.ID}).Decode(&stored))
+	assert.Equal(t, schema.StatusSent, stored.Status)
+	assert.Equal(t, "msg-1", stored.MessageID)
+	assert.False(t, stored.SentAt.IsZero())
+}
 
 func TestNewRepository_Unsupported(t *testing.T) {
 	cfg := config.DbSettings{
@@ -70,7 +135,7 @@ func TestNewRepository_Unsupported(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	repo, err := NewRepository(ctx, cfg)
+	repo, err := NewRepository(ctx, cfg, nil)
 	assert.Error(t, err)
 	assert.Nil(t, repo)
 	assert.Equal(t, "unsupported DB type: unsupported", err.Error())
@@ -102,13 +167,13 @@ func TestNewRepository_Spanner(t *testing.T) {
 
 	// Override the NewSpannerRepositoryFactory function to use the mock client
 	originalFactory := NewSpannerRepositoryFactory
-	NewSpannerRepositoryFactory = func(client *spanner.Client) OutBoxRepository {
-		return &SpannerRepository{client: client}
+	NewSpannerRepositoryFactory = func(client *spanner.Client, cfg config.DbSettings, retryPolicy *config.RetryPolicy) OutBoxRepository {
+		return &SpannerRepository{client: client, retryPolicy: retryPolicy, instanceID: cfg.InstanceID}
 	}
 	defer func() { NewSpannerRepositoryFactory = originalFactory }()
 
 	// Call NewRepository
-	repo, err := NewRepository(ctx, cfg)
+	repo, err := NewRepository(ctx, cfg, nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, repo)
 	assert.IsType(t, &SpannerRepository{}, repo)
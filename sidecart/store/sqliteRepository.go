@@ -0,0 +1,379 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"go.opentelemetry.io/otel"
+
+	_ "modernc.org/sqlite" // SQLite driver, pure Go
+)
+
+// DefaultSQLiteBusyTimeout is how long a write waits for the database lock held by another
+// connection before it fails with SQLITE_BUSY.
+const DefaultSQLiteBusyTimeout = 5 * time.Second
+
+// SQLiteRepository stores the outbox in a SQLite database file, for single-node services and
+// local development. Open the database with OpenSQLite.
+//
+// SQLite has no row locks, so claiming relies on a single writer instead: every transaction
+// begins IMMEDIATE and takes the database write lock up front. Claims made by several
+// sidecars sharing the file are serialized by the lock rather than racing, and a fetched
+// event cannot be claimed twice.
+type SQLiteRepository struct {
+	Db          *sql.DB
+	RetryPolicy *config.RetryPolicy
+	// InstanceID owns the leases of the events claimed through this repository.
+	InstanceID string
+	// LeaseDuration is how long a claim lasts unless renewed (default DefaultLeaseDuration).
+	LeaseDuration time.Duration
+	// AttemptHistory keeps every publish attempt in outbox_event_attempts.
+	AttemptHistory bool
+}
+
+// OpenSQLite opens the database file in dsn in WAL mode, so that the application keeps
+// reading while the sidecar writes, with foreign keys enforced and writers waiting up to
+// busyTimeout (default DefaultSQLiteBusyTimeout) for the lock. Transactions begin IMMEDIATE
+// and the pool holds a single connection, which makes the process a single writer.
+//
+// Timestamps are written as UTC text in SQLite's own format, so they compare in time order.
+func OpenSQLite(dsn string, busyTimeout time.Duration) (*sql.DB, error) {
+	if busyTimeout <= 0 {
+		busyTimeout = DefaultSQLiteBusyTimeout
+	}
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "foreign_keys(ON)")
+	params.Set("_txlock", "immediate")
+	params.Set("_time_format", "sqlite")
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite", dsn+separator+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func (s *SQLiteRepository) FetchPending(ctx context.Context, batchSize int) ([]schema.OutboxEvent, error) {
+	var claimed []schema.OutboxEvent
+	err := s.withTransaction(ctx, "FetchPending", func(ctx context.Context, tx *sql.Tx) error {
+		now := time.Now().UTC()
+		rows, err := tx.QueryContext(ctx,
+			`SELECT id, entity, entity_type, payload, retry_count, headers, routing_key, created_at FROM outbox_events
+             WHERE ((status='pending' AND (next_attempt_at IS NULL OR next_attempt_at <= ?1)) OR (status='processing' AND (locked_until IS NULL OR locked_until < ?1)))
+             ORDER BY created_at LIMIT ?2`, now, batchSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var events []schema.OutboxEvent
+		for rows.Next() {
+			var event schema.OutboxEvent
+			var rawHeaders sql.NullString
+			if err := rows.Scan(&event.ID,
+				&event.Entity,
+				&event.EntityType,
+				&event.Payload,
+				&event.RetryCount,
+				&rawHeaders,
+				&event.RoutingKey,
+				&event.CreatedAt); err != nil {
+				return err
+			}
+
+			if rawHeaders.String != "" {
+				if err := json.Unmarshal([]byte(rawHeaders.String), &event.Headers); err != nil {
+					return errors.New("failed to parse headers: " + err.Error())
+				}
+			}
+
+			events = append(events, event)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Claim the fetched events while holding the write lock. Events already retried
+		// beyond their limit (possible after the limit was lowered) are marked failed and
+		// not returned.
+		var claimedIDs, exceededIDs []string
+		for _, event := range events {
+			if event.RetryCount > s.RetryPolicy.MaxRetriesFor(event.Entity) {
+				exceededIDs = append(exceededIDs, event.ID)
+				continue
+			}
+			claimedIDs = append(claimedIDs, event.ID)
+			claimed = append(claimed, event)
+		}
+
+		if len(exceededIDs) > 0 {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events SET status=?, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id IN (`+placeholders(len(exceededIDs))+`)`,
+				append([]interface{}{schema.StatusFailed, now}, stringArgs(exceededIDs)...)...); err != nil {
+				return err
+			}
+		}
+		if len(claimedIDs) > 0 {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events SET status=?, locked_by=?, locked_until=?, updated_at=? WHERE id IN (`+placeholders(len(claimedIDs))+`)`,
+				append([]interface{}{schema.StatusProcessing, s.InstanceID, now.Add(resolveLeaseDuration(s.LeaseDuration)), now}, stringArgs(claimedIDs)...)...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (s *SQLiteRepository) MarkProcessed(ctx context.Context, eventID, messageID string) error {
+	now := time.Now().UTC()
+	return s.execOwned(ctx, "MarkProcessed",
+		`UPDATE outbox_events SET status=?1, sent_at=?2, message_id=NULLIF(?3, ''), locked_by=NULL, locked_until=NULL, updated_at=?2 WHERE id=?4 AND locked_by=?5`,
+		schema.StatusSent, now, messageID, eventID, s.InstanceID)
+}
+
+// MarkProcessedBatch updates the events one statement at a time in a single transaction,
+// which is as fast as a joined update on SQLite since there is no round trip per statement.
+func (s *SQLiteRepository) MarkProcessedBatch(ctx context.Context, sent []SentEvent) error {
+	now := time.Now().UTC()
+	args := make([][]interface{}, len(sent))
+	for i, event := range sent {
+		args[i] = []interface{}{schema.StatusSent, event.SentAt.UTC(), event.MessageID, now, event.EventID, s.InstanceID}
+	}
+	return s.execOwnedBatch(ctx, "MarkProcessedBatch",
+		`UPDATE outbox_events SET status=?1, sent_at=?2, message_id=NULLIF(?3, ''), locked_by=NULL, locked_until=NULL, updated_at=?4 WHERE id=?5 AND locked_by=?6`,
+		args)
+}
+
+// SetStatus sets the status of an event claimed by this instance and releases its lease.
+func (s *SQLiteRepository) SetStatus(ctx context.Context, eventID string, status schema.Status) error {
+	return s.execOwned(ctx, "SetStatus",
+		`UPDATE outbox_events SET status=?, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id=? AND locked_by=?`,
+		status, time.Now().UTC(), eventID, s.InstanceID)
+}
+
+func (s *SQLiteRepository) SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error {
+	return s.execOwned(ctx, "SetStatusAndIncrementRetry",
+		`UPDATE outbox_events SET status=?, retry_count = retry_count + 1, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id=? AND locked_by=?`,
+		status, time.Now().UTC(), eventID, s.InstanceID)
+}
+
+func (s *SQLiteRepository) ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) error {
+	return s.execOwned(ctx, "ScheduleRetry",
+		`UPDATE outbox_events SET status=?, retry_count = retry_count + 1, next_attempt_at=?, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id=? AND locked_by=?`,
+		schema.StatusPending, nextAttemptAt.UTC(), time.Now().UTC(), eventID, s.InstanceID)
+}
+
+func (s *SQLiteRepository) ScheduleRetryBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return s.deferBatch(ctx, "ScheduleRetryBatch", nextAttempts, 1)
+}
+
+func (s *SQLiteRepository) DeferBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return s.deferBatch(ctx, "DeferBatch", nextAttempts, 0)
+}
+
+// deferBatch sets the events back to pending until their next attempts, adding retries to
+// their retry counts.
+func (s *SQLiteRepository) deferBatch(ctx context.Context, op string, nextAttempts map[string]time.Time, retries int) error {
+	now := time.Now().UTC()
+	ids, times := sortedRetries(nextAttempts)
+	args := make([][]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = []interface{}{schema.StatusPending, retries, times[i].UTC(), now, id, s.InstanceID}
+	}
+	return s.execOwnedBatch(ctx, op,
+		`UPDATE outbox_events SET status=?, retry_count = retry_count + ?, next_attempt_at=?, locked_by=NULL, locked_until=NULL, updated_at=? WHERE id=? AND locked_by=?`,
+		args)
+}
+
+func (s *SQLiteRepository) IncrementRetryCount(ctx context.Context, eventID string) error {
+	return s.execOwned(ctx, "IncrementRetryCount",
+		`UPDATE outbox_events SET retry_count = retry_count + 1, updated_at=? WHERE id=? AND locked_by=?`,
+		time.Now().UTC(), eventID, s.InstanceID)
+}
+
+func (s *SQLiteRepository) RenewLease(ctx context.Context, eventID string) error {
+	now := time.Now().UTC()
+	return s.execOwned(ctx, "RenewLease",
+		`UPDATE outbox_events SET locked_until=?, updated_at=? WHERE id=? AND status=? AND locked_by=?`,
+		now.Add(resolveLeaseDuration(s.LeaseDuration)), now, eventID, schema.StatusProcessing, s.InstanceID)
+}
+
+// RecordAttempts writes the last errors and the attempt history in one transaction.
+// Attempts of events that no longer exist are skipped.
+func (s *SQLiteRepository) RecordAttempts(ctx context.Context, attempts []schema.EventAttempt) error {
+	attempts, failedIDs, lastErrors := attributeAttempts(attempts, s.InstanceID)
+	if len(failedIDs) == 0 && (!s.AttemptHistory || len(attempts) == 0) {
+		return nil
+	}
+	return s.withTransaction(ctx, "RecordAttempts", func(ctx context.Context, tx *sql.Tx) error {
+		for i, id := range failedIDs {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE outbox_events SET last_error=? WHERE id=?`, lastErrors[i], id); err != nil {
+				return err
+			}
+		}
+		if !s.AttemptHistory {
+			return nil
+		}
+
+		for _, attempt := range attempts {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO outbox_event_attempts (event_id, attempted_at, instance_id, broker, error)
+                 SELECT id, ?2, ?3, ?4, NULLIF(?5, '') FROM outbox_events WHERE id=?1`,
+				attempt.EventID, attempt.AttemptedAt.UTC(), attempt.InstanceID, attempt.Broker, attempt.Error); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Purge deletes the oldest matching events by ID. With archive set, they are copied to
+// outbox_events_archive first. Their attempts are deleted by the foreign key cascade.
+func (s *SQLiteRepository) Purge(ctx context.Context, status schema.Status, before time.Time, limit int, archive bool) (int, error) {
+	var purged int64
+	err := s.withTransaction(ctx, "Purge", func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT id FROM outbox_events WHERE status=? AND updated_at < ? ORDER BY updated_at LIMIT ?`,
+			status, before.UTC(), limit)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil || len(ids) == 0 {
+			return err
+		}
+
+		if archive {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO outbox_events_archive SELECT * FROM outbox_events WHERE id IN (`+placeholders(len(ids))+`)`,
+				stringArgs(ids)...); err != nil {
+				return err
+			}
+		}
+		result, err := tx.ExecContext(ctx,
+			`DELETE FROM outbox_events WHERE id IN (`+placeholders(len(ids))+`)`, stringArgs(ids)...)
+		if err != nil {
+			return err
+		}
+		purged, err = result.RowsAffected()
+		return err
+	})
+	return int(purged), err
+}
+
+func (s *SQLiteRepository) Close() error {
+	return s.Db.Close()
+}
+
+// execOwned runs an update restricted to events whose lease this instance holds and
+// returns ErrLeaseLost when it matched no row.
+func (s *SQLiteRepository) execOwned(ctx context.Context, spanName string, query string, args ...interface{}) error {
+	return s.withTransaction(ctx, spanName, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrLeaseLost
+		}
+		return nil
+	})
+}
+
+// execOwnedBatch runs the update once per argument list, restricted to events whose lease
+// this instance holds. The updates are committed even when some leases were lost, in which
+// case it returns ErrLeaseLost.
+func (s *SQLiteRepository) execOwnedBatch(ctx context.Context, spanName string, query string, args [][]interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	var affected int64
+	err := s.withTransaction(ctx, spanName, func(ctx context.Context, tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, rowArgs := range args {
+			result, err := stmt.ExecContext(ctx, rowArgs...)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			affected += n
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if affected < int64(len(args)) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (s *SQLiteRepository) withTransaction(ctx context.Context, spanName string, fn func(ctx context.Context, tx *sql.Tx) error) (err error) {
+	tracer := otel.Tracer("go-outbox")
+	ctx, span := tracer.Start(ctx, spanName)
+	defer span.End()
+
+	startTime := time.Now()
+	tx, err := s.Db.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			span.RecordError(err)
+		} else if err = tx.Commit(); err != nil {
+			span.RecordError(err)
+		}
+	}()
+
+	if err = fn(ctx, tx); err != nil {
+		return err
+	}
+
+	addDBStatsToSpan(span, dbSystemSQLite, spanName, 0, time.Since(startTime))
+	return nil
+}
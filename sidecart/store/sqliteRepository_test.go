@@ -0,0 +1,360 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+)
+
+// openSQLiteTestDB creates a database file in a temporary directory with the outbox schema
+// from deployment/migrations/sqlite.
+func openSQLiteTestDB(t testing.TB) *sql.DB {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "outbox.db"), 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	ups, err := filepath.Glob(filepath.Join("..", "..", "deployment", "migrations", "sqlite", "*.up.sql"))
+	require.NoError(t, err)
+	require.NotEmpty(t, ups)
+	sort.Strings(ups)
+	for _, file := range ups {
+		statements, err := os.ReadFile(file)
+		require.NoError(t, err)
+		_, err = db.Exec(string(statements))
+		require.NoError(t, err, file)
+	}
+
+	return db
+}
+
+func newSQLiteTestRepository(db *sql.DB, instanceID string) *SQLiteRepository {
+	return &SQLiteRepository{Db: db, RetryPolicy: &config.RetryPolicy{MaxRetries: 3}, InstanceID: instanceID}
+}
+
+func insertSQLiteTestEvent(t testing.TB, db *sql.DB, id string, createdAt time.Time) {
+	_, err := db.Exec(`INSERT INTO outbox_events (id, entity, entity_type, payload, headers, routing_key, created_at, updated_at)
+		VALUES (?, 'orders', 'direct', 'payload', '{"trace":"abc"}', 'key', ?, ?)`, id, createdAt.UTC(), createdAt.UTC())
+	require.NoError(t, err)
+}
+
+func readSQLiteTestEvent(t *testing.T, db *sql.DB, id string) (status string, lockedBy sql.NullString, retryCount int) {
+	err := db.QueryRow(`SELECT status, locked_by, retry_count FROM outbox_events WHERE id=?`, id).
+		Scan(&status, &lockedBy, &retryCount)
+	require.NoError(t, err)
+	return status, lockedBy, retryCount
+}
+
+func TestOpenSQLite_EnablesWALAndForeignKeys(t *testing.T) {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "outbox.db"), 2*time.Second)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var journalMode string
+	var foreignKeys, busyTimeout int
+	require.NoError(t, db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode))
+	require.NoError(t, db.QueryRow(`PRAGMA foreign_keys`).Scan(&foreignKeys))
+	require.NoError(t, db.QueryRow(`PRAGMA busy_timeout`).Scan(&busyTimeout))
+	assert.Equal(t, "wal", journalMode)
+	assert.Equal(t, 1, foreignKeys)
+	assert.Equal(t, 2000, busyTimeout)
+}
+
+func TestSQLiteFetchPending(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-a")
+
+	now := time.Now()
+	insertSQLiteTestEvent(t, db, "2", now.Add(-time.Minute))
+	insertSQLiteTestEvent(t, db, "1", now.Add(-2*time.Minute))
+	insertSQLiteTestEvent(t, db, "3", now)
+
+	events, err := repo.FetchPending(context.Background(), 2)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "1", events[0].ID)
+	assert.Equal(t, "2", events[1].ID)
+	assert.Equal(t, "orders", events[0].Entity)
+	assert.Equal(t, []byte("payload"), events[0].Payload)
+	assert.Equal(t, map[string]string{"trace": "abc"}, events[0].Headers)
+	assert.Equal(t, "key", events[0].RoutingKey)
+	assert.WithinDuration(t, now.Add(-2*time.Minute), events[0].CreatedAt, time.Microsecond)
+
+	status, lockedBy, _ := readSQLiteTestEvent(t, db, "1")
+	assert.Equal(t, string(schema.StatusProcessing), status)
+	assert.Equal(t, "instance-a", lockedBy.String)
+}
+
+func TestSQLiteRepository_SpansReportTheDBSystem(t *testing.T) {
+	spans := recordSpans(t)
+	db := openSQLiteTestDB(t)
+	insertSQLiteTestEvent(t, db, "1", time.Now())
+
+	events, err := newSQLiteTestRepository(db, "instance-a").FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "sqlite", spanAttribute(spans, "FetchPending", "db.system"))
+}
+
+func TestSQLiteFetchPending_ReclaimsExpiredLeasesOnly(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-b")
+
+	insertSQLiteTestEvent(t, db, "expired", time.Now().Add(-time.Minute))
+	insertSQLiteTestEvent(t, db, "leased", time.Now())
+	_, err := db.Exec(`UPDATE outbox_events SET status='processing', locked_by='instance-a', locked_until=? WHERE id='expired'`,
+		time.Now().Add(-time.Second).UTC())
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE outbox_events SET status='processing', locked_by='instance-a', locked_until=? WHERE id='leased'`,
+		time.Now().Add(time.Minute).UTC())
+	require.NoError(t, err)
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "expired", events[0].ID)
+}
+
+func TestSQLiteFetchPending_SkipsEventsScheduledLater(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-a")
+
+	insertSQLiteTestEvent(t, db, "1", time.Now())
+	_, err := db.Exec(`UPDATE outbox_events SET next_attempt_at=? WHERE id='1'`, time.Now().Add(time.Minute).UTC())
+	require.NoError(t, err)
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestSQLiteFetchPending_MarksEventsOverTheirRetryLimitFailed(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-a")
+
+	insertSQLiteTestEvent(t, db, "1", time.Now())
+	_, err := db.Exec(`UPDATE outbox_events SET retry_count=4 WHERE id='1'`)
+	require.NoError(t, err)
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	status, lockedBy, _ := readSQLiteTestEvent(t, db, "1")
+	assert.Equal(t, string(schema.StatusFailed), status)
+	assert.False(t, lockedBy.Valid)
+}
+
+func TestSQLiteFetchPending_ConcurrentFetchesClaimEachEventOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	migrated, err := OpenSQLite(path, 0)
+	require.NoError(t, err)
+	statements, err := os.ReadFile(filepath.Join("..", "..", "deployment", "migrations", "sqlite", "0001_create_outbox_events_table.up.sql"))
+	require.NoError(t, err)
+	_, err = migrated.Exec(string(statements))
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		insertSQLiteTestEvent(t, migrated, fmt.Sprintf("event-%02d", i), time.Now())
+	}
+	require.NoError(t, migrated.Close())
+
+	// Each sidecar has its own connection to the file, as separate processes would.
+	var mu sync.Mutex
+	claims := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		db, err := OpenSQLite(path, 0)
+		require.NoError(t, err)
+		defer db.Close()
+		repo := newSQLiteTestRepository(db, fmt.Sprintf("instance-%d", i))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				events, err := repo.FetchPending(context.Background(), 5)
+				if !assert.NoError(t, err) || len(events) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, event := range events {
+					claims[event.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claims, 50)
+	for id, count := range claims {
+		assert.Equal(t, 1, count, id)
+	}
+}
+
+func TestSQLiteMarkProcessed(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-a")
+	other := newSQLiteTestRepository(db, "instance-b")
+	ctx := context.Background()
+
+	insertSQLiteTestEvent(t, db, "1", time.Now())
+	_, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, other.MarkProcessed(ctx, "1", "msg-1"), ErrLeaseLost)
+	require.NoError(t, repo.MarkProcessed(ctx, "1", "msg-1"))
+
+	var status, messageID string
+	var sentAt time.Time
+	require.NoError(t, db.QueryRow(`SELECT status, message_id, sent_at FROM outbox_events WHERE id='1'`).Scan(&status, &messageID, &sentAt))
+	assert.Equal(t, string(schema.StatusSent), status)
+	assert.Equal(t, "msg-1", messageID)
+	assert.WithinDuration(t, time.Now(), sentAt, 5*time.Second)
+}
+
+func TestSQLiteSetStatusAndRetries(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-a")
+	ctx := context.Background()
+
+	insertSQLiteTestEvent(t, db, "1", time.Now())
+	_, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+
+	require.NoError(t, repo.IncrementRetryCount(ctx, "1"))
+	require.NoError(t, repo.RenewLease(ctx, "1"))
+	require.NoError(t, repo.SetStatusAndIncrementRetry(ctx, "1", schema.StatusFailed))
+
+	status, lockedBy, retryCount := readSQLiteTestEvent(t, db, "1")
+	assert.Equal(t, string(schema.StatusFailed), status)
+	assert.False(t, lockedBy.Valid)
+	assert.Equal(t, 2, retryCount)
+
+	// The lease was released, so further updates are rejected.
+	assert.ErrorIs(t, repo.SetStatus(ctx, "1", schema.StatusPending), ErrLeaseLost)
+	assert.ErrorIs(t, repo.RenewLease(ctx, "1"), ErrLeaseLost)
+}
+
+func TestSQLiteMarkProcessedBatch_CommitsOwnedEventsWhenSomeLeasesAreLost(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-a")
+	ctx := context.Background()
+
+	insertSQLiteTestEvent(t, db, "1", time.Now())
+	insertSQLiteTestEvent(t, db, "2", time.Now())
+	_, err := repo.FetchPending(ctx, 1)
+	require.NoError(t, err)
+
+	err = repo.MarkProcessedBatch(ctx, []SentEvent{{EventID: "1", MessageID: "msg-1", SentAt: time.Now()}, {EventID: "2", SentAt: time.Now()}})
+	assert.ErrorIs(t, err, ErrLeaseLost)
+
+	status, _, _ := readSQLiteTestEvent(t, db, "1")
+	assert.Equal(t, string(schema.StatusSent), status)
+	status, _, _ = readSQLiteTestEvent(t, db, "2")
+	assert.Equal(t, string(schema.StatusPending), status)
+}
+
+func TestSQLiteScheduleRetryBatch(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-a")
+	ctx := context.Background()
+
+	insertSQLiteTestEvent(t, db, "1", time.Now())
+	insertSQLiteTestEvent(t, db, "2", time.Now())
+	_, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+
+	require.NoError(t, repo.ScheduleRetryBatch(ctx, map[string]time.Time{
+		"1": time.Now().Add(-time.Second),
+		"2": time.Now().Add(time.Hour),
+	}))
+
+	status, lockedBy, retryCount := readSQLiteTestEvent(t, db, "2")
+	assert.Equal(t, string(schema.StatusPending), status)
+	assert.False(t, lockedBy.Valid)
+	assert.Equal(t, 1, retryCount)
+
+	// Only the event whose next attempt is due is fetched again.
+	events, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "1", events[0].ID)
+}
+
+func TestSQLiteRecordAttempts(t *testing.T) {
+	db := openSQLiteTestDB(t)
+	repo := newSQLiteTestRepository(db, "instance-a")
+	repo.AttemptHistory = true
+
+	insertSQLiteTestEvent(t, db, "1", time.Now())
+	now := time.Now()
+	err := repo.RecordAttempts(context.Background(), []schema.EventAttempt{
+		{EventID: "1", AttemptedAt: now, Broker: "rabbitmq", Error: "connection refused"},
+		{EventID: "1", AttemptedAt: now.Add(time.Second), Broker: "rabbitmq"},
+		{EventID: "missing", AttemptedAt: now, Broker: "rabbitmq", Error: "timeout"},
+	})
+	require.NoError(t, err)
+
+	var lastError string
+	require.NoError(t, db.QueryRow(`SELECT last_error FROM outbox_events WHERE id='1'`).Scan(&lastError))
+	assert.Equal(t, "connection refused", lastError)
+
+	rows, err := db.Query(`SELECT event_id, instance_id, error FROM outbox_event_attempts ORDER BY attempted_at`)
+	require.NoError(t, err)
+	defer rows.Close()
+	var recorded []string
+	for rows.Next() {
+		var eventID, instanceID string
+		var attemptError sql.NullString
+		require.NoError(t, rows.Scan(&eventID, &instanceID, &attemptError))
+		recorded = append(recorded, eventID+"/"+instanceID+"/"+attemptError.String)
+	}
+	assert.Equal(t, []string{"1/instance-a/connection refused", "1/instance-a/"}, recorded)
+}
+
+func TestSQLitePurge(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("archive=%t", archive), func(t *testing.T) {
+			db := openSQLiteTestDB(t)
+			repo := newSQLiteTestRepository(db, "instance-a")
+			repo.AttemptHistory = true
+			ctx := context.Background()
+
+			for _, id := range []string{"old-1", "old-2", "recent"} {
+				insertSQLiteTestEvent(t, db, id, time.Now())
+			}
+			_, err := db.Exec(`UPDATE outbox_events SET status='sent', updated_at=? WHERE id LIKE 'old-%'`, time.Now().Add(-time.Hour).UTC())
+			require.NoError(t, err)
+			_, err = db.Exec(`UPDATE outbox_events SET status='sent' WHERE id='recent'`)
+			require.NoError(t, err)
+			require.NoError(t, repo.RecordAttempts(ctx, []schema.EventAttempt{{EventID: "old-1", AttemptedAt: time.Now(), Broker: "rabbitmq"}}))
+
+			purged, err := repo.Purge(ctx, schema.StatusSent, time.Now().Add(-time.Minute), 10, archive)
+			require.NoError(t, err)
+			assert.Equal(t, 2, purged)
+
+			var remaining, archived, attempts int
+			require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM outbox_events`).Scan(&remaining))
+			require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM outbox_events_archive`).Scan(&archived))
+			require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM outbox_event_attempts`).Scan(&attempts))
+			assert.Equal(t, 1, remaining)
+			assert.Equal(t, 0, attempts)
+			if archive {
+				assert.Equal(t, 2, archived)
+			} else {
+				assert.Equal(t, 0, archived)
+			}
+		})
+	}
+}
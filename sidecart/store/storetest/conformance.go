@@ -0,0 +1,376 @@
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"github.com/zoff-tech/go-outbox/store"
+)
+
+// Harness gives the conformance suite access to an empty outbox of the backend under test.
+type Harness struct {
+	// NewRepository returns a repository of the outbox claiming events as instanceID. The
+	// suite creates several to play several sidecar replicas.
+	NewRepository func(t *testing.T, instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository
+	// Insert stores events as the application would, keeping their ID, Entity, EntityType,
+	// Payload, Headers, RoutingKey, Status, RetryCount, CreatedAt and UpdatedAt.
+	Insert func(t *testing.T, events ...schema.OutboxEvent)
+}
+
+// conformanceLease is the lease duration of the repositories in scenarios that let leases
+// expire, long enough for slow backends to claim and update events within it.
+const conformanceLease = time.Second
+
+// RunConformance runs the scenarios every store.OutBoxRepository must pass, each as a
+// subtest of t. newHarness is called once per scenario and must return a harness for an
+// empty outbox.
+func RunConformance(t *testing.T, newHarness func(t *testing.T) Harness) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, h Harness)
+	}{
+		{"FetchesInCreationOrder", testFetchesInCreationOrder},
+		{"RoundTripsEventFields", testRoundTripsEventFields},
+		{"ClaimsEachEventOnceUnderConcurrency", testClaimsEachEventOnceUnderConcurrency},
+		{"ReclaimsExpiredLeases", testReclaimsExpiredLeases},
+		{"RenewLeaseKeepsTheClaim", testRenewLeaseKeepsTheClaim},
+		{"SetStatusReleasesTheLease", testSetStatusReleasesTheLease},
+		{"ScheduleRetryDefersTheNextAttempt", testScheduleRetryDefersTheNextAttempt},
+		{"DeferBatchKeepsTheRetryCount", testDeferBatchKeepsTheRetryCount},
+		{"FailsEventsThatExhaustedTheirRetries", testFailsEventsThatExhaustedTheirRetries},
+		{"BatchUpdatesReportLostLeases", testBatchUpdatesReportLostLeases},
+		{"PurgesOldEventsByStatus", testPurgesOldEventsByStatus},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			scenario.run(t, newHarness(t))
+		})
+	}
+}
+
+// conformanceEvent returns a pending event created at the given time.
+func conformanceEvent(id string, createdAt time.Time) schema.OutboxEvent {
+	return schema.OutboxEvent{
+		ID:         id,
+		Entity:     "orders",
+		EntityType: "direct",
+		Payload:    []byte(`{"id":"` + id + `"}`),
+		Status:     schema.StatusPending,
+		CreatedAt:  createdAt,
+		UpdatedAt:  createdAt,
+		RoutingKey: "order.created",
+	}
+}
+
+func eventIDs(events []schema.OutboxEvent) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func testFetchesInCreationOrder(t *testing.T, h Harness) {
+	ctx := context.Background()
+	repo := h.NewRepository(t, "instance-a", 0, nil)
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		h.Insert(t, conformanceEvent(fmt.Sprintf("event-%d", i), base.Add(time.Duration(i)*time.Second)))
+	}
+
+	events, err := repo.FetchPending(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"event-0", "event-1", "event-2"}, eventIDs(events))
+
+	events, err = repo.FetchPending(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"event-3", "event-4"}, eventIDs(events))
+
+	events, err = repo.FetchPending(ctx, 3)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func testRoundTripsEventFields(t *testing.T, h Harness) {
+	repo := h.NewRepository(t, "instance-a", 0, nil)
+
+	createdAt := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	event := conformanceEvent("with-headers", createdAt)
+	event.Entity = "payments"
+	event.EntityType = "topic"
+	event.Payload = []byte{0, 1, 2, 0xfe, 0xff}
+	event.Headers = map[string]string{
+		"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"tenant":      "acme \"quoted\" ünïcode",
+	}
+	event.RoutingKey = "payment.captured"
+	event.RetryCount = 1
+	h.Insert(t, event, conformanceEvent("without-headers", createdAt.Add(time.Second)))
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	fetched := events[0]
+	assert.Equal(t, event.ID, fetched.ID)
+	assert.Equal(t, event.Entity, fetched.Entity)
+	assert.Equal(t, event.EntityType, fetched.EntityType)
+	assert.Equal(t, event.Payload, fetched.Payload)
+	assert.Equal(t, event.Headers, fetched.Headers)
+	assert.Equal(t, event.RoutingKey, fetched.RoutingKey)
+	assert.Equal(t, event.RetryCount, fetched.RetryCount)
+	assert.WithinDuration(t, createdAt, fetched.CreatedAt, time.Millisecond)
+	assert.Empty(t, events[1].Headers)
+}
+
+func testClaimsEachEventOnceUnderConcurrency(t *testing.T, h Harness) {
+	const events, instances = 40, 4
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < events; i++ {
+		h.Insert(t, conformanceEvent(fmt.Sprintf("event-%02d", i), base.Add(time.Duration(i)*time.Millisecond)))
+	}
+
+	var mu sync.Mutex
+	claims := make(map[string][]string)
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		instanceID := fmt.Sprintf("instance-%d", i)
+		repo := h.NewRepository(t, instanceID, 0, nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				claimed, err := repo.FetchPending(context.Background(), 5)
+				if !assert.NoError(t, err) || len(claimed) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, event := range claimed {
+					claims[event.ID] = append(claims[event.ID], instanceID)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claims, events)
+	for id, claimedBy := range claims {
+		assert.Len(t, claimedBy, 1, "event %s was claimed by %v", id, claimedBy)
+	}
+}
+
+func testReclaimsExpiredLeases(t *testing.T, h Harness) {
+	ctx := context.Background()
+	first := h.NewRepository(t, "instance-a", conformanceLease, nil)
+	second := h.NewRepository(t, "instance-b", conformanceLease, nil)
+	h.Insert(t, conformanceEvent("1", time.Now().Add(-time.Minute)))
+
+	events, err := first.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, eventIDs(events))
+
+	events, err = second.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, events, "a leased event must not be claimed by another instance")
+
+	time.Sleep(conformanceLease + conformanceLease/2)
+	events, err = second.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, eventIDs(events), "an expired lease must be taken over")
+
+	assert.ErrorIs(t, first.MarkProcessed(ctx, "1", "msg-a"), store.ErrLeaseLost)
+	assert.ErrorIs(t, first.SetStatus(ctx, "1", schema.StatusFailed), store.ErrLeaseLost)
+	assert.ErrorIs(t, first.ScheduleRetry(ctx, "1", time.Now()), store.ErrLeaseLost)
+	assert.ErrorIs(t, first.RenewLease(ctx, "1"), store.ErrLeaseLost)
+	require.NoError(t, second.MarkProcessed(ctx, "1", "msg-b"))
+
+	// A sent event is never claimed again.
+	events, err = first.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func testRenewLeaseKeepsTheClaim(t *testing.T, h Harness) {
+	ctx := context.Background()
+	owner := h.NewRepository(t, "instance-a", conformanceLease, nil)
+	other := h.NewRepository(t, "instance-b", conformanceLease, nil)
+	h.Insert(t, conformanceEvent("1", time.Now().Add(-time.Minute)))
+
+	events, err := owner.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(conformanceLease / 2)
+		require.NoError(t, owner.RenewLease(ctx, "1"))
+	}
+	events, err = other.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, events, "a renewed lease must not expire")
+
+	require.NoError(t, owner.MarkProcessed(ctx, "1", "msg-1"))
+	assert.ErrorIs(t, owner.RenewLease(ctx, "1"), store.ErrLeaseLost, "a processed event has no lease to renew")
+}
+
+func testSetStatusReleasesTheLease(t *testing.T, h Harness) {
+	ctx := context.Background()
+	first := h.NewRepository(t, "instance-a", 0, nil)
+	second := h.NewRepository(t, "instance-b", 0, nil)
+	h.Insert(t, conformanceEvent("1", time.Now().Add(-time.Minute)))
+
+	events, err := first.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.NoError(t, first.SetStatus(ctx, "1", schema.StatusPending))
+
+	events, err = second.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, eventIDs(events), "a released event must be claimable right away")
+}
+
+func testScheduleRetryDefersTheNextAttempt(t *testing.T, h Harness) {
+	ctx := context.Background()
+	repo := h.NewRepository(t, "instance-a", 0, nil)
+	base := time.Now().Add(-time.Minute)
+	h.Insert(t, conformanceEvent("later", base), conformanceEvent("due", base.Add(time.Second)), conformanceEvent("batched", base.Add(2*time.Second)))
+
+	events, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	require.NoError(t, repo.ScheduleRetry(ctx, "later", time.Now().Add(time.Hour)))
+	require.NoError(t, repo.ScheduleRetry(ctx, "due", time.Now().Add(-time.Second)))
+	require.NoError(t, repo.ScheduleRetryBatch(ctx, map[string]time.Time{"batched": time.Now().Add(-time.Second)}))
+
+	events, err = repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"due", "batched"}, eventIDs(events))
+	for _, event := range events {
+		assert.Equal(t, 1, event.RetryCount, event.ID)
+	}
+}
+
+func testDeferBatchKeepsTheRetryCount(t *testing.T, h Harness) {
+	ctx := context.Background()
+	repo := h.NewRepository(t, "instance-a", 0, nil)
+	other := h.NewRepository(t, "instance-b", 0, nil)
+	base := time.Now().Add(-time.Minute)
+	h.Insert(t, conformanceEvent("held", base), conformanceEvent("due", base.Add(time.Second)))
+
+	events, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	require.NoError(t, repo.DeferBatch(ctx, map[string]time.Time{"held": time.Now().Add(time.Hour), "due": time.Now().Add(-time.Second)}))
+	assert.ErrorIs(t, other.DeferBatch(ctx, map[string]time.Time{"due": time.Now()}), store.ErrLeaseLost)
+
+	events, err = repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"due"}, eventIDs(events))
+	for _, event := range events {
+		assert.Zero(t, event.RetryCount, event.ID)
+	}
+}
+
+func testFailsEventsThatExhaustedTheirRetries(t *testing.T, h Harness) {
+	ctx := context.Background()
+	repo := h.NewRepository(t, "instance-a", 0, config.NewRetryPolicy(2, map[string]int{"payments": 5}))
+
+	base := time.Now().Add(-time.Minute)
+	exhausted := conformanceEvent("exhausted", base)
+	exhausted.RetryCount = 3
+	atLimit := conformanceEvent("at-limit", base.Add(time.Second))
+	atLimit.RetryCount = 2
+	overridden := conformanceEvent("overridden", base.Add(2*time.Second))
+	overridden.Entity = "payments"
+	overridden.RetryCount = 3
+	h.Insert(t, exhausted, atLimit, overridden)
+
+	events, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"at-limit", "overridden"}, eventIDs(events))
+
+	// The exhausted event was marked failed, so it is not fetched again either.
+	require.NoError(t, repo.SetStatus(ctx, "at-limit", schema.StatusPending))
+	events, err = repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"at-limit"}, eventIDs(events))
+}
+
+func testBatchUpdatesReportLostLeases(t *testing.T, h Harness) {
+	ctx := context.Background()
+	first := h.NewRepository(t, "instance-a", 0, nil)
+	second := h.NewRepository(t, "instance-b", 0, nil)
+	base := time.Now().Add(-time.Minute)
+	h.Insert(t, conformanceEvent("owned", base), conformanceEvent("foreign", base.Add(time.Second)), conformanceEvent("retried", base.Add(2*time.Second)))
+
+	events, err := first.FetchPending(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"owned"}, eventIDs(events))
+	events, err = second.FetchPending(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"foreign"}, eventIDs(events))
+	events, err = first.FetchPending(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"retried"}, eventIDs(events))
+
+	// Updates of owned events are kept even though the batch reports the lost lease.
+	err = first.MarkProcessedBatch(ctx, []store.SentEvent{
+		{EventID: "owned", MessageID: "msg-1", SentAt: time.Now()},
+		{EventID: "foreign", MessageID: "msg-2", SentAt: time.Now()},
+	})
+	assert.ErrorIs(t, err, store.ErrLeaseLost)
+	err = first.ScheduleRetryBatch(ctx, map[string]time.Time{"retried": time.Now().Add(-time.Second), "foreign": time.Now()})
+	assert.ErrorIs(t, err, store.ErrLeaseLost)
+
+	require.NoError(t, second.SetStatus(ctx, "foreign", schema.StatusPending))
+	events, err = first.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foreign", "retried"}, eventIDs(events), "the owned event must have been marked processed")
+}
+
+func testPurgesOldEventsByStatus(t *testing.T, h Harness) {
+	ctx := context.Background()
+	repo := h.NewRepository(t, "instance-a", 0, nil)
+
+	old := time.Now().Add(-2 * time.Hour)
+	var events []schema.OutboxEvent
+	for i, status := range []schema.Status{schema.StatusSent, schema.StatusSent, schema.StatusSent, schema.StatusFailed} {
+		event := conformanceEvent(fmt.Sprintf("old-%d", i), old.Add(time.Duration(i)*time.Second))
+		event.Status = status
+		events = append(events, event)
+	}
+	recent := conformanceEvent("recent", time.Now())
+	recent.Status = schema.StatusSent
+	pending := conformanceEvent("pending", old)
+	h.Insert(t, append(events, recent, pending)...)
+
+	var purged []int
+	for {
+		n, err := repo.Purge(ctx, schema.StatusSent, time.Now().Add(-time.Hour), 2, false)
+		require.NoError(t, err)
+		purged = append(purged, n)
+		if n < 2 {
+			break
+		}
+	}
+	assert.Equal(t, []int{2, 1}, purged)
+
+	n, err := repo.Purge(ctx, schema.StatusFailed, time.Now().Add(-time.Hour), 10, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Only the pending event is left to claim; the recent sent event is kept but not claimable.
+	fetched, err := repo.FetchPending(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pending"}, eventIDs(fetched))
+}
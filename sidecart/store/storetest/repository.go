@@ -0,0 +1,438 @@
+// Package storetest provides an in-memory OutBoxRepository for tests.
+package storetest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"github.com/zoff-tech/go-outbox/store"
+)
+
+// Repository is a thread-safe, in-memory store.OutBoxRepository. It claims, leases, retries
+// and purges events the way the database repositories do, so processor configurations can
+// be tested without a database. Set Clock to control time.
+type Repository struct {
+	// RetryPolicy decides when fetched events have exhausted their retries (default config.DefaultMaxRetries).
+	RetryPolicy *config.RetryPolicy
+	// InstanceID owns the leases of the events claimed through this repository.
+	InstanceID string
+	// LeaseDuration is how long a claim lasts unless renewed (default store.DefaultLeaseDuration).
+	LeaseDuration time.Duration
+	// AttemptHistory keeps every publish attempt, see Attempts.
+	AttemptHistory bool
+	// Clock returns the current time (default time.Now).
+	Clock func() time.Time
+
+	s *state
+}
+
+// state is the outbox shared by the repositories of all instances.
+type state struct {
+	mu            sync.Mutex
+	events        map[string]*record
+	archive       map[string]schema.OutboxEvent
+	attempts      []schema.EventAttempt
+	notifications chan struct{}
+	closed        bool
+}
+
+// record is a stored event along with its lease.
+type record struct {
+	event       schema.OutboxEvent
+	lockedBy    string
+	lockedUntil time.Time
+}
+
+// NewRepository creates an empty repository whose leases belong to instanceID.
+func NewRepository(instanceID string, retryPolicy *config.RetryPolicy) *Repository {
+	return &Repository{
+		RetryPolicy: retryPolicy,
+		InstanceID:  instanceID,
+		s: &state{
+			events:        make(map[string]*record),
+			archive:       make(map[string]schema.OutboxEvent),
+			notifications: make(chan struct{}, 1),
+		},
+	}
+}
+
+// ForInstance returns a repository of another instance sharing this outbox, as another
+// sidecar replica would, with the same settings.
+func (r *Repository) ForInstance(instanceID string) *Repository {
+	other := *r
+	other.InstanceID = instanceID
+	return &other
+}
+
+// Insert adds events to the outbox, as the application would, and wakes up the processor.
+// Events without a status are pending, and zero timestamps are set to the current time.
+func (r *Repository) Insert(events ...schema.OutboxEvent) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := r.now()
+	for _, event := range events {
+		event = copyEvent(event)
+		if event.Status == "" {
+			event.Status = schema.StatusPending
+		}
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = now
+		}
+		if event.UpdatedAt.IsZero() {
+			event.UpdatedAt = event.CreatedAt
+		}
+		r.s.events[event.ID] = &record{event: event}
+	}
+
+	select {
+	case r.s.notifications <- struct{}{}:
+	default:
+	}
+}
+
+// Notifications implements store.Notifier: it receives a value after every Insert.
+func (r *Repository) Notifications() <-chan struct{} {
+	return r.s.notifications
+}
+
+// Event returns the stored event with the given ID.
+func (r *Repository) Event(id string) (schema.OutboxEvent, bool) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	rec, ok := r.s.events[id]
+	if !ok {
+		return schema.OutboxEvent{}, false
+	}
+	return copyEvent(rec.event), true
+}
+
+// Events returns the stored events, ordered by creation time.
+func (r *Repository) Events() []schema.OutboxEvent {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	events := make([]schema.OutboxEvent, 0, len(r.s.events))
+	for _, rec := range r.sorted(func(rec *record) bool { return true }) {
+		events = append(events, copyEvent(rec.event))
+	}
+	return events
+}
+
+// LockedBy returns the instance holding the lease of the event, or "" when it is not leased.
+func (r *Repository) LockedBy(id string) string {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if rec, ok := r.s.events[id]; ok {
+		return rec.lockedBy
+	}
+	return ""
+}
+
+// Attempts returns the recorded publish attempts, in the order they were recorded.
+func (r *Repository) Attempts() []schema.EventAttempt {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	return append([]schema.EventAttempt(nil), r.s.attempts...)
+}
+
+// Archived returns the events purged with archive set, ordered by ID.
+func (r *Repository) Archived() []schema.OutboxEvent {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	events := make([]schema.OutboxEvent, 0, len(r.s.archive))
+	for _, event := range r.s.archive {
+		events = append(events, copyEvent(event))
+	}
+	sort.Slice(events, func(a, b int) bool { return events[a].ID < events[b].ID })
+	return events
+}
+
+// Closed reports whether Close was called.
+func (r *Repository) Closed() bool {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	return r.s.closed
+}
+
+func (r *Repository) FetchPending(ctx context.Context, batchSize int) ([]schema.OutboxEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := r.now()
+	due := r.sorted(func(rec *record) bool {
+		switch rec.event.Status {
+		case schema.StatusPending:
+			return rec.event.NextAttemptAt.IsZero() || !rec.event.NextAttemptAt.After(now)
+		case schema.StatusProcessing:
+			return rec.lockedUntil.Before(now)
+		}
+		return false
+	})
+	if len(due) > batchSize {
+		due = due[:batchSize]
+	}
+
+	// Events already retried beyond their limit are marked failed and not returned.
+	var claimed []schema.OutboxEvent
+	for _, rec := range due {
+		rec.event.UpdatedAt = now
+		if rec.event.RetryCount > r.RetryPolicy.MaxRetriesFor(rec.event.Entity) {
+			rec.event.Status = schema.StatusFailed
+			rec.lockedBy, rec.lockedUntil = "", time.Time{}
+			continue
+		}
+		rec.event.Status = schema.StatusProcessing
+		rec.lockedBy, rec.lockedUntil = r.InstanceID, now.Add(r.leaseDuration())
+		claimed = append(claimed, copyEvent(rec.event))
+	}
+	return claimed, nil
+}
+
+func (r *Repository) MarkProcessed(ctx context.Context, eventID, messageID string) error {
+	return r.MarkProcessedBatch(ctx, []store.SentEvent{{EventID: eventID, MessageID: messageID, SentAt: r.now()}})
+}
+
+func (r *Repository) MarkProcessedBatch(ctx context.Context, sent []store.SentEvent) error {
+	return r.updateOwned(ctx, len(sent), func(now time.Time) int {
+		updated := 0
+		for _, s := range sent {
+			if rec := r.owned(s.EventID); rec != nil {
+				rec.event.Status = schema.StatusSent
+				rec.event.SentAt = s.SentAt
+				rec.event.MessageID = s.MessageID
+				r.release(rec, now)
+				updated++
+			}
+		}
+		return updated
+	})
+}
+
+// SetStatus sets the status of an event claimed by this instance and releases its lease.
+func (r *Repository) SetStatus(ctx context.Context, eventID string, status schema.Status) error {
+	return r.updateOwned(ctx, 1, func(now time.Time) int {
+		rec := r.owned(eventID)
+		if rec == nil {
+			return 0
+		}
+		rec.event.Status = status
+		r.release(rec, now)
+		return 1
+	})
+}
+
+func (r *Repository) SetStatusAndIncrementRetry(ctx context.Context, eventID string, status schema.Status) error {
+	return r.updateOwned(ctx, 1, func(now time.Time) int {
+		rec := r.owned(eventID)
+		if rec == nil {
+			return 0
+		}
+		rec.event.Status = status
+		rec.event.RetryCount++
+		r.release(rec, now)
+		return 1
+	})
+}
+
+func (r *Repository) ScheduleRetry(ctx context.Context, eventID string, nextAttemptAt time.Time) error {
+	return r.ScheduleRetryBatch(ctx, map[string]time.Time{eventID: nextAttemptAt})
+}
+
+func (r *Repository) ScheduleRetryBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return r.deferBatch(ctx, nextAttempts, 1)
+}
+
+func (r *Repository) DeferBatch(ctx context.Context, nextAttempts map[string]time.Time) error {
+	return r.deferBatch(ctx, nextAttempts, 0)
+}
+
+func (r *Repository) deferBatch(ctx context.Context, nextAttempts map[string]time.Time, retries int) error {
+	return r.updateOwned(ctx, len(nextAttempts), func(now time.Time) int {
+		updated := 0
+		for id, nextAttemptAt := range nextAttempts {
+			if rec := r.owned(id); rec != nil {
+				rec.event.Status = schema.StatusPending
+				rec.event.RetryCount += retries
+				rec.event.NextAttemptAt = nextAttemptAt
+				r.release(rec, now)
+				updated++
+			}
+		}
+		return updated
+	})
+}
+
+func (r *Repository) IncrementRetryCount(ctx context.Context, eventID string) error {
+	return r.updateOwned(ctx, 1, func(now time.Time) int {
+		rec := r.owned(eventID)
+		if rec == nil {
+			return 0
+		}
+		rec.event.RetryCount++
+		rec.event.UpdatedAt = now
+		return 1
+	})
+}
+
+func (r *Repository) RenewLease(ctx context.Context, eventID string) error {
+	return r.updateOwned(ctx, 1, func(now time.Time) int {
+		rec := r.owned(eventID)
+		if rec == nil || rec.event.Status != schema.StatusProcessing {
+			return 0
+		}
+		rec.lockedUntil = now.Add(r.leaseDuration())
+		rec.event.UpdatedAt = now
+		return 1
+	})
+}
+
+// RecordAttempts sets the last error of the events with a failed attempt and, when
+// AttemptHistory is set, keeps the attempts. Attempts of unknown events are skipped.
+func (r *Repository) RecordAttempts(ctx context.Context, attempts []schema.EventAttempt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, attempt := range attempts {
+		rec, ok := r.s.events[attempt.EventID]
+		if !ok {
+			continue
+		}
+		if attempt.InstanceID == "" {
+			attempt.InstanceID = r.InstanceID
+		}
+		if attempt.Failed() {
+			rec.event.LastError = attempt.Error
+		}
+		if r.AttemptHistory {
+			r.s.attempts = append(r.s.attempts, attempt)
+		}
+	}
+	return nil
+}
+
+func (r *Repository) Purge(ctx context.Context, status schema.Status, before time.Time, limit int, archive bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	expired := r.sorted(func(rec *record) bool {
+		return rec.event.Status == status && rec.event.UpdatedAt.Before(before)
+	})
+	sort.SliceStable(expired, func(a, b int) bool { return expired[a].event.UpdatedAt.Before(expired[b].event.UpdatedAt) })
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+
+	purged := make(map[string]bool, len(expired))
+	for _, rec := range expired {
+		if archive {
+			r.s.archive[rec.event.ID] = rec.event
+		}
+		delete(r.s.events, rec.event.ID)
+		purged[rec.event.ID] = true
+	}
+	attempts := r.s.attempts[:0]
+	for _, attempt := range r.s.attempts {
+		if !purged[attempt.EventID] {
+			attempts = append(attempts, attempt)
+		}
+	}
+	r.s.attempts = attempts
+	return len(expired), nil
+}
+
+func (r *Repository) Close() error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.closed = true
+	return nil
+}
+
+// updateOwned applies update under the lock and returns store.ErrLeaseLost when it updated
+// fewer than expected events. Updates of events that are still owned are kept either way.
+func (r *Repository) updateOwned(ctx context.Context, expected int, update func(now time.Time) int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if update(r.now()) < expected {
+		return store.ErrLeaseLost
+	}
+	return nil
+}
+
+// owned returns the record of the event if this instance holds its lease.
+func (r *Repository) owned(id string) *record {
+	rec, ok := r.s.events[id]
+	if !ok || rec.lockedBy != r.InstanceID {
+		return nil
+	}
+	return rec
+}
+
+func (r *Repository) release(rec *record, now time.Time) {
+	rec.lockedBy, rec.lockedUntil = "", time.Time{}
+	rec.event.UpdatedAt = now
+}
+
+// sorted returns the records matching keep, ordered by creation time and then by ID.
+func (r *Repository) sorted(keep func(rec *record) bool) []*record {
+	var records []*record
+	for _, rec := range r.s.events {
+		if keep(rec) {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(a, b int) bool {
+		if !records[a].event.CreatedAt.Equal(records[b].event.CreatedAt) {
+			return records[a].event.CreatedAt.Before(records[b].event.CreatedAt)
+		}
+		return records[a].event.ID < records[b].event.ID
+	})
+	return records
+}
+
+func (r *Repository) now() time.Time {
+	if r.Clock != nil {
+		return r.Clock()
+	}
+	return time.Now()
+}
+
+func (r *Repository) leaseDuration() time.Duration {
+	if r.LeaseDuration > 0 {
+		return r.LeaseDuration
+	}
+	return store.DefaultLeaseDuration
+}
+
+// copyEvent returns a copy of event that shares no memory with it.
+func copyEvent(event schema.OutboxEvent) schema.OutboxEvent {
+	event.Payload = append([]byte(nil), event.Payload...)
+	if event.Headers != nil {
+		headers := make(map[string]string, len(event.Headers))
+		for key, value := range event.Headers {
+			headers[key] = value
+		}
+		event.Headers = headers
+	}
+	return event
+}
@@ -0,0 +1,254 @@
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zoff-tech/go-outbox/config"
+	"github.com/zoff-tech/go-outbox/schema"
+	"github.com/zoff-tech/go-outbox/store"
+)
+
+var _ store.OutBoxRepository = (*Repository)(nil)
+var _ store.Notifier = (*Repository)(nil)
+
+// clock is a manually advanced time source.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestRepository(c *clock) *Repository {
+	repo := NewRepository("instance-a", &config.RetryPolicy{MaxRetries: 2})
+	repo.Clock = c.Now
+	repo.LeaseDuration = time.Minute
+	return repo
+}
+
+func TestFetchPending_ClaimsDueEventsInCreationOrder(t *testing.T) {
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	repo := newTestRepository(c)
+	repo.Insert(
+		schema.OutboxEvent{ID: "2", Entity: "orders", CreatedAt: c.now.Add(-time.Minute)},
+		schema.OutboxEvent{ID: "1", Entity: "orders", CreatedAt: c.now.Add(-2 * time.Minute), Headers: map[string]string{"trace": "abc"}},
+		schema.OutboxEvent{ID: "later", Entity: "orders", NextAttemptAt: c.now.Add(time.Minute)},
+		schema.OutboxEvent{ID: "sent", Entity: "orders", Status: schema.StatusSent},
+	)
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "1", events[0].ID)
+	assert.Equal(t, "2", events[1].ID)
+	assert.Equal(t, map[string]string{"trace": "abc"}, events[0].Headers)
+	assert.Equal(t, "instance-a", repo.LockedBy("1"))
+
+	// Changes to returned events do not leak into the repository.
+	events[0].Headers["trace"] = "changed"
+	stored, _ := repo.Event("1")
+	assert.Equal(t, "abc", stored.Headers["trace"])
+
+	// The scheduled event is fetched once its next attempt is due.
+	c.Advance(time.Minute)
+	events, err = repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "later", events[0].ID)
+}
+
+func TestFetchPending_LeasesAreHonouredAcrossInstances(t *testing.T) {
+	c := &clock{now: time.Now()}
+	repo := newTestRepository(c)
+	other := repo.ForInstance("instance-b")
+	repo.Insert(schema.OutboxEvent{ID: "1"})
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	events, err = other.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	// Once the lease expires, the other instance takes the event over and the first one
+	// can no longer update it.
+	c.Advance(2 * time.Minute)
+	events, err = other.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.ErrorIs(t, repo.MarkProcessed(context.Background(), "1", "msg-1"), store.ErrLeaseLost)
+	assert.ErrorIs(t, repo.RenewLease(context.Background(), "1"), store.ErrLeaseLost)
+
+	require.NoError(t, other.MarkProcessed(context.Background(), "1", "msg-1"))
+	stored, _ := repo.Event("1")
+	assert.Equal(t, schema.StatusSent, stored.Status)
+	assert.Equal(t, "msg-1", stored.MessageID)
+	assert.Equal(t, c.Now(), stored.SentAt)
+	assert.Empty(t, repo.LockedBy("1"))
+}
+
+func TestFetchPending_ConcurrentInstancesClaimEachEventOnce(t *testing.T) {
+	repo := NewRepository("instance-0", nil)
+	for i := 0; i < 100; i++ {
+		repo.Insert(schema.OutboxEvent{ID: fmt.Sprintf("event-%03d", i)})
+	}
+
+	var mu sync.Mutex
+	claims := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		instance := repo.ForInstance(fmt.Sprintf("instance-%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				events, err := instance.FetchPending(context.Background(), 3)
+				if !assert.NoError(t, err) || len(events) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, event := range events {
+					claims[event.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claims, 100)
+	for id, count := range claims {
+		assert.Equal(t, 1, count, id)
+	}
+}
+
+func TestFetchPending_MarksEventsOverTheirRetryLimitFailed(t *testing.T) {
+	repo := newTestRepository(&clock{now: time.Now()})
+	repo.Insert(schema.OutboxEvent{ID: "1", RetryCount: 3})
+
+	events, err := repo.FetchPending(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	stored, _ := repo.Event("1")
+	assert.Equal(t, schema.StatusFailed, stored.Status)
+}
+
+func TestScheduleRetryBatch(t *testing.T) {
+	c := &clock{now: time.Now()}
+	repo := newTestRepository(c)
+	repo.Insert(schema.OutboxEvent{ID: "1"}, schema.OutboxEvent{ID: "2"})
+	_, err := repo.FetchPending(context.Background(), 1)
+	require.NoError(t, err)
+
+	// Event 2 was never claimed, so the batch reports a lost lease but still retries event 1.
+	err = repo.ScheduleRetryBatch(context.Background(), map[string]time.Time{"1": c.now.Add(time.Hour), "2": c.now})
+	assert.ErrorIs(t, err, store.ErrLeaseLost)
+
+	stored, _ := repo.Event("1")
+	assert.Equal(t, schema.StatusPending, stored.Status)
+	assert.Equal(t, 1, stored.RetryCount)
+	assert.Equal(t, c.now.Add(time.Hour), stored.NextAttemptAt)
+	assert.Empty(t, repo.LockedBy("1"))
+}
+
+func TestRecordAttempts(t *testing.T) {
+	repo := newTestRepository(&clock{now: time.Now()})
+	repo.AttemptHistory = true
+	repo.Insert(schema.OutboxEvent{ID: "1"})
+
+	err := repo.RecordAttempts(context.Background(), []schema.EventAttempt{
+		{EventID: "1", Broker: "rabbitmq", Error: "nack"},
+		{EventID: "1", Broker: "rabbitmq", InstanceID: "instance-b"},
+		{EventID: "missing", Broker: "rabbitmq", Error: "nack"},
+	})
+	require.NoError(t, err)
+
+	stored, _ := repo.Event("1")
+	assert.Equal(t, "nack", stored.LastError)
+	assert.Equal(t, []schema.EventAttempt{
+		{EventID: "1", Broker: "rabbitmq", InstanceID: "instance-a", Error: "nack"},
+		{EventID: "1", Broker: "rabbitmq", InstanceID: "instance-b"},
+	}, repo.Attempts())
+}
+
+func TestPurge(t *testing.T) {
+	c := &clock{now: time.Now()}
+	repo := newTestRepository(c)
+	repo.AttemptHistory = true
+	repo.Insert(
+		schema.OutboxEvent{ID: "old", Status: schema.StatusSent, UpdatedAt: c.now.Add(-2 * time.Hour)},
+		schema.OutboxEvent{ID: "older", Status: schema.StatusSent, UpdatedAt: c.now.Add(-3 * time.Hour)},
+		schema.OutboxEvent{ID: "recent", Status: schema.StatusSent},
+		schema.OutboxEvent{ID: "failed", Status: schema.StatusFailed, UpdatedAt: c.now.Add(-3 * time.Hour)},
+	)
+	require.NoError(t, repo.RecordAttempts(context.Background(), []schema.EventAttempt{{EventID: "older"}, {EventID: "recent"}}))
+
+	purged, err := repo.Purge(context.Background(), schema.StatusSent, c.now.Add(-time.Hour), 1, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	_, ok := repo.Event("older")
+	assert.False(t, ok)
+	require.Len(t, repo.Archived(), 1)
+	assert.Equal(t, "older", repo.Archived()[0].ID)
+	require.Len(t, repo.Attempts(), 1)
+	assert.Equal(t, "recent", repo.Attempts()[0].EventID)
+
+	purged, err = repo.Purge(context.Background(), schema.StatusSent, c.now.Add(-time.Hour), 10, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Len(t, repo.Events(), 2)
+	assert.Len(t, repo.Archived(), 1)
+}
+
+func TestInsert_Notifies(t *testing.T) {
+	repo := NewRepository("instance-a", nil)
+	repo.Insert(schema.OutboxEvent{ID: "1"})
+	repo.Insert(schema.OutboxEvent{ID: "2"})
+
+	select {
+	case <-repo.Notifications():
+	default:
+		t.Fatal("no notification after Insert")
+	}
+	select {
+	case <-repo.Notifications():
+		t.Fatal("notifications are not coalesced")
+	default:
+	}
+}
+
+func TestRepository_Conformance(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Harness {
+		outbox := NewRepository("", nil)
+		return Harness{
+			NewRepository: func(t *testing.T, instanceID string, leaseDuration time.Duration, retryPolicy *config.RetryPolicy) store.OutBoxRepository {
+				repo := outbox.ForInstance(instanceID)
+				repo.LeaseDuration = leaseDuration
+				repo.RetryPolicy = retryPolicy
+				return repo
+			},
+			Insert: func(t *testing.T, events ...schema.OutboxEvent) {
+				outbox.Insert(events...)
+			},
+		}
+	})
+}
@@ -8,8 +8,10 @@ import (
 
 	"github.com/zoff-tech/go-outbox/config"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
@@ -52,10 +54,33 @@ func Init(cfg config.Observability) (func(), error) {
 	)
 	otel.SetTracerProvider(tp)
 
+	// Export metrics, such as the delivery latency of events, over OTLP when a metrics
+	// endpoint is configured
+	var mp *metric.MeterProvider
+	if cfg.MetricsURL != "" {
+		metricExporter, err := otlpmetrichttp.New(context.Background(),
+			otlpmetrichttp.WithEndpoint(cfg.MetricsURL),
+			otlpmetrichttp.WithInsecure(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create metric exporter: %w", err)
+		}
+		mp = metric.NewMeterProvider(
+			metric.WithReader(metric.NewPeriodicReader(metricExporter)),
+			metric.WithResource(res),
+		)
+		otel.SetMeterProvider(mp)
+	}
+
 	// Return a shutdown function to clean up resources
 	return func() {
 		if err := tp.Shutdown(context.Background()); err != nil {
 			log.Printf("Error shutting down tracer provider: %v", err)
 		}
+		if mp != nil {
+			if err := mp.Shutdown(context.Background()); err != nil {
+				log.Printf("Error shutting down meter provider: %v", err)
+			}
+		}
 	}, nil
 }
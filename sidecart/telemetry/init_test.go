@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/zoff-tech/go-outbox/config"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/metric"
 )
 
 func TestInit_Success(t *testing.T) {
@@ -69,3 +70,21 @@ func TestInit_Shutdown(t *testing.T) {
 	// Call the shutdown function and ensure it completes without errors
 	shutdown()
 }
+
+func TestInit_WithMetricsURL(t *testing.T) {
+	// Mock observability configuration with an OTLP metrics endpoint
+	cfg := config.Observability{
+		ServiceName: "test-service",
+		TracingURL:  "localhost:4318",
+		MetricsURL:  "localhost:4318",
+	}
+
+	// Call Init and ensure the global meter provider is the SDK one
+	shutdown, err := Init(cfg)
+	assert.NoError(t, err)
+	assert.NotNil(t, shutdown)
+	assert.IsType(t, &metric.MeterProvider{}, otel.GetMeterProvider())
+
+	// Shutdown telemetry and ensure no errors occur
+	shutdown()
+}